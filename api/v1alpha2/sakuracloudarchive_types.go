@@ -0,0 +1,158 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ArchiveFinalizer allows ReconcileSakuraCloudArchive to clean up SakuraCloud
+	// archives before removing it from the API server.
+	ArchiveFinalizer = "sakuracloudarchive.infrastructure.cluster.x-k8s.io"
+)
+
+// SakuraCloudArchiveSpec defines the desired state of SakuraCloudArchive.
+// Only Zones can be changed after the archive is imported, other changes are reported by
+// Status.ErrorMessage and not applied. Create a new SakuraCloudArchive to import another image.
+type SakuraCloudArchiveSpec struct {
+	// Zone is the zone the image is uploaded to first.
+	Zone string `json:"zone"`
+
+	// Zones is the list of the zones the archive is copied to in addition to Zone.
+	// The image is uploaded to each zone separately, as the archives can't be transferred between zones.
+	// Zones added later are uploaded to without changing the existing archives.
+	// +optional
+	Zones []string `json:"zones,omitempty"`
+
+	// Source is the image uploaded to the archive.
+	Source ArchiveSource `json:"source"`
+
+	// SizeGB is the size of the archive. Defaults to 20.
+	// +optional
+	SizeGB int `json:"sizeGB,omitempty"`
+
+	// Description .
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Tags is the additional tags of the archive.
+	// e.g. k8s-version=1.16.2 to select the archive from the Kubernetes version of Machines
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+}
+
+// ArchiveSource describes the image uploaded to an archive.
+// Exactly one of URL or Path must be specified.
+type ArchiveSource struct {
+	// URL is the HTTP(S) URL of the image.
+	// The scheme and the host must be allowed by the --archive-source-url-schemes and --archive-source-hosts flags of the controller.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Path is the path of the image relative to the directory set by the --archive-image-dir flag of the controller.
+	// Paths outside the directory are rejected.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// SakuraCloudArchiveStatus defines the observed state of SakuraCloudArchive
+type SakuraCloudArchiveStatus struct {
+	// Ready is true when the archive is available in all zones.
+	Ready bool `json:"ready"`
+
+	// State is the state of the archive.
+	// +optional
+	State ArchiveState `json:"state,omitempty"`
+
+	// ArchiveIDs is the IDs of the archives, keyed by zone.
+	// +optional
+	ArchiveIDs map[string]string `json:"archiveIDs,omitempty"`
+
+	// SpecHash is the hash of the spec the archives are imported with, except the zones.
+	// It is used to detect the changes which can't be applied.
+	// +optional
+	SpecHash string `json:"specHash,omitempty"`
+
+	// JobRef is a managed object reference to a Job related to the
+	// SakuraCloud resources.
+	// This value is set automatically at runtime and should not be set or
+	// modified by users.
+	// +optional
+	JobRef string `json:"jobRef,omitempty"`
+
+	// ErrorMessage will be set in the event that there is a terminal problem
+	// importing the archive and will contain a verbose string suitable
+	// for logging and human consumption.
+	// +optional
+	ErrorMessage *string `json:"errorMessage,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=sakuracloudarchives,scope=Namespaced,categories=cluster-api
+// +kubebuilder:storageversion
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Zone",type="string",JSONPath=".spec.zone",description="name of the SakuraCloud zone"
+// +kubebuilder:printcolumn:name="State",type="string",JSONPath=".status.state",description="state of the archive"
+// +kubebuilder:printcolumn:name="Ready",type="boolean",JSONPath=".status.ready",description="archive is available in all zones"
+
+// SakuraCloudArchive is the Schema for the sakuracloudarchives API
+type SakuraCloudArchive struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SakuraCloudArchiveSpec   `json:"spec,omitempty"`
+	Status SakuraCloudArchiveStatus `json:"status,omitempty"`
+}
+
+// Zones returns the names of all zones the archive is placed in.
+func (a *SakuraCloudArchive) Zones() []string {
+	zones := []string{a.Spec.Zone}
+	for _, zone := range a.Spec.Zones {
+		if !containsString(zones, zone) {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// HasZone returns true if the archive is placed in the zone.
+func (a *SakuraCloudArchive) HasZone(zone string) bool {
+	return containsString(a.Zones(), zone)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// +kubebuilder:object:root=true
+
+// SakuraCloudArchiveList contains a list of SakuraCloudArchive
+type SakuraCloudArchiveList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SakuraCloudArchive `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SakuraCloudArchive{}, &SakuraCloudArchiveList{})
+}
@@ -30,8 +30,223 @@ const (
 
 // SakuraCloudClusterSpec defines the desired state of SakuraCloudCluster
 type SakuraCloudClusterSpec struct {
-	Zone                       string                    `json:"zone"`
+	Zone string `json:"zone"`
+
+	// Zones is the list of the zones used as failure domains in addition to Zone.
+	// Machines without a zone are spread across Zone and Zones.
+	// +optional
+	Zones []string `json:"zones,omitempty"`
+
 	CloudProviderConfiguration SakuraCloudProviderConfig `json:"cloudProviderConfiguration,omitempty"`
+
+	// PacketFilter is the packet filter attached to the NICs of the cluster's servers.
+	// If not specified, the packet filter is created with the default rules.
+	// +optional
+	PacketFilter *PacketFilterSpec `json:"packetFilter,omitempty"`
+
+	// ShutdownTimeout is the default of the shutdownTimeout of the SakuraCloudMachines,
+	// how long to wait for servers to shut down via ACPI before deleting them.
+	// It also applies to the servers left when the cluster is deleted.
+	// Defaults to 5m. 0s powers off servers forcibly without waiting.
+	// +optional
+	ShutdownTimeout *metav1.Duration `json:"shutdownTimeout,omitempty"`
+
+	// ControlPlaneBackup is the default of the backup schedule of the control-plane machines.
+	// +optional
+	ControlPlaneBackup *BackupSpec `json:"controlPlaneBackup,omitempty"`
+
+	// DNS is the SakuraCloud DNS zone the records of the API endpoint and the nodes are maintained in.
+	// If specified, the record of the API endpoint is used as the host of the API endpoint.
+	// +optional
+	DNS *DNSSpec `json:"dns,omitempty"`
+}
+
+// ClusterInventory summarizes the SakuraCloud resources owned by a cluster
+type ClusterInventory struct {
+	// Servers is the servers of the cluster.
+	// +optional
+	Servers []InventoryServer `json:"servers,omitempty"`
+
+	// ServerCounts is the number of the servers by role and instance status.
+	// +optional
+	ServerCounts []InventoryServerCount `json:"serverCounts,omitempty"`
+
+	// Disks is the disks of the cluster, including the ones not connected to any server.
+	// +optional
+	Disks []InventoryResource `json:"disks,omitempty"`
+
+	// ISOImages is the ISO images holding the cloud-init data of the servers.
+	// +optional
+	ISOImages []InventoryResource `json:"isoImages,omitempty"`
+
+	// Appliances is the switches, load balancers and packet filters of the cluster.
+	// +optional
+	Appliances []InventoryResource `json:"appliances,omitempty"`
+
+	// Archives is the backups of the disks of the cluster.
+	// +optional
+	Archives []InventoryResource `json:"archives,omitempty"`
+
+	// TotalCPUs is the total number of the virtual processors of the servers.
+	TotalCPUs int `json:"totalCPUs"`
+
+	// TotalMemoryGB is the total size of the memory of the servers, in GB.
+	TotalMemoryGB int `json:"totalMemoryGB"`
+
+	// TotalDiskGB is the total size of the disks, in GB.
+	TotalDiskGB int `json:"totalDiskGB"`
+
+	// LastChanged is the time the resources were found changed. The inventory is read from SakuraCloud
+	// on every reconcile, but the status is updated only when the resources change.
+	LastChanged metav1.Time `json:"lastChanged"`
+}
+
+// InventoryServer describes a server owned by a cluster
+type InventoryServer struct {
+	// ID is the ID of the server.
+	ID string `json:"id"`
+
+	// Name is the name of the server.
+	Name string `json:"name"`
+
+	// Zone is the zone of the server.
+	Zone string `json:"zone"`
+
+	// Role is control-plane or worker.
+	Role string `json:"role"`
+
+	// InstanceStatus is the power state of the server, e.g. up or down.
+	InstanceStatus string `json:"instanceStatus"`
+
+	// CPUs is the number of the virtual processors.
+	CPUs int `json:"cpus"`
+
+	// MemoryGB is the size of the memory, in GB.
+	MemoryGB int `json:"memoryGB"`
+}
+
+// InventoryServerCount is the number of the servers with a role and an instance status
+type InventoryServerCount struct {
+	// Role is control-plane or worker.
+	Role string `json:"role"`
+
+	// InstanceStatus is the power state of the servers.
+	InstanceStatus string `json:"instanceStatus"`
+
+	// Count is the number of the servers.
+	Count int `json:"count"`
+}
+
+// InventoryResource describes a SakuraCloud resource owned by a cluster
+type InventoryResource struct {
+	// Type is the type of the resource, e.g. disk, isoImage, switch, loadBalancer, packetFilter or archive.
+	Type string `json:"type"`
+
+	// ID is the ID of the resource.
+	ID string `json:"id"`
+
+	// Name is the name of the resource.
+	Name string `json:"name"`
+
+	// Zone is the zone of the resource.
+	Zone string `json:"zone"`
+
+	// SizeGB is the size of disks and archives, in GB.
+	// +optional
+	SizeGB int `json:"sizeGB,omitempty"`
+
+	// ServerID is the ID of the server the disk is connected to.
+	// +optional
+	ServerID string `json:"serverID,omitempty"`
+}
+
+// ProvisioningQueueStatus describes the provisioning queue of a zone
+type ProvisioningQueueStatus struct {
+	// Zone is the name of the zone.
+	Zone string `json:"zone"`
+
+	// Waiting is the number of the servers waiting to be provisioned.
+	Waiting int `json:"waiting"`
+
+	// Running is the number of the servers being provisioned.
+	Running int `json:"running"`
+}
+
+// PacketFilterSpec defines the rules of the packet filter for the cluster.
+//
+// The rules are evaluated in the following order, and all other packets are denied:
+//   - all packets from the servers of the cluster, or from ClusterCIDRs if specified
+//   - TCP 6443 from APIServerCIDRs
+//   - TCP NodePortRange from NodePortCIDRs
+//   - TCP 22 from SSHCIDRs
+//   - Rules
+//   - responses for the connections from the servers, ICMP and fragmented packets
+type PacketFilterSpec struct {
+	// Disabled disables the packet filter. The NICs of the servers are disconnected from the packet filter.
+	// +optional
+	Disabled bool `json:"disabled,omitempty"`
+
+	// ClusterCIDRs is the networks of the servers of the cluster, all packets from which are allowed.
+	// Defaults to the addresses of the servers, one rule per address. A packet filter has at most 30 rules,
+	// so set this for large clusters, e.g. to the network of a switch. Note that the subnet of the shared segment
+	// includes the servers of other users.
+	// +optional
+	ClusterCIDRs []string `json:"clusterCIDRs,omitempty"`
+
+	// APIServerCIDRs is the networks allowed to connect to the API server.
+	// Defaults to any.
+	// +optional
+	APIServerCIDRs []string `json:"apiServerCIDRs,omitempty"`
+
+	// NodePortRange is the range of the ports used by NodePort services.
+	// Defaults to 30000-32767.
+	// +optional
+	NodePortRange string `json:"nodePortRange,omitempty"`
+
+	// NodePortCIDRs is the networks allowed to connect to the NodePort services.
+	// Defaults to any.
+	// +optional
+	NodePortCIDRs []string `json:"nodePortCIDRs,omitempty"`
+
+	// SSHCIDRs is the networks allowed to connect to the servers via SSH.
+	// If not specified, SSH is denied.
+	// +optional
+	SSHCIDRs []string `json:"sshCIDRs,omitempty"`
+
+	// Rules is the additional rules evaluated before the default deny rule.
+	// +optional
+	Rules []PacketFilterRule `json:"rules,omitempty"`
+}
+
+// PacketFilterRule is a rule of the packet filter
+type PacketFilterRule struct {
+	// Protocol is one of tcp, udp, icmp, fragment or ip.
+	// +kubebuilder:validation:Enum=tcp;udp;icmp;fragment;ip
+	Protocol string `json:"protocol"`
+
+	// SourceNetwork is the source network of the packets. e.g. 192.0.2.0/24
+	// Defaults to any.
+	// +optional
+	SourceNetwork string `json:"sourceNetwork,omitempty"`
+
+	// SourcePort is the source port or port range of the packets. e.g. 1024-65535
+	// Defaults to any.
+	// +optional
+	SourcePort string `json:"sourcePort,omitempty"`
+
+	// DestinationPort is the destination port or port range of the packets.
+	// Defaults to any.
+	// +optional
+	DestinationPort string `json:"destinationPort,omitempty"`
+
+	// Action is one of allow or deny. Defaults to allow.
+	// +kubebuilder:validation:Enum=allow;deny
+	// +optional
+	Action string `json:"action,omitempty"`
+
+	// Description .
+	// +optional
+	Description string `json:"description,omitempty"`
 }
 
 // SakuraCloudClusterStatus defines the observed state of SakuraCloudClusterSpec
@@ -42,6 +257,47 @@ type SakuraCloudClusterStatus struct {
 	// +optional
 	APIEndpoints []APIEndpoint `json:"apiEndpoints,omitempty"`
 
+	// PacketFilterIDs is the IDs of the packet filters attached to the NICs of the cluster's servers,
+	// keyed by zone.
+	// +optional
+	PacketFilterIDs map[string]string `json:"packetFilterIDs,omitempty"`
+
+	// ProvisioningQueue is the number of the servers waiting and being provisioned in each zone
+	// of the cluster, including the servers of the other clusters.
+	// +optional
+	ProvisioningQueue []ProvisioningQueueStatus `json:"provisioningQueue,omitempty"`
+
+	// Inventory is the summary of the SakuraCloud resources owned by this cluster.
+	// +optional
+	Inventory *ClusterInventory `json:"inventory,omitempty"`
+
+	// APIEndpointRecord is the DNS records of the API endpoint, pointing to the control-plane machines.
+	// +optional
+	APIEndpointRecord *DNSRecordReference `json:"apiEndpointRecord,omitempty"`
+
+	// Credentials is the account and the permission of the API key used for this cluster.
+	// +optional
+	Credentials *CredentialsStatus `json:"credentials,omitempty"`
+
+	// EstimatedCost is the estimated cost of the SakuraCloud resources owned by this cluster.
+	// +optional
+	EstimatedCost *CostEstimate `json:"estimatedCost,omitempty"`
+
+	// State is the state of the SakuraCloud resources owned by this cluster.
+	// +optional
+	State ClusterState `json:"state,omitempty"`
+
+	// Conditions is the observed conditions of the cluster.
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+
+	// JobRef is a managed object reference to a Job related to the
+	// SakuraCloud resources.
+	// This value is set automatically at runtime and should not be set or
+	// modified by users.
+	// +optional
+	JobRef string `json:"jobRef,omitempty"`
+
 	// ErrorReason will be set in the event that there is a terminal problem
 	// reconciling the Machine and will contain a succinct value suitable
 	// for machine interpretation.
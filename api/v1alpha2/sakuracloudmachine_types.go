@@ -41,8 +41,14 @@ type SakuraCloudMachineSpec struct {
 	// +optional
 	MachineRef *SakuraCloudResourceReference `json:"machineRef,omitempty"`
 
+	// Zone is the zone in which the server is created.
+	// It must be one of the zones of the cluster. If not specified, a zone
+	// with the fewest machines of the cluster is selected.
+	// +optional
+	Zone *string `json:"zone,omitempty"`
+
 	// SourceArchive .
-	SourceArchive SakuraCloudResourceReference `json:"sourceArchive"`
+	SourceArchive SourceArchiveReference `json:"sourceArchive"`
 
 	// CPUs is the number of virtual processors in a virtual machine.
 	// Defaults to the analogue property value in the template from which this
@@ -52,9 +58,95 @@ type SakuraCloudMachineSpec struct {
 	// MemoryMiB is the size of a virtual machine's memory, in GB.
 	// +optional
 	MemoryGB int `json:"memoryGB,omitempty"`
+	// Commitment is the CPU commitment of the server plan. Defaults to standard.
+	// +kubebuilder:validation:Enum=standard;dedicatedcpu
+	// +optional
+	Commitment Commitment `json:"commitment,omitempty"`
+	// Generation is the generation of the server plan.
+	// If not specified, the newest generation available in the zone is used.
+	// +kubebuilder:validation:Enum=0;100;200
+	// +optional
+	Generation int `json:"generation,omitempty"`
+	// InterfaceDriver is the driver of the NICs. Defaults to virtio.
+	// +kubebuilder:validation:Enum=virtio;e1000
+	// +optional
+	InterfaceDriver InterfaceDriver `json:"interfaceDriver,omitempty"`
 	// DiskGiB is the size of a virtual machine's disk, in GB.
 	// +optional
 	DiskGB int `json:"diskGB,omitempty"`
+	// DiskPlan is the plan of the boot disk. Defaults to ssd.
+	// +kubebuilder:validation:Enum=ssd;hdd
+	// +optional
+	DiskPlan DiskPlan `json:"diskPlan,omitempty"`
+	// DiskConnection is the connection type of the boot disk. Defaults to virtio.
+	// +kubebuilder:validation:Enum=virtio;ide
+	// +optional
+	DiskConnection DiskConnection `json:"diskConnection,omitempty"`
+
+	// AdditionalDisks is the data disks connected to the server in addition to the boot disk,
+	// e.g. for etcd or container storage.
+	// +optional
+	AdditionalDisks []AdditionalDisk `json:"additionalDisks,omitempty"`
+
+	// PowerPolicy is how the power state of the server is reconciled after provisioning.
+	// If not specified, the power state is only reported.
+	// alwaysOn boots the server when it is powered off.
+	// +kubebuilder:validation:Enum=alwaysOn
+	// +optional
+	PowerPolicy PowerPolicy `json:"powerPolicy,omitempty"`
+
+	// ShutdownTimeout is how long to wait for the server to shut down via ACPI before
+	// deleting it. The server is forcibly powered off after the timeout.
+	// Defaults to the shutdownTimeout of the SakuraCloudCluster.
+	// +optional
+	ShutdownTimeout *metav1.Duration `json:"shutdownTimeout,omitempty"`
+
+	// DeletionPolicy is what is done with the disks when the server is deleted. Defaults to delete.
+	// retain leaves the disks disconnected from the cluster, and archive creates
+	// archives of the disks before deleting them.
+	// +kubebuilder:validation:Enum=delete;retain;archive
+	// +optional
+	DeletionPolicy DiskDeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// DeletionPolicyDisks is the names of the disks the deletion policy is applied to,
+	// boot for the boot disk and the names of AdditionalDisks.
+	// If not specified, it's applied to all disks. The other disks are deleted.
+	// Unknown names are rejected, and the server isn't deleted until they are fixed.
+	// +optional
+	DeletionPolicyDisks []string `json:"deletionPolicyDisks,omitempty"`
+
+	// Backup is the schedule of the backups of the disks. The backups are deleted with the machine.
+	// Defaults to the controlPlaneBackup of the SakuraCloudCluster for control-plane machines.
+	// +optional
+	Backup *BackupSpec `json:"backup,omitempty"`
+}
+
+// AdditionalDisk defines a data disk of the server
+type AdditionalDisk struct {
+	// Name is used as the suffix of the disk name, <server name>-<name>.
+	Name string `json:"name"`
+
+	// SizeGB is the size of the disk, in GB.
+	SizeGB int `json:"sizeGB"`
+
+	// Plan is the plan of the disk. Defaults to ssd.
+	// +kubebuilder:validation:Enum=ssd;hdd
+	// +optional
+	Plan DiskPlan `json:"plan,omitempty"`
+
+	// Connection is the connection type of the disk. Defaults to virtio.
+	// +kubebuilder:validation:Enum=virtio;ide
+	// +optional
+	Connection DiskConnection `json:"connection,omitempty"`
+
+	// SourceArchive is the archive from which the disk is created.
+	// If not specified, a blank disk is created.
+	// +optional
+	SourceArchive *SourceArchiveReference `json:"sourceArchive,omitempty"`
+
+	// Tags is the additional tags of the disk.
+	// +optional
+	Tags []string `json:"tags,omitempty"`
 }
 
 // SakuraCloudMachineStatus defines the observed state of SakuraCloudMachine
@@ -73,9 +165,64 @@ type SakuraCloudMachineStatus struct {
 	// +optional
 	SourceArchive *SourceArchiveInfo `json:"sourceArchive,omitempty"`
 
+	// ServerPlan represents information of the effective server plan
+	//
+	// This value is set automatically at runtime and should not be set or
+	// modified by users.
+	// +optional
+	ServerPlan *ServerPlanInfo `json:"serverPlan,omitempty"`
+
 	// State is the state of the SakuraCloud instance for this machine.
 	State InstanceState `json:"state,omitempty"`
 
+	// InstanceStatus is the power state of the server reported by SakuraCloud, e.g. up or down.
+	// +optional
+	InstanceStatus string `json:"instanceStatus,omitempty"`
+
+	// Conditions is the observed conditions of the server.
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+
+	// Backups is the existing backups of the disks, oldest first.
+	// +optional
+	Backups []BackupInfo `json:"backups,omitempty"`
+
+	// LastBackupTime is the time the last backup was completed.
+	// +optional
+	LastBackupTime *metav1.Time `json:"lastBackupTime,omitempty"`
+
+	// BackupFailures is the number of the consecutive failures of the backup.
+	// The backup is retried with an exponential backoff while it fails.
+	// +optional
+	BackupFailures int `json:"backupFailures,omitempty"`
+
+	// LastBackupFailureTime is the time the last backup failed.
+	// +optional
+	LastBackupFailureTime *metav1.Time `json:"lastBackupFailureTime,omitempty"`
+
+	// BackupJobRef is a managed object reference to a Job backing up the disks.
+	// This value is set automatically at runtime and should not be set or
+	// modified by users.
+	// +optional
+	BackupJobRef string `json:"backupJobRef,omitempty"`
+
+	// RetainedResources is the disks and archives left on SakuraCloud by the deletion policy.
+	// +optional
+	RetainedResources []RetainedResource `json:"retainedResources,omitempty"`
+
+	// ProvisioningQueuePosition is the 1-based position of the server in the provisioning queue of the zone
+	// while it waits for other servers to be provisioned.
+	// +optional
+	ProvisioningQueuePosition int `json:"provisioningQueuePosition,omitempty"`
+
+	// DNSRecord is the DNS record of the node.
+	// +optional
+	DNSRecord *DNSRecordReference `json:"dnsRecord,omitempty"`
+
+	// EstimatedCost is the estimated cost of the server, its disks and ISO image.
+	// +optional
+	EstimatedCost *CostEstimate `json:"estimatedCost,omitempty"`
+
 	// JobRef is a managed object reference to a Job related to the
 	// SakuraCloud resources.
 	// This value is set automatically at runtime and should not be set or
@@ -126,10 +273,12 @@ type SakuraCloudMachineStatus struct {
 // +kubebuilder:resource:path=sakuracloudmachines,scope=Namespaced,categories=cluster-api
 // +kubebuilder:storageversion
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Zone",type="string",JSONPath=".spec.zone",description="name of the SakuraCloud zone"
 // +kubebuilder:printcolumn:name="CPUs",type="integer",JSONPath=".spec.cpus",description="number of CPUs"
 // +kubebuilder:printcolumn:name="Memory",type="integer",JSONPath=".spec.memoryGB",description="size of memory"
 // +kubebuilder:printcolumn:name="Disk",type="integer",JSONPath=".spec.diskGB",description="size of the disks"
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.state",description="current status of the machine"
+// +kubebuilder:printcolumn:name="Power",type="string",JSONPath=".status.instanceStatus",description="power state of the server"
 
 // SakuraCloudMachine is the Schema for the sakuracloudmachines API
 type SakuraCloudMachine struct {
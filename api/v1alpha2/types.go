@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha2
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 )
@@ -40,6 +41,50 @@ type SourceArchiveInfo struct {
 	ID string `json:"id,omitempty"`
 	// Name .
 	Name string `json:"name,omitempty"`
+	// KubernetesVersion is the Kubernetes version the archive was selected for.
+	// +optional
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+}
+
+// FilterMatchType describes how the values of a filter are matched
+type FilterMatchType string
+
+const (
+	// FilterMatchTypeExact is the string representing the exact match
+	FilterMatchTypeExact FilterMatchType = "exact"
+
+	// FilterMatchTypePartial is the string representing the partial match
+	FilterMatchTypePartial = "partial"
+
+	// FilterMatchTypePrefix is the string representing the prefix match
+	FilterMatchTypePrefix = "prefix"
+)
+
+// ArchiveSelectionPolicy describes which archive is selected when multiple archives match
+type ArchiveSelectionPolicy string
+
+const (
+	// ArchiveSelectionUnique is the string representing that multiple matches are an error
+	ArchiveSelectionUnique ArchiveSelectionPolicy = ""
+
+	// ArchiveSelectionNewest is the string representing that the newest archive is selected
+	ArchiveSelectionNewest = "newest"
+)
+
+// ServerPlanInfo represents information of a server plan
+type ServerPlanInfo struct {
+	// ID .
+	ID string `json:"id,omitempty"`
+	// Name .
+	Name string `json:"name,omitempty"`
+	// CPUs .
+	CPUs int `json:"cpus,omitempty"`
+	// MemoryGB .
+	MemoryGB int `json:"memoryGB,omitempty"`
+	// Commitment .
+	Commitment Commitment `json:"commitment,omitempty"`
+	// Generation .
+	Generation int `json:"generation,omitempty"`
 }
 
 // SakuraCloudResourceReference is a reference to a specific SakuraCloud resource by ID+Zone or filters.
@@ -63,10 +108,46 @@ type SakuraCloudResourceReference struct {
 // Filter is a filter used to identify an SakuraCloud resource
 type Filter struct {
 	// Name of the filter. Filter names are case-sensitive.
+	// Filters named Tags match resources which have all of the values as tags.
 	Name string `json:"name"`
 
 	// Values includes one or more filter values. Filter values are case-sensitive.
 	Values []string `json:"values"`
+
+	// MatchType is how the values are matched. Defaults to exact.
+	// The exact match is satisfied by any of the values, the partial match
+	// requires all of the values. The prefix match is only supported by
+	// filters named Name, and filters named Tags only support the exact match.
+	// +kubebuilder:validation:Enum=exact;partial;prefix
+	// +optional
+	MatchType FilterMatchType `json:"matchType,omitempty"`
+}
+
+// SourceArchiveReference is a reference to an archive by ID, filters or OS type
+type SourceArchiveReference struct {
+	SakuraCloudResourceReference `json:",inline"`
+
+	// OSType selects the public archive of the OS, e.g. ubuntu, centos.
+	// It can be combined with Filters.
+	// +optional
+	OSType string `json:"osType,omitempty"`
+
+	// Selection is the policy when multiple archives match.
+	// If not specified, multiple matches are an error.
+	// +kubebuilder:validation:Enum=newest
+	// +optional
+	Selection ArchiveSelectionPolicy `json:"selection,omitempty"`
+
+	// ArchiveRef is the name of the SakuraCloudArchive in the namespace of the machine.
+	// The machine waits until the archive is available in its zone.
+	// +optional
+	ArchiveRef string `json:"archiveRef,omitempty"`
+
+	// MatchKubernetesVersion selects the archive tagged with the Kubernetes
+	// version of the Machine, e.g. k8s-version=1.16.2 for v1.16.2.
+	// It can be combined with Filters and OSType.
+	// +optional
+	MatchKubernetesVersion bool `json:"matchKubernetesVersion,omitempty"`
 }
 
 // SakuraCloudMachineTemplateResource describes the data needed to create a SakuraCloudMachine from a template
@@ -108,3 +189,298 @@ const (
 	// InstanceStateNotFound is the string representing an instance in not-found state
 	InstanceStateNotFound = "notfound"
 )
+
+// DiskPlan describes the plan of a disk
+type DiskPlan string
+
+const (
+	// DiskPlanSSD is the string representing the SSD plan
+	DiskPlanSSD DiskPlan = "ssd"
+
+	// DiskPlanHDD is the string representing the HDD plan
+	DiskPlanHDD = "hdd"
+)
+
+// DiskConnection describes the connection type of a disk
+type DiskConnection string
+
+const (
+	// DiskConnectionVirtIO is the string representing the virtio connection
+	DiskConnectionVirtIO DiskConnection = "virtio"
+
+	// DiskConnectionIDE is the string representing the IDE connection
+	DiskConnectionIDE = "ide"
+)
+
+// Commitment describes the CPU commitment of a server plan
+type Commitment string
+
+const (
+	// CommitmentStandard is the string representing the standard plan
+	CommitmentStandard Commitment = "standard"
+
+	// CommitmentDedicatedCPU is the string representing the dedicated CPU plan
+	CommitmentDedicatedCPU = "dedicatedcpu"
+)
+
+// InterfaceDriver describes the driver of a NIC
+type InterfaceDriver string
+
+const (
+	// InterfaceDriverVirtIO is the string representing the virtio driver
+	InterfaceDriverVirtIO InterfaceDriver = "virtio"
+
+	// InterfaceDriverE1000 is the string representing the e1000 driver
+	InterfaceDriverE1000 = "e1000"
+)
+
+// ClusterState describes the state of the SakuraCloud resources owned by a cluster
+type ClusterState string
+
+const (
+	// ClusterStateProvisioned is the string representing cluster resources in provisioned state
+	ClusterStateProvisioned ClusterState = ""
+
+	// ClusterStateCleaning is the string representing cluster resources in shutting-down state
+	ClusterStateCleaning = "cleaning"
+
+	// ClusterStateDeleted is the string representing cluster resources in deleted state
+	ClusterStateDeleted = "deleted"
+)
+
+// ArchiveState describes the state of a SakuraCloudArchive
+type ArchiveState string
+
+const (
+	// ArchiveStatePending is the string representing an archive in pending state
+	ArchiveStatePending ArchiveState = ""
+
+	// ArchiveStateUploading is the string representing an archive in uploading state
+	ArchiveStateUploading = "uploading"
+
+	// ArchiveStateAvailable is the string representing an archive available in all zones
+	ArchiveStateAvailable = "available"
+
+	// ArchiveStateCleaning is the string representing an archive in deleting state
+	ArchiveStateCleaning = "cleaning"
+
+	// ArchiveStateDeleted is the string representing an archive in deleted state
+	ArchiveStateDeleted = "deleted"
+)
+
+// PowerPolicy describes how the power state of a server is reconciled
+type PowerPolicy string
+
+const (
+	// PowerPolicyManual is the string representing the policy that only reports the power state
+	PowerPolicyManual PowerPolicy = ""
+
+	// PowerPolicyAlwaysOn is the string representing the policy that boots servers powered off
+	PowerPolicyAlwaysOn = "alwaysOn"
+)
+
+// DiskDeletionPolicy describes what is done with the disks of a server when it's deleted
+type DiskDeletionPolicy string
+
+const (
+	// DiskDeletionPolicyDelete is the string representing the policy that deletes the disks with the server
+	DiskDeletionPolicyDelete DiskDeletionPolicy = "delete"
+
+	// DiskDeletionPolicyRetain is the string representing the policy that leaves the disks disconnected
+	DiskDeletionPolicyRetain = "retain"
+
+	// DiskDeletionPolicyArchive is the string representing the policy that creates archives of the disks
+	// before deleting them
+	DiskDeletionPolicyArchive = "archive"
+)
+
+// BootDiskName is the name representing the boot disk in the disk names of a machine
+const BootDiskName = "boot"
+
+// RetainedResourceType describes the type of a SakuraCloud resource left by a deletion policy
+type RetainedResourceType string
+
+const (
+	// RetainedResourceTypeDisk is the string representing a retained disk
+	RetainedResourceTypeDisk RetainedResourceType = "disk"
+
+	// RetainedResourceTypeArchive is the string representing an archive created from a disk
+	RetainedResourceTypeArchive = "archive"
+)
+
+// RetainedResource is a SakuraCloud resource left by the deletion policy of a machine
+type RetainedResource struct {
+	// Type is the type of the resource, disk or archive.
+	Type RetainedResourceType `json:"type"`
+
+	// ID is the ID of the resource.
+	ID string `json:"id"`
+
+	// Zone is the zone of the resource.
+	Zone string `json:"zone"`
+
+	// DiskName is the name of the disk the resource is retained from,
+	// boot or the name of an additional disk.
+	DiskName string `json:"diskName"`
+}
+
+// BackupSpec defines the schedule of the backups of the disks of a machine.
+// The backups are archives created from the disks periodically.
+type BackupSpec struct {
+	// Interval is the interval between backups, e.g. 24h.
+	Interval metav1.Duration `json:"interval"`
+
+	// Retention is the number of the backups kept for each disk. Defaults to 3.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Retention int `json:"retention,omitempty"`
+
+	// Disks is the names of the disks backed up, boot for the boot disk and
+	// the names of AdditionalDisks. If not specified, all disks are backed up.
+	// +optional
+	Disks []string `json:"disks,omitempty"`
+}
+
+// BackupInfo describes a backup of a disk
+type BackupInfo struct {
+	// DiskName is the name of the disk, boot or the name of an additional disk.
+	DiskName string `json:"diskName"`
+
+	// ArchiveID is the ID of the archive holding the backup.
+	ArchiveID string `json:"archiveID"`
+
+	// CreatedAt is the time the backup was created.
+	CreatedAt metav1.Time `json:"createdAt"`
+}
+
+// DNSSpec describes the records of a cluster in a SakuraCloud DNS zone
+type DNSSpec struct {
+	// Zone is the name of the DNS zone registered in SakuraCloud DNS, e.g. example.com.
+	Zone string `json:"zone"`
+
+	// Subdomain is the name under Zone the records are created in. Defaults to the name of the cluster.
+	// The record of the API endpoint is api.<subdomain>.<zone>, and the records of the nodes are
+	// <machine name>.<subdomain>.<zone>.
+	// +optional
+	Subdomain string `json:"subdomain,omitempty"`
+
+	// NodeRecords enables the records of the nodes.
+	// +optional
+	NodeRecords bool `json:"nodeRecords,omitempty"`
+
+	// TTL is the TTL of the records in seconds. Defaults to 60.
+	// +optional
+	TTL int `json:"ttl,omitempty"`
+}
+
+// DNSRecordReference is a reference to the A records of a name in a SakuraCloud DNS zone
+type DNSRecordReference struct {
+	// Zone is the name of the DNS zone.
+	Zone string `json:"zone"`
+
+	// Name is the name of the records relative to the zone.
+	Name string `json:"name"`
+}
+
+// FQDN returns the fully qualified domain name of the records.
+func (r *DNSRecordReference) FQDN() string {
+	return r.Name + "." + r.Zone
+}
+
+// CredentialsStatus describes the account and the permission of the SakuraCloud API key
+type CredentialsStatus struct {
+	// AccountID is the ID of the account.
+	AccountID string `json:"accountID"`
+
+	// AccountName is the name of the account.
+	// +optional
+	AccountName string `json:"accountName,omitempty"`
+
+	// AccountCode is the code of the account.
+	// +optional
+	AccountCode string `json:"accountCode,omitempty"`
+
+	// Permission is the permission level of the API key, create, arrange, power or view.
+	// Servers are provisioned only with create.
+	Permission string `json:"permission"`
+
+	// Zones is the zones of the cluster the API key is allowed to access.
+	// +optional
+	Zones []string `json:"zones,omitempty"`
+
+	// DeniedZones is the zones of the cluster the API key is not allowed to access.
+	// +optional
+	DeniedZones []string `json:"deniedZones,omitempty"`
+
+	// LastCheckTime is the time the API key was checked.
+	// The API key is checked again after the credentials check interval.
+	// +optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+// CostEstimate is the estimated cost of SakuraCloud resources in JPY, excluding tax
+type CostEstimate struct {
+	// Hourly is the estimated cost per hour.
+	Hourly int `json:"hourly"`
+
+	// Monthly is the estimated cost per month.
+	Monthly int `json:"monthly"`
+
+	// Items is the breakdown of the cost by the type of the resources,
+	// server, disk, isoImage, appliance or archive.
+	// +optional
+	Items []CostEstimateItem `json:"items,omitempty"`
+}
+
+// CostEstimateItem is the estimated cost of a type of resources
+type CostEstimateItem struct {
+	// Type is the type of the resources.
+	Type string `json:"type"`
+
+	// Hourly is the estimated cost per hour.
+	Hourly int `json:"hourly"`
+
+	// Monthly is the estimated cost per month.
+	Monthly int `json:"monthly"`
+}
+
+// ConditionType describes the type of a condition
+type ConditionType string
+
+const (
+	// ConditionTypePoweredOn is the condition representing the server is powered on
+	ConditionTypePoweredOn ConditionType = "PoweredOn"
+
+	// ConditionTypePaused is the condition representing the reconciliation is paused by
+	// the cluster's paused annotation or the maintenance annotation
+	ConditionTypePaused = "Paused"
+
+	// ConditionTypePreflightPassed is the condition representing the server plan is available and
+	// the server fits in the account quota
+	ConditionTypePreflightPassed ConditionType = "PreflightPassed"
+
+	// ConditionTypeCredentialsValid is the condition representing the API key is allowed to
+	// create resources in all zones of the cluster
+	ConditionTypeCredentialsValid ConditionType = "CredentialsValid"
+)
+
+// Condition describes an aspect of the observed state of a resource
+type Condition struct {
+	// Type is the type of the condition.
+	Type ConditionType `json:"type"`
+
+	// Status is the status of the condition, one of True, False or Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the condition transitioned from one status to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Reason is a brief CamelCase reason for the condition's last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human readable message indicating details about the transition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
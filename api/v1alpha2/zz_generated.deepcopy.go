@@ -21,7 +21,8 @@ limitations under the License..
 package v1alpha2
 
 import (
-	"k8s.io/api/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/cluster-api/errors"
 )
@@ -41,6 +42,239 @@ func (in *APIEndpoint) DeepCopy() *APIEndpoint {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AdditionalDisk) DeepCopyInto(out *AdditionalDisk) {
+	*out = *in
+	if in.SourceArchive != nil {
+		in, out := &in.SourceArchive, &out.SourceArchive
+		*out = new(SourceArchiveReference)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AdditionalDisk.
+func (in *AdditionalDisk) DeepCopy() *AdditionalDisk {
+	if in == nil {
+		return nil
+	}
+	out := new(AdditionalDisk)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ArchiveSource) DeepCopyInto(out *ArchiveSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ArchiveSource.
+func (in *ArchiveSource) DeepCopy() *ArchiveSource {
+	if in == nil {
+		return nil
+	}
+	out := new(ArchiveSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupInfo) DeepCopyInto(out *BackupInfo) {
+	*out = *in
+	in.CreatedAt.DeepCopyInto(&out.CreatedAt)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupInfo.
+func (in *BackupInfo) DeepCopy() *BackupInfo {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupInfo)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupSpec) DeepCopyInto(out *BackupSpec) {
+	*out = *in
+	out.Interval = in.Interval
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupSpec.
+func (in *BackupSpec) DeepCopy() *BackupSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterInventory) DeepCopyInto(out *ClusterInventory) {
+	*out = *in
+	if in.Servers != nil {
+		in, out := &in.Servers, &out.Servers
+		*out = make([]InventoryServer, len(*in))
+		copy(*out, *in)
+	}
+	if in.ServerCounts != nil {
+		in, out := &in.ServerCounts, &out.ServerCounts
+		*out = make([]InventoryServerCount, len(*in))
+		copy(*out, *in)
+	}
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]InventoryResource, len(*in))
+		copy(*out, *in)
+	}
+	if in.ISOImages != nil {
+		in, out := &in.ISOImages, &out.ISOImages
+		*out = make([]InventoryResource, len(*in))
+		copy(*out, *in)
+	}
+	if in.Appliances != nil {
+		in, out := &in.Appliances, &out.Appliances
+		*out = make([]InventoryResource, len(*in))
+		copy(*out, *in)
+	}
+	if in.Archives != nil {
+		in, out := &in.Archives, &out.Archives
+		*out = make([]InventoryResource, len(*in))
+		copy(*out, *in)
+	}
+	in.LastChanged.DeepCopyInto(&out.LastChanged)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterInventory.
+func (in *ClusterInventory) DeepCopy() *ClusterInventory {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterInventory)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Condition) DeepCopyInto(out *Condition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Condition.
+func (in *Condition) DeepCopy() *Condition {
+	if in == nil {
+		return nil
+	}
+	out := new(Condition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CostEstimate) DeepCopyInto(out *CostEstimate) {
+	*out = *in
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]CostEstimateItem, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CostEstimate.
+func (in *CostEstimate) DeepCopy() *CostEstimate {
+	if in == nil {
+		return nil
+	}
+	out := new(CostEstimate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CostEstimateItem) DeepCopyInto(out *CostEstimateItem) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CostEstimateItem.
+func (in *CostEstimateItem) DeepCopy() *CostEstimateItem {
+	if in == nil {
+		return nil
+	}
+	out := new(CostEstimateItem)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CredentialsStatus) DeepCopyInto(out *CredentialsStatus) {
+	*out = *in
+	if in.Zones != nil {
+		in, out := &in.Zones, &out.Zones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DeniedZones != nil {
+		in, out := &in.DeniedZones, &out.DeniedZones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CredentialsStatus.
+func (in *CredentialsStatus) DeepCopy() *CredentialsStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CredentialsStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DNSRecordReference) DeepCopyInto(out *DNSRecordReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DNSRecordReference.
+func (in *DNSRecordReference) DeepCopy() *DNSRecordReference {
+	if in == nil {
+		return nil
+	}
+	out := new(DNSRecordReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DNSSpec) DeepCopyInto(out *DNSSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DNSSpec.
+func (in *DNSSpec) DeepCopy() *DNSSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DNSSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Filter) DeepCopyInto(out *Filter) {
 	*out = *in
@@ -61,12 +295,254 @@ func (in *Filter) DeepCopy() *Filter {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InventoryResource) DeepCopyInto(out *InventoryResource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InventoryResource.
+func (in *InventoryResource) DeepCopy() *InventoryResource {
+	if in == nil {
+		return nil
+	}
+	out := new(InventoryResource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InventoryServer) DeepCopyInto(out *InventoryServer) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InventoryServer.
+func (in *InventoryServer) DeepCopy() *InventoryServer {
+	if in == nil {
+		return nil
+	}
+	out := new(InventoryServer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InventoryServerCount) DeepCopyInto(out *InventoryServerCount) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InventoryServerCount.
+func (in *InventoryServerCount) DeepCopy() *InventoryServerCount {
+	if in == nil {
+		return nil
+	}
+	out := new(InventoryServerCount)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PacketFilterRule) DeepCopyInto(out *PacketFilterRule) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PacketFilterRule.
+func (in *PacketFilterRule) DeepCopy() *PacketFilterRule {
+	if in == nil {
+		return nil
+	}
+	out := new(PacketFilterRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PacketFilterSpec) DeepCopyInto(out *PacketFilterSpec) {
+	*out = *in
+	if in.ClusterCIDRs != nil {
+		in, out := &in.ClusterCIDRs, &out.ClusterCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.APIServerCIDRs != nil {
+		in, out := &in.APIServerCIDRs, &out.APIServerCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.NodePortCIDRs != nil {
+		in, out := &in.NodePortCIDRs, &out.NodePortCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SSHCIDRs != nil {
+		in, out := &in.SSHCIDRs, &out.SSHCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]PacketFilterRule, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PacketFilterSpec.
+func (in *PacketFilterSpec) DeepCopy() *PacketFilterSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PacketFilterSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProvisioningQueueStatus) DeepCopyInto(out *ProvisioningQueueStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProvisioningQueueStatus.
+func (in *ProvisioningQueueStatus) DeepCopy() *ProvisioningQueueStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ProvisioningQueueStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RetainedResource) DeepCopyInto(out *RetainedResource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RetainedResource.
+func (in *RetainedResource) DeepCopy() *RetainedResource {
+	if in == nil {
+		return nil
+	}
+	out := new(RetainedResource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SakuraCloudArchive) DeepCopyInto(out *SakuraCloudArchive) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SakuraCloudArchive.
+func (in *SakuraCloudArchive) DeepCopy() *SakuraCloudArchive {
+	if in == nil {
+		return nil
+	}
+	out := new(SakuraCloudArchive)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SakuraCloudArchive) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SakuraCloudArchiveList) DeepCopyInto(out *SakuraCloudArchiveList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SakuraCloudArchive, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SakuraCloudArchiveList.
+func (in *SakuraCloudArchiveList) DeepCopy() *SakuraCloudArchiveList {
+	if in == nil {
+		return nil
+	}
+	out := new(SakuraCloudArchiveList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SakuraCloudArchiveList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SakuraCloudArchiveSpec) DeepCopyInto(out *SakuraCloudArchiveSpec) {
+	*out = *in
+	if in.Zones != nil {
+		in, out := &in.Zones, &out.Zones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.Source = in.Source
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SakuraCloudArchiveSpec.
+func (in *SakuraCloudArchiveSpec) DeepCopy() *SakuraCloudArchiveSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SakuraCloudArchiveSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SakuraCloudArchiveStatus) DeepCopyInto(out *SakuraCloudArchiveStatus) {
+	*out = *in
+	if in.ArchiveIDs != nil {
+		in, out := &in.ArchiveIDs, &out.ArchiveIDs
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ErrorMessage != nil {
+		in, out := &in.ErrorMessage, &out.ErrorMessage
+		*out = new(string)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SakuraCloudArchiveStatus.
+func (in *SakuraCloudArchiveStatus) DeepCopy() *SakuraCloudArchiveStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SakuraCloudArchiveStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SakuraCloudCluster) DeepCopyInto(out *SakuraCloudCluster) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	in.Status.DeepCopyInto(&out.Status)
 }
 
@@ -123,7 +599,32 @@ func (in *SakuraCloudClusterList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SakuraCloudClusterSpec) DeepCopyInto(out *SakuraCloudClusterSpec) {
 	*out = *in
+	if in.Zones != nil {
+		in, out := &in.Zones, &out.Zones
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	out.CloudProviderConfiguration = in.CloudProviderConfiguration
+	if in.PacketFilter != nil {
+		in, out := &in.PacketFilter, &out.PacketFilter
+		*out = new(PacketFilterSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ShutdownTimeout != nil {
+		in, out := &in.ShutdownTimeout, &out.ShutdownTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ControlPlaneBackup != nil {
+		in, out := &in.ControlPlaneBackup, &out.ControlPlaneBackup
+		*out = new(BackupSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.DNS != nil {
+		in, out := &in.DNS, &out.DNS
+		*out = new(DNSSpec)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SakuraCloudClusterSpec.
@@ -144,6 +645,45 @@ func (in *SakuraCloudClusterStatus) DeepCopyInto(out *SakuraCloudClusterStatus)
 		*out = make([]APIEndpoint, len(*in))
 		copy(*out, *in)
 	}
+	if in.PacketFilterIDs != nil {
+		in, out := &in.PacketFilterIDs, &out.PacketFilterIDs
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ProvisioningQueue != nil {
+		in, out := &in.ProvisioningQueue, &out.ProvisioningQueue
+		*out = make([]ProvisioningQueueStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Inventory != nil {
+		in, out := &in.Inventory, &out.Inventory
+		*out = new(ClusterInventory)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.APIEndpointRecord != nil {
+		in, out := &in.APIEndpointRecord, &out.APIEndpointRecord
+		*out = new(DNSRecordReference)
+		**out = **in
+	}
+	if in.Credentials != nil {
+		in, out := &in.Credentials, &out.Credentials
+		*out = new(CredentialsStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.EstimatedCost != nil {
+		in, out := &in.EstimatedCost, &out.EstimatedCost
+		*out = new(CostEstimate)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.ErrorReason != nil {
 		in, out := &in.ErrorReason, &out.ErrorReason
 		*out = new(errors.ClusterStatusError)
@@ -238,7 +778,34 @@ func (in *SakuraCloudMachineSpec) DeepCopyInto(out *SakuraCloudMachineSpec) {
 		*out = new(SakuraCloudResourceReference)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Zone != nil {
+		in, out := &in.Zone, &out.Zone
+		*out = new(string)
+		**out = **in
+	}
 	in.SourceArchive.DeepCopyInto(&out.SourceArchive)
+	if in.AdditionalDisks != nil {
+		in, out := &in.AdditionalDisks, &out.AdditionalDisks
+		*out = make([]AdditionalDisk, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ShutdownTimeout != nil {
+		in, out := &in.ShutdownTimeout, &out.ShutdownTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.DeletionPolicyDisks != nil {
+		in, out := &in.DeletionPolicyDisks, &out.DeletionPolicyDisks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Backup != nil {
+		in, out := &in.Backup, &out.Backup
+		*out = new(BackupSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SakuraCloudMachineSpec.
@@ -256,7 +823,7 @@ func (in *SakuraCloudMachineStatus) DeepCopyInto(out *SakuraCloudMachineStatus)
 	*out = *in
 	if in.Addresses != nil {
 		in, out := &in.Addresses, &out.Addresses
-		*out = make([]v1.NodeAddress, len(*in))
+		*out = make([]corev1.NodeAddress, len(*in))
 		copy(*out, *in)
 	}
 	if in.SourceArchive != nil {
@@ -264,6 +831,48 @@ func (in *SakuraCloudMachineStatus) DeepCopyInto(out *SakuraCloudMachineStatus)
 		*out = new(SourceArchiveInfo)
 		**out = **in
 	}
+	if in.ServerPlan != nil {
+		in, out := &in.ServerPlan, &out.ServerPlan
+		*out = new(ServerPlanInfo)
+		**out = **in
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Backups != nil {
+		in, out := &in.Backups, &out.Backups
+		*out = make([]BackupInfo, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastBackupTime != nil {
+		in, out := &in.LastBackupTime, &out.LastBackupTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastBackupFailureTime != nil {
+		in, out := &in.LastBackupFailureTime, &out.LastBackupFailureTime
+		*out = (*in).DeepCopy()
+	}
+	if in.RetainedResources != nil {
+		in, out := &in.RetainedResources, &out.RetainedResources
+		*out = make([]RetainedResource, len(*in))
+		copy(*out, *in)
+	}
+	if in.DNSRecord != nil {
+		in, out := &in.DNSRecord, &out.DNSRecord
+		*out = new(DNSRecordReference)
+		**out = **in
+	}
+	if in.EstimatedCost != nil {
+		in, out := &in.EstimatedCost, &out.EstimatedCost
+		*out = new(CostEstimate)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.ErrorReason != nil {
 		in, out := &in.ErrorReason, &out.ErrorReason
 		*out = new(errors.MachineStatusError)
@@ -420,6 +1029,21 @@ func (in *SakuraCloudResourceReference) DeepCopy() *SakuraCloudResourceReference
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServerPlanInfo) DeepCopyInto(out *ServerPlanInfo) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServerPlanInfo.
+func (in *ServerPlanInfo) DeepCopy() *ServerPlanInfo {
+	if in == nil {
+		return nil
+	}
+	out := new(ServerPlanInfo)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SourceArchiveInfo) DeepCopyInto(out *SourceArchiveInfo) {
 	*out = *in
@@ -434,3 +1058,19 @@ func (in *SourceArchiveInfo) DeepCopy() *SourceArchiveInfo {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SourceArchiveReference) DeepCopyInto(out *SourceArchiveReference) {
+	*out = *in
+	in.SakuraCloudResourceReference.DeepCopyInto(&out.SakuraCloudResourceReference)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SourceArchiveReference.
+func (in *SourceArchiveReference) DeepCopy() *SourceArchiveReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SourceArchiveReference)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	goctx "context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
+	clusterutilv1 "sigs.k8s.io/cluster-api/util"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/services"
+)
+
+const (
+	archiveControllerName = "sakuracloudarchive-controller"
+)
+
+// SakuraCloudArchiveReconciler reconciles a SakuraCloudArchive object
+type SakuraCloudArchiveReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudarchives,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudarchives/status,verbs=get;update;patch
+
+// Reconcile ensures the back-end state reflects the Kubernetes resource state intent.
+func (r *SakuraCloudArchiveReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reterr error) {
+	parentContext := goctx.Background()
+
+	logger := r.Log.
+		WithName(archiveControllerName).
+		WithName(fmt.Sprintf("namespace=%s", req.Namespace)).
+		WithName(fmt.Sprintf("sakuracloudArchive=%s", req.Name))
+
+	// Fetch the SakuraCloudArchive instance.
+	sakuracloudArchive := &infrav1.SakuraCloudArchive{}
+	if err := r.Get(parentContext, req.NamespacedName, sakuracloudArchive); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	// Create the archive context.
+	ctx, err := context.NewArchiveContext(&context.ArchiveContextParams{
+		Context:            parentContext,
+		SakuraCloudArchive: sakuracloudArchive,
+		Client:             r.Client,
+		Logger:             logger,
+	})
+	if err != nil {
+		return reconcile.Result{}, errors.Errorf("failed to create archive context: %+v", err)
+	}
+
+	// Always close the context when exiting this function so we can persist any SakuraCloudArchive changes.
+	defer func() {
+		if err := ctx.Patch(); err != nil && reterr == nil {
+			reterr = err
+		}
+	}()
+
+	// Handle deleted archives
+	if !sakuracloudArchive.DeletionTimestamp.IsZero() {
+		return r.reconcileDelete(ctx)
+	}
+
+	// Handle non-deleted archives
+	return r.reconcileNormal(ctx)
+}
+
+func (r *SakuraCloudArchiveReconciler) reconcileDelete(ctx *context.ArchiveContext) (reconcile.Result, error) {
+	ctx.Logger.Info("Reconciling SakuraCloudArchive delete")
+
+	var service services.SakuraCloudArchiveInterface = &services.SakuraCloudService{}
+	archive, err := service.DestroyArchive(ctx)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "failed to destroy archives")
+	}
+
+	// Requeue the operation until the upload in progress is finished and the archives are deleted.
+	if archive.Status.State != infrav1.ArchiveStateDeleted {
+		ctx.Logger.V(6).Info("requeuing operation until archives are deleted", "expected-state", infrav1.ArchiveStateDeleted, "actual-state", archive.Status.State)
+		return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+	}
+
+	// Archives are deleted so remove the finalizer.
+	ctx.SakuraCloudArchive.Finalizers = clusterutilv1.Filter(ctx.SakuraCloudArchive.Finalizers, infrav1.ArchiveFinalizer)
+
+	return reconcile.Result{}, nil
+}
+
+func (r *SakuraCloudArchiveReconciler) reconcileNormal(ctx *context.ArchiveContext) (reconcile.Result, error) {
+	ctx.Logger.Info("Reconciling SakuraCloudArchive")
+
+	// If the SakuraCloudArchive doesn't have our finalizer, add it.
+	if !clusterutilv1.Contains(ctx.SakuraCloudArchive.Finalizers, infrav1.ArchiveFinalizer) {
+		ctx.SakuraCloudArchive.Finalizers = append(ctx.SakuraCloudArchive.Finalizers, infrav1.ArchiveFinalizer)
+	}
+
+	var service services.SakuraCloudArchiveInterface = &services.SakuraCloudService{}
+	archive, err := service.ReconcileArchive(ctx)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "failed to reconcile archive")
+	}
+
+	// Requeue the operation until the archive is available in all zones.
+	if archive.Status.State != infrav1.ArchiveStateAvailable {
+		ctx.Logger.V(6).Info("requeuing operation until archive is available", "expected-state", infrav1.ArchiveStateAvailable, "actual-state", archive.Status.State)
+		return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// SetupWithManager adds this controller to the provided manager.
+func (r *SakuraCloudArchiveReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrav1.SakuraCloudArchive{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: config.MaxConcurrentReconciles}).
+		Complete(r)
+}
@@ -19,19 +19,29 @@ package controllers
 import (
 	goctx "context"
 	"fmt"
+	"reflect"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/record"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	clusterutilv1 "sigs.k8s.io/cluster-api/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/services"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/services/cloudprovider"
 	infrautilv1 "github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
 )
@@ -54,6 +64,8 @@ type SakuraCloudClusterReconciler struct {
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudclusters,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudclusters/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters;clusters/status,verbs=get;list;watch
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines;machines/status,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudmachines,verbs=get;list;watch
 // +kubebuilder:rbac:groups=bootstrap.cluster.x-k8s.io,resources=kubeadmconfigs;kubeadmconfigs/status,verbs=get;list;watch
 
 // Reconcile ensures the back-end state reflects the Kubernetes resource state intent.
@@ -107,6 +119,15 @@ func (r *SakuraCloudClusterReconciler) Reconcile(req ctrl.Request) (_ ctrl.Resul
 		}
 	}()
 
+	// Skip all changes on SakuraCloud and the workload cluster while the cluster is paused or in maintenance.
+	if reason := infrautilv1.PauseReason(cluster, sakuracloudCluster); reason != "" {
+		return r.reconcilePaused(ctx, reason)
+	}
+	if infrautilv1.GetCondition(sakuracloudCluster.Status.Conditions, infrav1.ConditionTypePaused) != nil {
+		sakuracloudCluster.Status.Conditions = infrautilv1.SetCondition(sakuracloudCluster.Status.Conditions,
+			infrav1.ConditionTypePaused, corev1.ConditionFalse, "Resumed", "")
+	}
+
 	// Handle deleted clusters
 	if !sakuracloudCluster.DeletionTimestamp.IsZero() {
 		return r.reconcileDelete(ctx)
@@ -119,18 +140,63 @@ func (r *SakuraCloudClusterReconciler) Reconcile(req ctrl.Request) (_ ctrl.Resul
 func (r *SakuraCloudClusterReconciler) reconcileDelete(ctx *context.ClusterContext) (reconcile.Result, error) {
 	ctx.Logger.Info("Reconciling SakuraCloudCluster delete")
 
+	// Wait for all Machines of the cluster to be deleted.
+	// SakuraCloudMachines cloned from templates don't have the cluster label, so they are waited for via their owner Machines,
+	// which aren't deleted until the SakuraCloudMachines are.
+	machines, err := infrautilv1.GetMachinesInCluster(ctx, ctx.Client, ctx.Cluster.Namespace, ctx.Cluster.Name)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err,
+			"failed to list Machines for Cluster %s/%s",
+			ctx.Cluster.Namespace, ctx.Cluster.Name)
+	}
+	if len(machines) > 0 {
+		ctx.Logger.Info("Waiting for Machines to be deleted", "count", len(machines))
+		return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+	}
+
+	var service services.SakuraCloudClusterInterface = &services.SakuraCloudService{}
+	sakuracloudCluster, err := service.DestroyCluster(ctx)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "failed to destroy cluster resources")
+	}
+
+	// Requeue the operation until SakuraCloud confirms the deletion.
+	if sakuracloudCluster.Status.State != infrav1.ClusterStateDeleted {
+		ctx.Logger.V(6).Info("requeuing operation until cluster resources are deleted", "expected-state", infrav1.ClusterStateDeleted, "actual-state", sakuracloudCluster.Status.State)
+		return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+	}
+
+	// Drop the cached client for the workload cluster.
+	infrautilv1.DeleteKubeClient(ctx.Cluster)
+
 	// Cluster is deleted so remove the finalizer.
 	ctx.SakuraCloudCluster.Finalizers = clusterutilv1.Filter(ctx.SakuraCloudCluster.Finalizers, infrav1.ClusterFinalizer)
 
 	return reconcile.Result{}, nil
 }
 
+func (r *SakuraCloudClusterReconciler) reconcilePaused(ctx *context.ClusterContext, reason string) (reconcile.Result, error) {
+	ctx.Logger.Info("Reconciliation is paused, only refreshing status", "reason", reason)
+	ctx.SakuraCloudCluster.Status.Conditions = infrautilv1.SetCondition(ctx.SakuraCloudCluster.Status.Conditions,
+		infrav1.ConditionTypePaused, corev1.ConditionTrue, reason, "changes on SakuraCloud and the workload cluster are skipped")
+
+	if ctx.SakuraCloudCluster.DeletionTimestamp.IsZero() {
+		// DNS records aren't updated while paused.
+		if ctx.SakuraCloudCluster.Spec.DNS == nil {
+			if err := r.reconcileAPIEndpoints(ctx); err != nil && err != infrautilv1.ErrNoMachineIPAddr {
+				return reconcile.Result{}, errors.Wrapf(err,
+					"failed to reconcile API endpoints for SakuraCloudCluster %s/%s",
+					ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
+			}
+		}
+		r.refreshInventory(ctx)
+	}
+	return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+}
+
 func (r *SakuraCloudClusterReconciler) reconcileNormal(ctx *context.ClusterContext) (reconcile.Result, error) {
 	ctx.Logger.Info("Reconciling SakuraCloudCluster")
 
-	ctx.SakuraCloudCluster.Status.Ready = true
-	ctx.Logger.V(6).Info("SakuraCloudCluster is infrastructure-ready")
-
 	// If the SakuraCloudCluster doesn't have our finalizer, add it.
 	if !clusterutilv1.Contains(ctx.SakuraCloudCluster.Finalizers, infrav1.ClusterFinalizer) {
 		ctx.SakuraCloudCluster.Finalizers = append(ctx.SakuraCloudCluster.Finalizers, infrav1.ClusterFinalizer)
@@ -140,6 +206,30 @@ func (r *SakuraCloudClusterReconciler) reconcileNormal(ctx *context.ClusterConte
 			"cluster-name", ctx.SakuraCloudCluster.Name)
 	}
 
+	// Refuse to create resources if the API key isn't allowed to.
+	var service services.SakuraCloudClusterInterface = &services.SakuraCloudService{}
+	if _, err := service.CheckCredentials(ctx); err != nil {
+		return reconcile.Result{}, errors.Wrapf(err,
+			"failed to check credentials for SakuraCloudCluster %s/%s",
+			ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
+	}
+	if !infrautilv1.IsConditionTrue(ctx.SakuraCloudCluster.Status.Conditions, infrav1.ConditionTypeCredentialsValid) {
+		ctx.Logger.Info("API key is not allowed to create resources, requeuing")
+		return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+	}
+
+	// Create or update the resources shared by the servers, e.g. the packet filter.
+	// Machines are not provisioned until the cluster is infrastructure-ready.
+	if _, err := service.ReconcileCluster(ctx); err != nil {
+		return reconcile.Result{}, errors.Wrapf(err,
+			"failed to reconcile cluster resources for SakuraCloudCluster %s/%s",
+			ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
+	}
+	r.refreshInventory(ctx)
+
+	ctx.SakuraCloudCluster.Status.Ready = true
+	ctx.Logger.V(6).Info("SakuraCloudCluster is infrastructure-ready")
+
 	// Update the SakuraCloudCluster resource with its API enpoints.
 	if err := r.reconcileAPIEndpoints(ctx); err != nil {
 		return reconcile.Result{}, errors.Wrapf(err,
@@ -149,6 +239,10 @@ func (r *SakuraCloudClusterReconciler) reconcileNormal(ctx *context.ClusterConte
 
 	// Create the external cloud provider addons
 	if err := r.reconcileCloudProvider(ctx); err != nil {
+		if unreachable, ok := infrautilv1.IsClusterUnreachable(err); ok {
+			ctx.Logger.Info("Workload cluster is unreachable, requeuing", "retry-after", unreachable.RetryAfter, "reason", unreachable.Err.Error())
+			return reconcile.Result{RequeueAfter: unreachable.RetryAfter}, nil
+		}
 		return reconcile.Result{}, errors.Wrapf(err,
 			"failed to reconcile cloud provider for SakuraCloudCluster %s/%s",
 			ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
@@ -157,75 +251,231 @@ func (r *SakuraCloudClusterReconciler) reconcileNormal(ctx *context.ClusterConte
 	return reconcile.Result{}, nil
 }
 
+// refreshInventory summarizes the resources owned by the cluster in the status.
+// The inventory is informational, so failures are only logged.
+func (r *SakuraCloudClusterReconciler) refreshInventory(ctx *context.ClusterContext) {
+	var service services.SakuraCloudClusterInterface = &services.SakuraCloudService{}
+	if _, err := service.RefreshInventory(ctx); err != nil {
+		ctx.Logger.Error(err, "failed to refresh the inventory of SakuraCloud resources")
+	}
+}
+
 func (r *SakuraCloudClusterReconciler) reconcileAPIEndpoints(ctx *context.ClusterContext) error {
+	if ctx.SakuraCloudCluster.Spec.DNS != nil {
+		return r.reconcileAPIEndpointRecord(ctx)
+	}
+
 	// If the cluster already has API endpoints set then there is nothing to do.
 	if len(ctx.SakuraCloudCluster.Status.APIEndpoints) > 0 {
 		ctx.Logger.V(6).Info("API endpoints already exist")
 		return nil
 	}
 
+	// TODO HA対応
+	addresses, err := r.controlPlaneAddresses(ctx)
+	if err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		return infrautilv1.ErrNoMachineIPAddr
+	}
+
+	apiEndpoint := infrav1.APIEndpoint{
+		Host: addresses[0],
+		Port: apiEndpointPort,
+	}
+	ctx.Logger.V(6).Info(
+		"found API endpoint via control plane machine",
+		"host", apiEndpoint.Host, "port", apiEndpoint.Port)
+
+	// Set APIEndpoints so the CAPI controller can read the API endpoints
+	// for this SakuraCloudCluster into the analogous CAPI Cluster using an
+	// UnstructuredReader.
+	ctx.SakuraCloudCluster.Status.APIEndpoints = []infrav1.APIEndpoint{apiEndpoint}
+	return nil
+}
+
+// reconcileAPIEndpointRecord keeps the DNS records of the API endpoint pointing to all control plane machines,
+// and uses the FQDN of the records as the API endpoint.
+func (r *SakuraCloudClusterReconciler) reconcileAPIEndpointRecord(ctx *context.ClusterContext) error {
+	addresses, err := r.controlPlaneAddresses(ctx)
+	if err != nil {
+		return err
+	}
+
+	var service services.SakuraCloudClusterInterface = &services.SakuraCloudService{}
+	if _, err := service.ReconcileAPIEndpointRecord(ctx, addresses); err != nil {
+		return errors.Wrapf(err,
+			"failed to reconcile DNS records of the API endpoint for SakuraCloudCluster %s/%s",
+			ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
+	}
+
+	ref := ctx.SakuraCloudCluster.Status.APIEndpointRecord
+	if ref == nil {
+		return infrautilv1.ErrNoMachineIPAddr
+	}
+
+	// The API endpoint of a running cluster isn't changed because the certificates don't include the new one.
+	if len(ctx.SakuraCloudCluster.Status.APIEndpoints) == 0 {
+		ctx.SakuraCloudCluster.Status.APIEndpoints = []infrav1.APIEndpoint{
+			{
+				Host: ref.FQDN(),
+				Port: apiEndpointPort,
+			},
+		}
+	}
+	return nil
+}
+
+// controlPlaneAddresses returns the preferred IP addresses of the control plane machines serving the API.
+// Once the control plane is initialized, only the machines whose nodes have joined are included,
+// and the machines being deleted are never included.
+func (r *SakuraCloudClusterReconciler) controlPlaneAddresses(ctx *context.ClusterContext) ([]string, error) {
 	// Get the CAPI Machine resources for the cluster.
 	machines, err := infrautilv1.GetMachinesInCluster(ctx, ctx.Client, ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
 	if err != nil {
-		return errors.Wrapf(err,
+		return nil, errors.Wrapf(err,
 			"failed to get Machines for Cluster %s/%s",
 			ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
 	}
+	controlPlanes := servingControlPlaneMachines(ctx, machines)
 
-	// Iterate over the cluster's control plane CAPI machines.
-	for _, machine := range clusterutilv1.GetControlPlaneMachines(machines) {
-
-		// TODO HA対応
-		var apiEndpoint infrav1.APIEndpoint
+	// Get the SakuraCloudMachines referred by the CAPI Machine resources.
+	sakuracloudMachines, err := infrautilv1.GetSakuraCloudMachinesForMachines(ctx, ctx.Client, controlPlanes)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to get SakuraCloudMachines for Cluster %s/%s",
+			ctx.SakuraCloudCluster.Namespace, ctx.SakuraCloudCluster.Name)
+	}
 
-		if machine.Spec.Bootstrap.Data == nil {
-			ctx.Logger.V(6).Info(
-				"skipping machine while looking for IP address",
-				"machine-name", machine.Name,
-				"skip-reason", "nilBootstrapData")
+	var addresses []string
+	for _, machine := range controlPlanes {
+		sakuracloudMachine, ok := sakuracloudMachines[machine.Name]
+		if !ok || !sakuracloudMachine.DeletionTimestamp.IsZero() {
 			continue
 		}
 
-		// Get the SakuraCloudMachine for the CAPI Machine resource.
-		sakuracloudMachine, err := infrautilv1.GetSakuraCloudMachine(ctx, ctx.Client, machine.Namespace, machine.Name)
-		if err != nil {
-			return errors.Wrapf(err,
-				"failed to get SakuraCloudMachine for Machine %s/%s/%s",
-				machine.Namespace, ctx.SakuraCloudCluster.Name, machine.Name)
-		}
-
 		// Get the SakuraCloudMachine's preferred IP address.
 		ipAddr, err := infrautilv1.GetMachinePreferredIPAddress(sakuracloudMachine)
 		if err != nil {
 			if err == infrautilv1.ErrNoMachineIPAddr {
 				continue
 			}
-			return errors.Wrapf(err,
+			return nil, errors.Wrapf(err,
 				"failed to get preferred IP address for SakuraCloudMachine %s/%s/%s",
 				machine.Namespace, ctx.SakuraCloudCluster.Name, sakuracloudMachine.Name)
 		}
+		addresses = append(addresses, ipAddr)
+	}
+	return addresses, nil
+}
 
-		apiEndpoint.Host = ipAddr
-		apiEndpoint.Port = apiEndpointPort
-
-		ctx.Logger.V(6).Info(
-			"found API endpoint via control plane machine",
-			"host", apiEndpoint.Host, "port", apiEndpoint.Port)
-
-		// Set APIEndpoints so the CAPI controller can read the API endpoints
-		// for this SakuraCloudCluster into the analogous CAPI Cluster using an
-		// UnstructuredReader.
-		ctx.SakuraCloudCluster.Status.APIEndpoints = []infrav1.APIEndpoint{apiEndpoint}
-		return nil
+// servingControlPlaneMachines returns the control plane machines which serve or are about to serve the API.
+// While the control plane is initialized, the first control plane machine is included before its node joins
+// because kubeadm waits for the API endpoint to be reachable.
+func servingControlPlaneMachines(ctx *context.ClusterContext, machines []*clusterv1.Machine) []*clusterv1.Machine {
+	var serving []*clusterv1.Machine
+	for _, machine := range clusterutilv1.GetControlPlaneMachines(machines) {
+		skipReason := ""
+		switch {
+		case !machine.DeletionTimestamp.IsZero():
+			skipReason = "deleting"
+		case machine.Spec.Bootstrap.Data == nil:
+			skipReason = "nilBootstrapData"
+		case ctx.Cluster.Status.ControlPlaneInitialized && machine.Status.NodeRef == nil:
+			skipReason = "nodeNotJoined"
+		}
+		if skipReason != "" {
+			ctx.Logger.V(6).Info(
+				"skipping machine while looking for IP address",
+				"machine-name", machine.Name,
+				"skip-reason", skipReason)
+			continue
+		}
+		serving = append(serving, machine)
 	}
-	return infrautilv1.ErrNoMachineIPAddr
+	return serving
 }
 
 // SetupWithManager adds this controller to the provided manager.
 func (r *SakuraCloudClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	c, err := ctrl.NewControllerManagedBy(mgr).
 		For(&infrav1.SakuraCloudCluster{}).
-		Complete(r)
+		WithOptions(controller.Options{MaxConcurrentReconciles: config.MaxConcurrentReconciles}).
+		Build(r)
+	if err != nil {
+		return err
+	}
+
+	// Watch the machines to update the API endpoint, and to finish deleting the cluster
+	if err := c.Watch(
+		&source.Kind{Type: &infrav1.SakuraCloudMachine{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.machineToSakuraCloudCluster)},
+		machineEndpointChanged,
+	); err != nil {
+		return err
+	}
+	return c.Watch(
+		&source.Kind{Type: &clusterv1.Machine{}},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.machineToSakuraCloudCluster)},
+		machineEndpointChanged,
+	)
+}
+
+// machineEndpointChanged passes the creations and deletions of the machines, and the updates which may change
+// the addresses of the API endpoint. The other updates, e.g. the power state and the costs, are ignored.
+var machineEndpointChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		if !reflect.DeepEqual(e.MetaOld.GetDeletionTimestamp(), e.MetaNew.GetDeletionTimestamp()) ||
+			!reflect.DeepEqual(e.MetaOld.GetLabels(), e.MetaNew.GetLabels()) {
+			return true
+		}
+		switch oldMachine := e.ObjectOld.(type) {
+		case *infrav1.SakuraCloudMachine:
+			newMachine, ok := e.ObjectNew.(*infrav1.SakuraCloudMachine)
+			return ok && !reflect.DeepEqual(oldMachine.Status.Addresses, newMachine.Status.Addresses)
+		case *clusterv1.Machine:
+			newMachine, ok := e.ObjectNew.(*clusterv1.Machine)
+			return ok && ((oldMachine.Spec.Bootstrap.Data == nil) != (newMachine.Spec.Bootstrap.Data == nil) ||
+				(oldMachine.Status.NodeRef == nil) != (newMachine.Status.NodeRef == nil))
+		}
+		return false
+	},
+}
+
+// machineToSakuraCloudCluster maps the control-plane Machines and their SakuraCloudMachines to the SakuraCloudCluster
+// of their cluster, so that the API endpoint is updated when the control plane changes.
+// The other machines are mapped only while the cluster is being deleted, which waits for them to be deleted.
+func (r *SakuraCloudClusterReconciler) machineToSakuraCloudCluster(o handler.MapObject) []reconcile.Request {
+	ctx := goctx.Background()
+
+	machine, ok := o.Object.(*clusterv1.Machine)
+	if !ok {
+		// SakuraCloudMachines may not have the cluster label, use the owner Machine
+		owner, err := clusterutilv1.GetOwnerMachine(ctx, r.Client, metav1.ObjectMeta{
+			Namespace:       o.Meta.GetNamespace(),
+			OwnerReferences: o.Meta.GetOwnerReferences(),
+		})
+		if err != nil || owner == nil {
+			return nil
+		}
+		machine = owner
+	}
+
+	cluster, err := clusterutilv1.GetClusterFromMetadata(ctx, r.Client, machine.ObjectMeta)
+	if err != nil {
+		return nil
+	}
+	if !infrautilv1.IsControlPlaneMachine(machine) && cluster.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	ref := cluster.Spec.InfrastructureRef
+	if ref == nil || ref.Kind != "SakuraCloudCluster" {
+		return nil
+	}
+	return []reconcile.Request{
+		{NamespacedName: client.ObjectKey{Namespace: cluster.Namespace, Name: ref.Name}},
+	}
 }
 
 func (r *SakuraCloudClusterReconciler) reconcileCloudProvider(ctx *context.ClusterContext) error {
@@ -249,7 +499,7 @@ func (r *SakuraCloudClusterReconciler) reconcileCloudProvider(ctx *context.Clust
 		conf.ClusterID = "sakuracloud"
 	}
 
-	targetClusterClient, err := infrautilv1.NewKubeClient(ctx, ctx.Client, ctx.Cluster)
+	targetClusterClient, err := infrautilv1.GetOrCreateKubeClient(ctx, ctx.Client, ctx.Cluster)
 	if err != nil {
 		return errors.Wrapf(err,
 			"failed to get client for Cluster %s/%s",
@@ -18,16 +18,25 @@ package controllers
 
 import (
 	"context"
+	"testing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	sakuracloudcontext "github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
 )
 
 var _ = Describe("SakuraCloudClusterReconciler", func() {
@@ -60,3 +69,176 @@ var _ = Describe("SakuraCloudClusterReconciler", func() {
 		})
 	})
 })
+
+func TestMachineToSakuraCloudCluster(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(infrav1.AddToScheme(scheme)).To(Succeed())
+
+	newCluster := func(name string) *clusterv1.Cluster {
+		return &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: clusterv1.ClusterSpec{
+				InfrastructureRef: &corev1.ObjectReference{Kind: "SakuraCloudCluster", Name: name + "-sakuracloud"},
+			},
+		}
+	}
+	newMachine := func(clusterName, name string, controlPlane bool) *clusterv1.Machine {
+		labels := map[string]string{clusterv1.MachineClusterLabelName: clusterName}
+		if controlPlane {
+			labels[clusterv1.MachineControlPlaneLabelName] = "true"
+		}
+		return &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}}
+	}
+	newSakuraCloudMachine := func(owner *clusterv1.Machine) *infrav1.SakuraCloudMachine {
+		return &infrav1.SakuraCloudMachine{ObjectMeta: metav1.ObjectMeta{
+			Name:      owner.Name + "-xxxxx",
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: clusterv1.GroupVersion.String(), Kind: "Machine", Name: owner.Name},
+			},
+		}}
+	}
+
+	running := newCluster("running")
+	deleting := newCluster("deleting")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+
+	controlPlane := newMachine("running", "running-controlplane-0", true)
+	worker := newMachine("running", "running-md-0-a", false)
+	deletingWorker := newMachine("deleting", "deleting-md-0-a", false)
+	controllerClient := fake.NewFakeClientWithScheme(scheme, running, deleting, controlPlane, worker, deletingWorker)
+	r := &SakuraCloudClusterReconciler{Client: controllerClient}
+
+	mapObject := func(o runtime.Object) []ctrl.Request {
+		objectMeta, err := meta.Accessor(o)
+		g.Expect(err).NotTo(HaveOccurred())
+		return r.machineToSakuraCloudCluster(handler.MapObject{Meta: objectMeta, Object: o})
+	}
+	runningRequest := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: "default", Name: "running-sakuracloud"}}
+
+	// the control plane changes the API endpoint
+	g.Expect(mapObject(controlPlane)).To(Equal([]ctrl.Request{runningRequest}))
+	g.Expect(mapObject(newSakuraCloudMachine(controlPlane))).To(Equal([]ctrl.Request{runningRequest}))
+
+	// the workers don't, unless the cluster waits for them to be deleted
+	g.Expect(mapObject(worker)).To(BeEmpty())
+	g.Expect(mapObject(newSakuraCloudMachine(worker))).To(BeEmpty())
+	g.Expect(mapObject(deletingWorker)).To(Equal([]ctrl.Request{
+		{NamespacedName: client.ObjectKey{Namespace: "default", Name: "deleting-sakuracloud"}},
+	}))
+
+	// the owner Machine is not found
+	g.Expect(mapObject(newSakuraCloudMachine(newMachine("running", "deleted", true)))).To(BeEmpty())
+}
+
+func TestControlPlaneAddresses(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(clusterv1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(infrav1.AddToScheme(scheme)).To(Succeed())
+
+	data := "data"
+	now := metav1.Now()
+	var objects []runtime.Object
+	// newControlPlane returns a control-plane Machine whose SakuraCloudMachine is cloned from the template
+	newControlPlane := func(name, address string, joined bool) *clusterv1.Machine {
+		machine := &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{
+				clusterv1.MachineClusterLabelName:      "example",
+				clusterv1.MachineControlPlaneLabelName: "true",
+			}},
+			Spec: clusterv1.MachineSpec{
+				Bootstrap:         clusterv1.Bootstrap{Data: &data},
+				InfrastructureRef: corev1.ObjectReference{Kind: "SakuraCloudMachine", Name: name + "-xxxxx"},
+			},
+		}
+		if joined {
+			machine.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: name}
+		}
+		sakuracloudMachine := &infrav1.SakuraCloudMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: name + "-xxxxx", Namespace: "default"},
+			Status: infrav1.SakuraCloudMachineStatus{
+				Addresses: []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: address}},
+			},
+		}
+		objects = append(objects, machine, sakuracloudMachine)
+		return machine
+	}
+
+	newControlPlane("example-controlplane-0", "203.0.113.10", true)
+	newControlPlane("example-controlplane-1", "203.0.113.11", false)
+	newControlPlane("example-controlplane-2", "203.0.113.12", true).DeletionTimestamp = &now
+	cluster := &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: "default"}}
+	ctx := &sakuracloudcontext.ClusterContext{
+		Context:            context.Background(),
+		Cluster:            cluster,
+		SakuraCloudCluster: &infrav1.SakuraCloudCluster{ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: "default"}},
+		Client:             fake.NewFakeClientWithScheme(scheme, objects...),
+		Logger:             log.Log,
+	}
+	r := &SakuraCloudClusterReconciler{Client: ctx.Client}
+
+	// the first control plane is published while the control plane is initialized
+	addresses, err := r.controlPlaneAddresses(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(addresses).To(Equal([]string{"203.0.113.10", "203.0.113.11"}))
+
+	// the control planes whose nodes haven't joined yet are not published after that
+	cluster.Status.ControlPlaneInitialized = true
+	addresses, err = r.controlPlaneAddresses(ctx)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(addresses).To(Equal([]string{"203.0.113.10"}))
+}
+
+func TestMachineEndpointChanged(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	update := func(oldObject, newObject runtime.Object) bool {
+		oldMeta, err := meta.Accessor(oldObject)
+		g.Expect(err).NotTo(HaveOccurred())
+		newMeta, err := meta.Accessor(newObject)
+		g.Expect(err).NotTo(HaveOccurred())
+		return machineEndpointChanged.Update(event.UpdateEvent{MetaOld: oldMeta, ObjectOld: oldObject, MetaNew: newMeta, ObjectNew: newObject})
+	}
+
+	sakuracloudMachine := &infrav1.SakuraCloudMachine{ObjectMeta: metav1.ObjectMeta{Name: "example-controlplane-0", Namespace: "default"}}
+
+	// status updates not changing the addresses
+	patched := sakuracloudMachine.DeepCopy()
+	patched.Status.InstanceStatus = "up"
+	patched.Status.Conditions = []infrav1.Condition{{Type: infrav1.ConditionTypePoweredOn, Status: corev1.ConditionTrue}}
+	g.Expect(update(sakuracloudMachine, patched)).To(BeFalse())
+
+	// addresses
+	addressed := patched.DeepCopy()
+	addressed.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: "203.0.113.11"}}
+	g.Expect(update(patched, addressed)).To(BeTrue())
+
+	// deletion
+	deleted := addressed.DeepCopy()
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	g.Expect(update(addressed, deleted)).To(BeTrue())
+
+	// bootstrap data and nodes of Machines
+	machine := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "example-controlplane-0", Namespace: "default"}}
+	bootstrapped := machine.DeepCopy()
+	data := "data"
+	bootstrapped.Spec.Bootstrap.Data = &data
+	g.Expect(update(machine, bootstrapped)).To(BeTrue())
+	running := bootstrapped.DeepCopy()
+	running.Status.Phase = "running"
+	g.Expect(update(bootstrapped, running)).To(BeFalse())
+	joined := running.DeepCopy()
+	joined.Status.NodeRef = &corev1.ObjectReference{Kind: "Node", Name: "example-controlplane-0"}
+	g.Expect(update(running, joined)).To(BeTrue())
+
+	// creations and deletions always pass
+	g.Expect(machineEndpointChanged.Create(event.CreateEvent{Meta: sakuracloudMachine, Object: sakuracloudMachine})).To(BeTrue())
+	g.Expect(machineEndpointChanged.Delete(event.DeleteEvent{Meta: sakuracloudMachine, Object: sakuracloudMachine})).To(BeTrue())
+}
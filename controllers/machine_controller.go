@@ -19,18 +19,23 @@ package controllers
 import (
 	goctx "context"
 	"fmt"
+	"sync"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/services"
 	"github.com/sacloud/libsacloud/v2/sacloud/types"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/tools/record"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	clusterutilv1 "sigs.k8s.io/cluster-api/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
@@ -38,6 +43,8 @@ import (
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+	infrautilv1 "github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
 
 	clusterv1errors "sigs.k8s.io/cluster-api/errors"
 )
@@ -53,11 +60,23 @@ type SakuraCloudMachineReconciler struct {
 	client.Client
 	Log      logr.Logger
 	Recorder record.EventRecorder
+
+	// jobOwners is the SakuraCloudMachines waiting for the jobs, keyed by job ID.
+	// The owners are kept until the machines don't refer to the jobs.
+	jobOwners sync.Map
+	// machineEvents enqueues the SakuraCloudMachines
+	machineEvents chan event.GenericEvent
+}
+
+// jobGetter returns the snapshots of the jobs
+type jobGetter interface {
+	JobByID(id string) *session.JobStatus
 }
 
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudmachines,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudmachines/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines;machines/status,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.cluster.x-k8s.io,resources=sakuracloudarchives,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=events,verbs=get;list;watch;create;update;patch
 
 // Reconcile ensures the back-end state reflects the Kubernetes resource state intent.
@@ -73,6 +92,7 @@ func (r *SakuraCloudMachineReconciler) Reconcile(req ctrl.Request) (_ ctrl.Resul
 	sakuracloudMachine := &infrav1.SakuraCloudMachine{}
 	if err := r.Get(parentContext, req.NamespacedName, sakuracloudMachine); err != nil {
 		if apierrors.IsNotFound(err) {
+			r.forgetJobs(req.NamespacedName, nil)
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, err
@@ -135,53 +155,186 @@ func (r *SakuraCloudMachineReconciler) Reconcile(req ctrl.Request) (_ ctrl.Resul
 		return reconcile.Result{}, errors.Wrapf(err, "failed to create machine context")
 	}
 
+	// Always close the context when exiting this function so we can persist any SakuraCloudMachine changes.
+	// This must precede the spec completion below, whose errors and results are recorded in the SakuraCloudMachine.
+	defer func() {
+		if err := machineContext.Patch(); err != nil && reterr == nil {
+			reterr = err
+		}
+		r.watchJobs(req.NamespacedName, sakuracloudMachine, machineContext.Session)
+	}()
+
+	// Skip all changes on SakuraCloud while the cluster is paused or in maintenance.
+	if reason := infrautilv1.PauseReason(cluster, sakuracloudCluster, sakuracloudMachine); reason != "" {
+		return r.reconcilePaused(machineContext, reason)
+	}
+	if infrautilv1.GetCondition(sakuracloudMachine.Status.Conditions, infrav1.ConditionTypePaused) != nil {
+		sakuracloudMachine.Status.Conditions = infrautilv1.SetCondition(sakuracloudMachine.Status.Conditions,
+			infrav1.ConditionTypePaused, corev1.ConditionFalse, "Resumed", "")
+	}
+
+	// select the zone of the server
+	if sakuracloudMachine.Spec.Zone == nil {
+		zone := clusterContext.Zone()
+		// servers created before the zone was recorded are in the cluster's zone
+		if sakuracloudMachine.Spec.MachineRef == nil && sakuracloudMachine.DeletionTimestamp.IsZero() {
+			machines, err := infrautilv1.GetMachinesInCluster(machineContext, r.Client, cluster.Namespace, cluster.Name)
+			if err != nil {
+				return reconcile.Result{}, errors.Wrapf(err, "failed to list Machines")
+			}
+			sakuracloudMachines, err := infrautilv1.GetSakuraCloudMachinesForMachines(machineContext, r.Client, machines)
+			if err != nil {
+				return reconcile.Result{}, errors.Wrapf(err, "failed to get SakuraCloudMachines")
+			}
+			zone = infrautilv1.SelectZone(clusterContext.Zones(), machines, sakuracloudMachines, infrautilv1.IsControlPlaneMachine(machine))
+		}
+		sakuracloudMachine.Spec.Zone = &zone
+	}
+	// servers in a zone removed from the cluster are still deleted
+	if sakuracloudMachine.DeletionTimestamp.IsZero() && !clusterContext.HasZone(machineContext.Zone()) {
+		msg := fmt.Sprintf("zone %q is not one of the zones of the cluster", machineContext.Zone())
+		machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, msg)
+		return reconcile.Result{}, errors.New(msg)
+	}
+
+	// Handle deleted machines
+	// The spec isn't completed for them, as the source archives may have been deleted already.
+	if !sakuracloudMachine.ObjectMeta.DeletionTimestamp.IsZero() {
+		return r.reconcileDelete(machineContext)
+	}
+
 	// complete cluster spec
+	if sakuracloudMachine.Spec.SourceArchive.ID == nil && sakuracloudMachine.Spec.SourceArchive.ArchiveRef != "" {
+		id, err := r.archiveIDFromRef(machineContext, sakuracloudMachine.Spec.SourceArchive.ArchiveRef)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if id == nil {
+			return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+		}
+		sakuracloudMachine.Spec.SourceArchive.ID = id
+	}
 	if sakuracloudMachine.Spec.SourceArchive.ID == nil {
-		archive, err := machineContext.Session.FindArchive(machineContext, machineContext.Zone(), sakuracloudMachine.Spec.SourceArchive.Filters)
+		ref := &sakuracloudMachine.Spec.SourceArchive
+		if ref.MatchKubernetesVersion {
+			if machine.Spec.Version == nil || *machine.Spec.Version == "" {
+				msg := "machine has no Kubernetes version to select the source archive"
+				machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, msg)
+				return reconcile.Result{}, errors.New(msg)
+			}
+			ref = session.ArchiveReferenceForKubernetesVersion(ref, *machine.Spec.Version)
+		}
+
+		archive, err := machineContext.Session.FindArchive(machineContext, machineContext.Zone(), ref)
 		if err != nil {
-			machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, err.Error())
+			// temporary failures of the API are retried
+			if !session.IsRetryableError(err) {
+				machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, err.Error())
+			}
 			return reconcile.Result{}, errors.Errorf("failed to set source archive id: %+v", err)
 		}
 
 		if archive == nil {
-			machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, "archive not found")
-			return reconcile.Result{}, errors.Errorf("failed to set source archive id: %+v", "archive not found")
+			msg := "archive not found"
+			if ref.MatchKubernetesVersion {
+				msg = fmt.Sprintf("archive for Kubernetes version %s not found in zone %q", *machine.Spec.Version, machineContext.Zone())
+			}
+			machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, msg)
+			return reconcile.Result{}, errors.Errorf("failed to set source archive id: %+v", msg)
 		}
 
 		id := archive.ID.String()
 		machineContext.SakuraCloudMachine.Spec.SourceArchive.ID = &id
 	}
 
+	for i := range sakuracloudMachine.Spec.AdditionalDisks {
+		disk := &sakuracloudMachine.Spec.AdditionalDisks[i]
+		if disk.SourceArchive == nil || disk.SourceArchive.ID != nil {
+			continue
+		}
+		if disk.SourceArchive.ArchiveRef != "" {
+			id, err := r.archiveIDFromRef(machineContext, disk.SourceArchive.ArchiveRef)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if id == nil {
+				return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+			}
+			disk.SourceArchive.ID = id
+			continue
+		}
+		archive, err := machineContext.Session.FindArchive(machineContext, machineContext.Zone(), disk.SourceArchive)
+		if err != nil {
+			if !session.IsRetryableError(err) {
+				machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, err.Error())
+			}
+			return reconcile.Result{}, errors.Errorf("failed to set source archive id of disk %q: %+v", disk.Name, err)
+		}
+		if archive == nil {
+			machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, "archive not found")
+			return reconcile.Result{}, errors.Errorf("failed to set source archive id of disk %q: %+v", disk.Name, "archive not found")
+		}
+
+		id := archive.ID.String()
+		disk.SourceArchive.ID = &id
+	}
+
 	if sakuracloudMachine.Status.SourceArchive == nil {
 		archive, err := machineContext.Session.ReadArchive(machineContext, machineContext.Zone(), types.StringID(*sakuracloudMachine.Spec.SourceArchive.ID))
 		if err != nil {
-			machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, err.Error())
+			if !session.IsRetryableError(err) {
+				machineContext.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, err.Error())
+			}
 			return reconcile.Result{}, errors.Errorf("failed to get source archive info: %+v", err)
 		}
 		sakuracloudMachine.Status.SourceArchive = &infrav1.SourceArchiveInfo{
 			ID:   archive.ID.String(),
 			Name: archive.Name,
 		}
-	}
-
-	// Always close the context when exiting this function so we can persist any SakuraCloudMachine changes.
-	defer func() {
-		if err := machineContext.Patch(); err != nil && reterr == nil {
-			reterr = err
+		if sakuracloudMachine.Spec.SourceArchive.MatchKubernetesVersion && machine.Spec.Version != nil {
+			sakuracloudMachine.Status.SourceArchive.KubernetesVersion = *machine.Spec.Version
 		}
-	}()
-
-	// Handle deleted machines
-	if !sakuracloudMachine.ObjectMeta.DeletionTimestamp.IsZero() {
-		return r.reconcileDelete(machineContext)
 	}
 
 	// Handle non-deleted machines
 	return r.reconcileNormal(machineContext)
 }
 
+// archiveIDFromRef returns the ID of the archive imported by the SakuraCloudArchive in the machine's zone,
+// or nil if the archive isn't available yet.
+func (r *SakuraCloudMachineReconciler) archiveIDFromRef(ctx *context.MachineContext, name string) (*string, error) {
+	archive := &infrav1.SakuraCloudArchive{}
+	key := client.ObjectKey{Namespace: ctx.SakuraCloudMachine.Namespace, Name: name}
+	if err := r.Client.Get(ctx, key, archive); err != nil {
+		if apierrors.IsNotFound(err) {
+			ctx.Logger.Info("Waiting for SakuraCloudArchive", "sakuracloudArchive", name)
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get SakuraCloudArchive %s/%s", key.Namespace, key.Name)
+	}
+
+	id, ok := archive.Status.ArchiveIDs[ctx.Zone()]
+	if !ok || id == "" {
+		if !archive.HasZone(ctx.Zone()) {
+			msg := fmt.Sprintf("SakuraCloudArchive %q is not placed in zone %q", name, ctx.Zone())
+			ctx.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, msg)
+			return nil, errors.New(msg)
+		}
+		ctx.Logger.Info("Waiting for SakuraCloudArchive to be available", "sakuracloudArchive", name, "zone", ctx.Zone())
+		return nil, nil
+	}
+	return &id, nil
+}
+
 // SetupWithManager adds this controller to the provided manager.
 func (r *SakuraCloudMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	jobEvents, err := context.SubscribeJobs()
+	if err != nil {
+		return err
+	}
+	r.machineEvents = make(chan event.GenericEvent)
+	go r.forwardJobEvents(jobEvents)
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&infrav1.SakuraCloudMachine{}).Watches(
 		&source.Kind{Type: &clusterv1.Machine{}},
@@ -192,7 +345,66 @@ func (r *SakuraCloudMachineReconciler) SetupWithManager(mgr ctrl.Manager) error
 				Kind:    "SakuraCloudMachine",
 			}),
 		},
-	).Complete(r)
+	).Watches(
+		&source.Channel{Source: r.machineEvents},
+		&handler.EnqueueRequestForObject{},
+	).WithOptions(controller.Options{MaxConcurrentReconciles: config.MaxConcurrentReconciles}).Complete(r)
+}
+
+// watchJobs records the SakuraCloudMachine as the owner of its running jobs
+// so that it's enqueued when the jobs change state.
+// The jobs may finish before the owner is recorded, whose events are dropped, so the machine is enqueued at once for them.
+func (r *SakuraCloudMachineReconciler) watchJobs(name client.ObjectKey, machine *infrav1.SakuraCloudMachine, jobs jobGetter) {
+	refs := make(map[session.JobID]bool)
+	for _, jobRef := range []string{machine.Status.JobRef, machine.Status.BackupJobRef} {
+		if jobRef != "" {
+			refs[session.JobID(jobRef)] = true
+		}
+	}
+	r.forgetJobs(name, refs)
+
+	for id := range refs {
+		if _, recorded := r.jobOwners.LoadOrStore(id, name); recorded {
+			continue
+		}
+		job := jobs.JobByID(string(id))
+		if job != nil && (job.State == session.JobStateDone || job.State == session.JobStateFailed) {
+			r.enqueue(name)
+		}
+	}
+}
+
+// forgetJobs removes the SakuraCloudMachine from the owners of the jobs other than the ones in refs
+func (r *SakuraCloudMachineReconciler) forgetJobs(name client.ObjectKey, refs map[session.JobID]bool) {
+	r.jobOwners.Range(func(id, owner interface{}) bool {
+		if owner.(client.ObjectKey) == name && !refs[id.(session.JobID)] {
+			r.jobOwners.Delete(id)
+		}
+		return true
+	})
+}
+
+// forwardJobEvents enqueues the owners of the jobs which changed state.
+// The machines are still requeued after config.JobPollingPeriod in case the events are missed.
+func (r *SakuraCloudMachineReconciler) forwardJobEvents(jobEvents <-chan session.JobEvent) {
+	for e := range jobEvents {
+		if owner, ok := r.jobOwners.Load(e.ID); ok {
+			r.enqueue(owner.(client.ObjectKey))
+		}
+	}
+}
+
+// enqueue sends the event of the SakuraCloudMachine without blocking the caller
+func (r *SakuraCloudMachineReconciler) enqueue(name client.ObjectKey) {
+	if r.machineEvents == nil {
+		return
+	}
+	machine := &infrav1.SakuraCloudMachine{
+		ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name},
+	}
+	go func() {
+		r.machineEvents <- event.GenericEvent{Meta: machine, Object: machine}
+	}()
 }
 
 func (r *SakuraCloudMachineReconciler) reconcileDelete(ctx *context.MachineContext) (reconcile.Result, error) {
@@ -208,7 +420,7 @@ func (r *SakuraCloudMachineReconciler) reconcileDelete(ctx *context.MachineConte
 	// Requeue the operation until the VM is "notfound".
 	if server.Status.State != infrav1.InstanceStateNotFound {
 		ctx.Logger.V(6).Info("requeuing operation until server state is reconciled", "expected-state", infrav1.InstanceStateNotFound, "actual-state", server.Status.State)
-		return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+		return reconcile.Result{RequeueAfter: config.JobPollingPeriod}, nil
 	}
 
 	// The server is deleted so remove the finalizer.
@@ -216,6 +428,18 @@ func (r *SakuraCloudMachineReconciler) reconcileDelete(ctx *context.MachineConte
 	return reconcile.Result{}, nil
 }
 
+func (r *SakuraCloudMachineReconciler) reconcilePaused(ctx *context.MachineContext, reason string) (reconcile.Result, error) {
+	ctx.Logger.Info("Reconciliation is paused, only refreshing status", "reason", reason)
+	ctx.SakuraCloudMachine.Status.Conditions = infrautilv1.SetCondition(ctx.SakuraCloudMachine.Status.Conditions,
+		infrav1.ConditionTypePaused, corev1.ConditionTrue, reason, "changes on SakuraCloud are skipped")
+
+	var service services.SakuraCloudMachineInterface = &services.SakuraCloudService{}
+	if _, err := service.RefreshServer(ctx); err != nil {
+		return reconcile.Result{}, errors.Wrapf(err, "failed to refresh server status")
+	}
+	return reconcile.Result{RequeueAfter: config.PowerStateSyncPeriod}, nil
+}
+
 func (r *SakuraCloudMachineReconciler) reconcileNormal(ctx *context.MachineContext) (reconcile.Result, error) {
 	// If the SakuraCloudMachine is in an error state, return early.
 	if ctx.SakuraCloudMachine.Status.ErrorReason != nil || ctx.SakuraCloudMachine.Status.ErrorMessage != nil {
@@ -247,7 +471,7 @@ func (r *SakuraCloudMachineReconciler) reconcileNormal(ctx *context.MachineConte
 
 	if sacloudMachine.Status.State != infrav1.InstanceStateReady {
 		ctx.Logger.V(6).Info("requeuing operation until vm state is reconciled", "expected-vm-state", infrav1.InstanceStateReady, "actual-vm-state", sacloudMachine.Status.State)
-		return reconcile.Result{RequeueAfter: config.DefaultRequeue}, nil
+		return reconcile.Result{RequeueAfter: config.JobPollingPeriod}, nil
 	}
 
 	if err := r.reconcileProviderID(ctx, sacloudMachine, service); err != nil {
@@ -257,7 +481,14 @@ func (r *SakuraCloudMachineReconciler) reconcileNormal(ctx *context.MachineConte
 	ctx.SakuraCloudMachine.Status.Ready = true
 	ctx.Logger.V(6).Info("SakuraCloudMachine is infrastructure-ready")
 
-	return reconcile.Result{}, nil
+	// Requeue the operation until the power operation is finished.
+	if sacloudMachine.Status.JobRef != "" {
+		ctx.Logger.V(6).Info("requeuing operation until power operation is finished", "job", sacloudMachine.Status.JobRef)
+		return reconcile.Result{RequeueAfter: config.JobPollingPeriod}, nil
+	}
+
+	// Requeue to keep the power state and the addresses up to date.
+	return reconcile.Result{RequeueAfter: config.PowerStateSyncPeriod}, nil
 }
 
 func (r *SakuraCloudMachineReconciler) reconcileProviderID(ctx *context.MachineContext, sacloudMachine *infrav1.SakuraCloudMachine, service services.SakuraCloudMachineInterface) error {
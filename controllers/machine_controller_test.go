@@ -17,15 +17,19 @@ limitations under the License.
 package controllers
 
 import (
+	"testing"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
 )
 
 var _ = Describe("SakuraCloudMachineReconciler", func() {
@@ -51,3 +55,47 @@ var _ = Describe("SakuraCloudMachineReconciler", func() {
 		})
 	})
 })
+
+type stubJobGetter map[string]*session.JobStatus
+
+func (s stubJobGetter) JobByID(id string) *session.JobStatus {
+	return s[id]
+}
+
+func TestWatchJobs(t *testing.T) {
+	g := NewGomegaWithT(t)
+
+	events := make(chan event.GenericEvent, 10)
+	r := &SakuraCloudMachineReconciler{machineEvents: events}
+	name := client.ObjectKey{Namespace: "default", Name: "example-md-0-a"}
+	machine := &infrav1.SakuraCloudMachine{}
+	machine.Status.JobRef = "build/is1a/example-md-0-a"
+	jobs := stubJobGetter{"build/is1a/example-md-0-a": {State: session.JobStateInFlight}}
+	owner := func(id string) interface{} {
+		owner, _ := r.jobOwners.Load(session.JobID(id))
+		return owner
+	}
+
+	// the running job is watched
+	r.watchJobs(name, machine, jobs)
+	g.Expect(owner("build/is1a/example-md-0-a")).To(Equal(name))
+	g.Consistently(events).ShouldNot(Receive())
+
+	// the job finished before the owner was recorded enqueues the machine once
+	machine.Status.BackupJobRef = "backup/is1a/example-md-0-a"
+	jobs["backup/is1a/example-md-0-a"] = &session.JobStatus{State: session.JobStateDone}
+	r.watchJobs(name, machine, jobs)
+	g.Eventually(events).Should(Receive())
+	r.watchJobs(name, machine, jobs)
+	g.Consistently(events).ShouldNot(Receive())
+
+	// the jobs the machine doesn't refer to are forgotten
+	machine.Status.BackupJobRef = ""
+	r.watchJobs(name, machine, jobs)
+	g.Expect(owner("backup/is1a/example-md-0-a")).To(BeNil())
+	g.Expect(owner("build/is1a/example-md-0-a")).To(Equal(name))
+
+	// and all jobs of the deleted machine
+	r.forgetJobs(name, nil)
+	g.Expect(owner("build/is1a/example-md-0-a")).To(BeNil())
+}
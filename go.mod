@@ -8,6 +8,7 @@ require (
 	github.com/onsi/ginkgo v1.8.0
 	github.com/onsi/gomega v1.5.0
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v0.9.3-0.20190127221311-3c4408c8b829
 	github.com/sacloud/ftps v0.0.0-20171205062625-42fc0f9886fe
 	github.com/sacloud/libsacloud/v2 v2.0.0-beta5.0.20191011051923-d3fd15b18992
 	k8s.io/api v0.0.0-20190918195907-bd6ac527cfd2
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"net/http"
 	"net/http/pprof"
@@ -35,6 +36,8 @@ import (
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/controllers"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
+	sakuracloudcontext "github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/record"
 )
 
@@ -86,6 +89,46 @@ func main() {
 		"The interval at which cluster-api objects are synchronized")
 	flag.DurationVar(&config.DefaultRequeue, "requeue-period", defaultRequeuePeriod,
 		"The default amount of time to wait before an operation is requeued.")
+	flag.DurationVar(&config.JobPollingPeriod, "job-polling-period", config.JobPollingPeriod,
+		"The interval at which running jobs are polled in case the notification of the jobs is missed.")
+	flag.DurationVar(&config.PowerStateSyncPeriod, "power-state-sync-period", config.PowerStateSyncPeriod,
+		"The interval at which the power state of provisioned servers is synchronized.")
+	flag.DurationVar(&config.CredentialsCheckInterval, "credentials-check-interval", config.CredentialsCheckInterval,
+		"The interval at which the permission of the API key is checked again for each cluster.")
+	flag.IntVar(&config.MaxConcurrentReconciles, "max-concurrent-reconciles", config.MaxConcurrentReconciles,
+		"The maximum number of concurrent reconciles of each controller.")
+	flag.IntVar(&config.MaxConcurrentProvisions, "max-concurrent-provisions", config.MaxConcurrentProvisions,
+		"The maximum number of servers provisioned at once in each zone. 0 means no limit.")
+	flag.StringVar(&config.APIRootURL, "api-root-url", config.APIRootURL,
+		"The root URL of the SakuraCloud API. If unspecified, the default endpoint is used.")
+	flag.StringVar(&config.APIProxyURL, "api-proxy-url", config.APIProxyURL,
+		"The URL of the HTTP proxy for the SakuraCloud API. If unspecified, the proxy environment variables are used.")
+	flag.DurationVar(&config.APITimeout, "api-timeout", config.APITimeout,
+		"The timeout of each request to the SakuraCloud API.")
+	flag.IntVar(&config.APIRetryMax, "api-retry-max", config.APIRetryMax,
+		"The number of retries of the requests to the SakuraCloud API failed because the API is busy.")
+	flag.DurationVar(&config.APIRetryInterval, "api-retry-interval", config.APIRetryInterval,
+		"The amount of time to wait before retrying a request to the SakuraCloud API.")
+	flag.IntVar(&config.APIRateLimitPerSec, "api-rate-limit", config.APIRateLimitPerSec,
+		"The maximum number of requests to the SakuraCloud API per second. 0 means no limit.")
+	flag.StringVar(&config.APIAcceptLanguage, "api-accept-language", config.APIAcceptLanguage,
+		"The Accept-Language header of the requests to the SakuraCloud API, e.g. en-US.")
+	flag.StringVar(&config.PriceTableFile, "price-table-file", config.PriceTableFile,
+		"The path of the JSON file overriding the prices used to estimate the cost of the resources.")
+	flag.IntVar(&config.QuotaServers, "quota-servers", config.QuotaServers,
+		"The maximum number of servers of the account in each zone, checked before provisioning. 0 means no limit.")
+	flag.IntVar(&config.QuotaCPUs, "quota-cpus", config.QuotaCPUs,
+		"The maximum total number of CPU cores of the account in each zone, checked before provisioning. 0 means no limit.")
+	flag.IntVar(&config.QuotaMemoryGB, "quota-memory-gb", config.QuotaMemoryGB,
+		"The maximum total memory size(GB) of the account in each zone, checked before provisioning. 0 means no limit.")
+	flag.IntVar(&config.QuotaDiskGB, "quota-disk-gb", config.QuotaDiskGB,
+		"The maximum total disk size(GB) of the account in each zone, checked before provisioning. 0 means no limit.")
+	flag.StringVar(&config.ArchiveImageDir, "archive-image-dir", config.ArchiveImageDir,
+		"The directory containing the images SakuraCloudArchives can upload by path. If unspecified, path sources are rejected.")
+	flag.StringVar(&config.ArchiveSourceURLSchemes, "archive-source-url-schemes", config.ArchiveSourceURLSchemes,
+		"The comma-separated list of the URL schemes SakuraCloudArchives can download images with.")
+	flag.StringVar(&config.ArchiveSourceHosts, "archive-source-hosts", config.ArchiveSourceHosts,
+		"The comma-separated list of the hosts SakuraCloudArchives can download images from. If unspecified, URL sources are rejected.")
 	flag.Parse()
 
 	if *watchNamespace != "" {
@@ -99,6 +142,21 @@ func main() {
 
 	ctrl.SetLogger(klogr.New())
 
+	// Fail fast if the API key is misconfigured.
+	authCtx, cancel := context.WithTimeout(context.Background(), config.APITimeout)
+	authStatus, err := sakuracloudcontext.AuthStatus(authCtx)
+	cancel()
+	if err != nil {
+		setupLog.Error(err, "unable to validate the SakuraCloud API key")
+		os.Exit(1)
+	}
+	setupLog.Info("Validated the SakuraCloud API key",
+		"account", authStatus.AccountName, "account-id", authStatus.AccountID, "permission", authStatus.Permission)
+	if !session.CanProvision(authStatus.Permission) {
+		setupLog.Info("The SakuraCloud API key is not allowed to create resources, servers will not be provisioned",
+			"permission", authStatus.Permission)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -130,6 +188,14 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "SakuraCloudCluster")
 		os.Exit(1)
 	}
+	if err = (&controllers.SakuraCloudArchiveReconciler{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("SakuraCloudArchive"),
+		Recorder: mgr.GetEventRecorderFor("sakuracloudarchive-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "SakuraCloudArchive")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -24,4 +24,87 @@ var (
 	// DefaultRequeue is the default time for how long to wait when
 	// requeueing a CAPI operation.
 	DefaultRequeue = 10 * time.Second
+
+	// JobPollingPeriod is the interval at which running jobs are polled. Machines are
+	// usually requeued when the jobs finish, so this is only a fallback.
+	JobPollingPeriod = time.Minute
+
+	// PowerStateSyncPeriod is the interval at which the power state of
+	// provisioned servers is read from SakuraCloud.
+	PowerStateSyncPeriod = time.Minute
+
+	// CredentialsCheckInterval is the interval at which the permission of the API key
+	// is checked again for each cluster.
+	CredentialsCheckInterval = 10 * time.Minute
+
+	// DefaultShutdownTimeout is the default time for how long to wait for
+	// servers to shut down via ACPI before powering them off forcibly.
+	DefaultShutdownTimeout = 5 * time.Minute
+
+	// MaxConcurrentReconciles is the maximum number of concurrent reconciles of each controller.
+	MaxConcurrentReconciles = 1
+
+	// MaxConcurrentProvisions is the maximum number of servers provisioned at once in each zone.
+	// The other servers wait in the provisioning queue, control-plane machines first, taking turns between the clusters.
+	MaxConcurrentProvisions = 5
+
+	// PriceTableFile is the path of the JSON file overriding the prices used to estimate the cost of the resources.
+	PriceTableFile = ""
+)
+
+// SakuraCloud API client settings
+var (
+	// APIRootURL overrides the root URL of the SakuraCloud API, e.g. to use a local stand-in API.
+	APIRootURL = ""
+
+	// APIProxyURL is the URL of the HTTP proxy used to call the SakuraCloud API.
+	// If empty, the proxy is taken from the HTTP_PROXY/HTTPS_PROXY environment variables.
+	APIProxyURL = ""
+
+	// APITimeout is the timeout of each request to the SakuraCloud API.
+	APITimeout = 20 * time.Minute
+
+	// APIRetryMax is the number of retries of the requests to the SakuraCloud API
+	// failed because the API is busy.
+	APIRetryMax = 0
+
+	// APIRetryInterval is the time for how long to wait before retrying a request.
+	APIRetryInterval = 5 * time.Second
+
+	// APIRateLimitPerSec is the maximum number of requests to the SakuraCloud API per second. 0 means no limit.
+	APIRateLimitPerSec = 3
+
+	// APIAcceptLanguage is the Accept-Language header of the requests, e.g. en-US to get error messages in English.
+	APIAcceptLanguage = ""
+)
+
+// Account quotas checked before provisioning servers, in each zone.
+// SakuraCloud doesn't expose the limits of the account via the API, so they are configured here. 0 means no limit.
+var (
+	// QuotaServers is the maximum number of servers.
+	QuotaServers = 0
+
+	// QuotaCPUs is the maximum total number of CPU cores of the servers.
+	QuotaCPUs = 0
+
+	// QuotaMemoryGB is the maximum total memory size of the servers.
+	QuotaMemoryGB = 0
+
+	// QuotaDiskGB is the maximum total size of the disks.
+	QuotaDiskGB = 0
+)
+
+// Sources of the images uploaded by SakuraCloudArchives.
+// The sources are restricted because anyone who can create SakuraCloudArchives can make the controller read them.
+var (
+	// ArchiveImageDir is the directory containing the images referred by the path of SakuraCloudArchives.
+	// If empty, images can't be uploaded from the filesystem of the controller.
+	ArchiveImageDir = ""
+
+	// ArchiveSourceURLSchemes is the comma-separated list of the URL schemes images can be downloaded with.
+	ArchiveSourceURLSchemes = "https"
+
+	// ArchiveSourceHosts is the comma-separated list of the hosts images can be downloaded from.
+	// If empty, images can't be downloaded.
+	ArchiveSourceHosts = ""
 )
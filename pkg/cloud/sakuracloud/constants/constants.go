@@ -48,4 +48,21 @@ const (
 	// MaintenanceAnnotationLabel is the annotation used to indicate a machine and/or
 	// cluster are in maintenance mode.
 	MaintenanceAnnotationLabel = "caps." + v1alpha2.GroupName + "/maintenance"
+
+	// PausedAnnotation is the annotation used to pause the reconciliation of a
+	// Cluster and its machines. Cluster.Spec.Paused is not available in
+	// v1alpha2, so the annotation of later versions of Cluster API is used.
+	PausedAnnotation = "cluster.x-k8s.io/paused"
+
+	// RebootRequestedAnnotationLabel is the annotation used to request a reboot
+	// of the server. The value is the time of the request, e.g. 2019-11-01T00:00:00Z.
+	RebootRequestedAnnotationLabel = "caps." + v1alpha2.GroupName + "/reboot-requested"
+
+	// ShutdownRequestedAnnotationLabel is the annotation used to request a
+	// shutdown of the server. The value is the time of the request.
+	ShutdownRequestedAnnotationLabel = "caps." + v1alpha2.GroupName + "/shutdown-requested"
+
+	// BootRequestedAnnotationLabel is the annotation used to request a boot
+	// of the server. The value is the time of the request.
+	BootRequestedAnnotationLabel = "caps." + v1alpha2.GroupName + "/boot-requested"
 )
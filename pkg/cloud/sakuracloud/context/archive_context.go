@@ -0,0 +1,96 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package context
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/klog/klogr"
+	"sigs.k8s.io/cluster-api/util/patch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+)
+
+// ArchiveContextParams are the parameters needed to create an ArchiveContext.
+type ArchiveContextParams struct {
+	Context            context.Context
+	SakuraCloudArchive *infrav1.SakuraCloudArchive
+	Client             client.Client
+	Logger             logr.Logger
+}
+
+// ArchiveContext is a Go context used with a SakuraCloudArchive.
+type ArchiveContext struct {
+	context.Context
+	SakuraCloudArchive *infrav1.SakuraCloudArchive
+	Client             client.Client
+	Logger             logr.Logger
+	Session            *session.Client
+	patchHelper        *patch.Helper
+}
+
+// NewArchiveContext returns a new ArchiveContext.
+func NewArchiveContext(params *ArchiveContextParams) (*ArchiveContext, error) {
+	parentContext := params.Context
+	if parentContext == nil {
+		parentContext = context.Background()
+	}
+
+	logr := params.Logger
+	if logr == nil {
+		logr = klogr.New().WithName("default-logger")
+	}
+	logr = logr.WithName(params.SakuraCloudArchive.Namespace).WithName(params.SakuraCloudArchive.Name)
+
+	session, err := getOrCreateSession()
+	if err != nil {
+		return nil, err
+	}
+	helper, err := patch.NewHelper(params.SakuraCloudArchive, params.Client)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to init patch helper")
+	}
+
+	return &ArchiveContext{
+		Context:            parentContext,
+		SakuraCloudArchive: params.SakuraCloudArchive,
+		Client:             params.Client,
+		Logger:             logr,
+		Session:            session,
+		patchHelper:        helper,
+	}, nil
+}
+
+// Strings returns ArchiveNamespace/ArchiveName
+func (c *ArchiveContext) String() string {
+	return fmt.Sprintf("%s/%s", c.SakuraCloudArchive.Namespace, c.SakuraCloudArchive.Name)
+}
+
+// SetArchiveError sets error details
+func (c *ArchiveContext) SetArchiveError(msg string) {
+	c.SakuraCloudArchive.Status.ErrorMessage = &msg
+}
+
+// Patch updates the object and its status on the API server.
+func (c *ArchiveContext) Patch() error {
+	return c.patchHelper.Patch(context.TODO(), c.SakuraCloudArchive)
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"sigs.k8s.io/cluster-api/util/patch"
 
@@ -31,6 +32,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
 
 	clusterv1errors "sigs.k8s.io/cluster-api/errors"
@@ -134,6 +136,40 @@ func (c *ClusterContext) Zone() string {
 	return c.SakuraCloudCluster.Spec.Zone
 }
 
+// Zones returns the names of all zones used by the cluster.
+func (c *ClusterContext) Zones() []string {
+	zones := []string{c.SakuraCloudCluster.Spec.Zone}
+	for _, zone := range c.SakuraCloudCluster.Spec.Zones {
+		if !containsZone(zones, zone) {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// HasZone returns true if the zone is used by the cluster.
+func (c *ClusterContext) HasZone(zone string) bool {
+	return containsZone(c.Zones(), zone)
+}
+
+// ShutdownTimeout returns how long to wait for the servers of the cluster to shut down via ACPI
+// before powering them off forcibly.
+func (c *ClusterContext) ShutdownTimeout() time.Duration {
+	if c.SakuraCloudCluster.Spec.ShutdownTimeout != nil {
+		return c.SakuraCloudCluster.Spec.ShutdownTimeout.Duration
+	}
+	return config.DefaultShutdownTimeout
+}
+
+func containsZone(zones []string, zone string) bool {
+	for _, z := range zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
 // SetClusterError sets error details
 func (c *ClusterContext) SetClusterError(reason clusterv1errors.ClusterStatusError, msg string) {
 	c.SakuraCloudCluster.Status.ErrorReason = &reason
@@ -19,10 +19,12 @@ package context
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"sigs.k8s.io/cluster-api/util/patch"
 
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
 
 	"github.com/pkg/errors"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -101,11 +103,33 @@ func (c *MachineContext) GetObject() runtime.Object {
 	return c.Machine
 }
 
-// Zone returns the name of target zone.
+// Zone returns the name of the zone in which the server is created.
 func (c *MachineContext) Zone() string {
+	if c.SakuraCloudMachine.Spec.Zone != nil {
+		return *c.SakuraCloudMachine.Spec.Zone
+	}
 	return c.SakuraCloudCluster.Spec.Zone
 }
 
+// ShutdownTimeout returns how long to wait for the server to shut down via ACPI before powering it off forcibly.
+func (c *MachineContext) ShutdownTimeout() time.Duration {
+	if c.SakuraCloudMachine.Spec.ShutdownTimeout != nil {
+		return c.SakuraCloudMachine.Spec.ShutdownTimeout.Duration
+	}
+	return c.ClusterContext.ShutdownTimeout()
+}
+
+// BackupSpec returns the backup schedule of the machine, or nil if the disks aren't backed up.
+func (c *MachineContext) BackupSpec() *infrav1.BackupSpec {
+	if c.SakuraCloudMachine.Spec.Backup != nil {
+		return c.SakuraCloudMachine.Spec.Backup
+	}
+	if util.IsControlPlaneMachine(c.Machine) {
+		return c.SakuraCloudCluster.Spec.ControlPlaneBackup
+	}
+	return nil
+}
+
 // SetMachineError sets error details
 func (c *MachineContext) SetMachineError(reason clusterv1errors.MachineStatusError, msg string) {
 	c.SakuraCloudMachine.Status.ErrorReason = &reason
@@ -16,8 +16,13 @@ limitations under the License.
 package context
 
 import (
+	"context"
+	"strings"
 	"sync"
 
+	"github.com/sacloud/libsacloud/v2/sacloud"
+
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
 )
 
@@ -31,7 +36,70 @@ func getOrCreateSession() (*session.Client, error) {
 		return s.(*session.Client), nil
 	}
 
-	session := session.NewClient()
+	var prices *session.PriceTable
+	if config.PriceTableFile != "" {
+		table, err := session.LoadPriceTable(config.PriceTableFile)
+		if err != nil {
+			return nil, err
+		}
+		prices = table
+	}
+
+	session, err := session.NewClient(&session.ClientOptions{
+		RootURL:         config.APIRootURL,
+		ProxyURL:        config.APIProxyURL,
+		Timeout:         config.APITimeout,
+		RetryMax:        config.APIRetryMax,
+		RetryInterval:   config.APIRetryInterval,
+		RateLimitPerSec: config.APIRateLimitPerSec,
+		AcceptLanguage:  config.APIAcceptLanguage,
+
+		MaxConcurrentProvisions: config.MaxConcurrentProvisions,
+		PriceTable:              prices,
+		Quota: session.ResourceQuota{
+			Servers:  config.QuotaServers,
+			CPUs:     config.QuotaCPUs,
+			MemoryGB: config.QuotaMemoryGB,
+			DiskGB:   config.QuotaDiskGB,
+		},
+		ArchiveSources: session.ArchiveSourceOptions{
+			ImageDir:   config.ArchiveImageDir,
+			URLSchemes: splitList(config.ArchiveSourceURLSchemes),
+			URLHosts:   splitList(config.ArchiveSourceHosts),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
 	sessionCache.Store(sessionKey, session)
 	return session, nil
 }
+
+// splitList splits the comma-separated list of the flag value
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// SubscribeJobs returns a channel receiving the state transitions of the jobs run by the shared session.
+func SubscribeJobs() (<-chan session.JobEvent, error) {
+	session, err := getOrCreateSession()
+	if err != nil {
+		return nil, err
+	}
+	return session.SubscribeJobs(), nil
+}
+
+// AuthStatus returns the account and the permission of the API key used by the shared session.
+func AuthStatus(ctx context.Context) (*sacloud.AuthStatus, error) {
+	session, err := getOrCreateSession()
+	if err != nil {
+		return nil, err
+	}
+	return session.AuthStatus(ctx)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"math"
+	"sort"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/metrics"
+)
+
+// updateMachineCost estimates the cost of the server in the status and the metrics
+func updateMachineCost(ctx *context.MachineContext, sv *sacloud.Server) {
+	var isoImage *sacloud.CDROM
+	if !sv.CDROMID.IsEmpty() {
+		image, err := ctx.Session.ReadISOImage(ctx, ctx.Zone(), sv.CDROMID)
+		if err != nil {
+			// the cost is estimated with the size of the ISO images created for the servers
+			ctx.Logger.V(6).Info("failed to read the ISO image of the server", "iso-image", sv.CDROMID, "error", err.Error())
+		}
+		isoImage = image
+	}
+
+	machine := ctx.SakuraCloudMachine
+	machine.Status.EstimatedCost = costEstimate(ctx.Session.EstimateServerCost(sv, isoImage))
+	metrics.SetEstimatedCost("SakuraCloudMachine", machine.Namespace, machine.Name,
+		machine.Status.EstimatedCost.Hourly, machine.Status.EstimatedCost.Monthly)
+}
+
+// clearMachineCost removes the cost of the deleted server
+func clearMachineCost(ctx *context.MachineContext) {
+	machine := ctx.SakuraCloudMachine
+	machine.Status.EstimatedCost = nil
+	metrics.DeleteEstimatedCost("SakuraCloudMachine", machine.Namespace, machine.Name)
+}
+
+// updateClusterCost estimates the cost of the resources owned by the cluster in the status and the metrics
+func updateClusterCost(ctx *context.ClusterContext, resources map[string]*session.ClusterResources) {
+	cost := session.Cost{}
+	for _, r := range resources {
+		cost.Merge(ctx.Session.EstimateResourcesCost(r))
+	}
+
+	cluster := ctx.SakuraCloudCluster
+	cluster.Status.EstimatedCost = costEstimate(cost)
+	metrics.SetEstimatedCost("SakuraCloudCluster", cluster.Namespace, cluster.Name,
+		cluster.Status.EstimatedCost.Hourly, cluster.Status.EstimatedCost.Monthly)
+}
+
+// clearClusterCost removes the cost of the deleted cluster
+func clearClusterCost(ctx *context.ClusterContext) {
+	cluster := ctx.SakuraCloudCluster
+	cluster.Status.EstimatedCost = nil
+	metrics.DeleteEstimatedCost("SakuraCloudCluster", cluster.Namespace, cluster.Name)
+}
+
+// costEstimate rounds the cost to JPY, omitting the resources which cost nothing
+func costEstimate(cost session.Cost) *infrav1.CostEstimate {
+	total := cost.Total()
+	estimate := &infrav1.CostEstimate{
+		Hourly:  roundJPY(total.Hourly),
+		Monthly: roundJPY(total.Monthly),
+	}
+	for costType, price := range cost {
+		if price.Hourly == 0 && price.Monthly == 0 {
+			continue
+		}
+		estimate.Items = append(estimate.Items, infrav1.CostEstimateItem{
+			Type:    costType,
+			Hourly:  roundJPY(price.Hourly),
+			Monthly: roundJPY(price.Monthly),
+		})
+	}
+	sort.Slice(estimate.Items, func(i, j int) bool {
+		return estimate.Items[i].Type < estimate.Items[j].Type
+	})
+	return estimate
+}
+
+func roundJPY(v float64) int {
+	return int(math.Round(v))
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterutilv1 "sigs.k8s.io/cluster-api/util"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/record"
+)
+
+// the reasons of the CredentialsValid condition and the PreflightPassed condition
+const (
+	reasonInsufficientPermission = "InsufficientPermission"
+	reasonZoneAccessDenied       = "ZoneAccessDenied"
+)
+
+// CheckCredentials records the account and the permission of the API key in the status,
+// and sets the CredentialsValid condition.
+// The recorded result is reused until the credentials check interval passes or the zones of the cluster change.
+func (s *SakuraCloudService) CheckCredentials(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error) {
+	cluster := ctx.SakuraCloudCluster
+	if credentialsChecked(cluster, ctx.Zones(), time.Now()) {
+		return cluster, nil
+	}
+
+	authStatus, err := ctx.Session.AuthStatus(ctx)
+	if err != nil {
+		return cluster, err
+	}
+	credentials := &infrav1.CredentialsStatus{
+		AccountID:     authStatus.AccountID.String(),
+		AccountName:   authStatus.AccountName,
+		AccountCode:   authStatus.AccountCode,
+		Permission:    string(authStatus.Permission),
+		LastCheckTime: &metav1.Time{Time: time.Now()},
+	}
+	for _, zone := range ctx.Zones() {
+		if err := ctx.Session.CheckZoneAccess(ctx, zone); err != nil {
+			if !session.IsAccessDeniedError(err) {
+				return cluster, err
+			}
+			credentials.DeniedZones = append(credentials.DeniedZones, zone)
+			continue
+		}
+		credentials.Zones = append(credentials.Zones, zone)
+	}
+	cluster.Status.Credentials = credentials
+
+	reason, msg := "", ""
+	switch {
+	case !session.CanProvision(authStatus.Permission):
+		reason = reasonInsufficientPermission
+		msg = fmt.Sprintf("API key with %q permission is not allowed to create resources", authStatus.Permission)
+	case len(credentials.DeniedZones) > 0:
+		reason = reasonZoneAccessDenied
+		msg = fmt.Sprintf("API key is not allowed to access zones %s", strings.Join(credentials.DeniedZones, ","))
+	}
+
+	if reason == "" {
+		cluster.Status.Conditions = util.SetCondition(cluster.Status.Conditions, infrav1.ConditionTypeCredentialsValid,
+			corev1.ConditionTrue, "CredentialsValid", "")
+		return cluster, nil
+	}
+	if condition := util.GetCondition(cluster.Status.Conditions, infrav1.ConditionTypeCredentialsValid); condition == nil ||
+		condition.Status != corev1.ConditionFalse || condition.Reason != reason {
+		record.Warnf(cluster, reason, "SakuraCloud resources can't be created: %s", msg)
+	}
+	cluster.Status.Conditions = util.SetCondition(cluster.Status.Conditions, infrav1.ConditionTypeCredentialsValid,
+		corev1.ConditionFalse, reason, msg)
+	return cluster, nil
+}
+
+// checkMachineCredentials returns false with the reason if the API key isn't allowed to create the server.
+// The result recorded in the status of the cluster is used unless it is outdated or doesn't include the zone of the machine.
+func checkMachineCredentials(ctx *context.MachineContext) (bool, string, string, error) {
+	zone := ctx.Zone()
+	if credentials := ctx.SakuraCloudCluster.Status.Credentials; credentialsChecked(ctx.SakuraCloudCluster, []string{zone}, time.Now()) {
+		ok, reason, msg := machineCredentialsResult(sacloudtypes.EPermission(credentials.Permission),
+			!clusterutilv1.Contains(credentials.DeniedZones, zone), zone)
+		return ok, reason, msg, nil
+	}
+
+	authStatus, err := ctx.Session.AuthStatus(ctx)
+	if err != nil {
+		return false, "", "", err
+	}
+	if !session.CanProvision(authStatus.Permission) {
+		ok, reason, msg := machineCredentialsResult(authStatus.Permission, true, zone)
+		return ok, reason, msg, nil
+	}
+	if err := ctx.Session.CheckZoneAccess(ctx, zone); err != nil {
+		if !session.IsAccessDeniedError(err) {
+			return false, "", "", err
+		}
+		ok, reason, msg := machineCredentialsResult(authStatus.Permission, false, zone)
+		return ok, reason, msg, nil
+	}
+	return true, "", "", nil
+}
+
+// machineCredentialsResult returns false with the reason if the permission or the zone access doesn't allow to create the server
+func machineCredentialsResult(permission sacloudtypes.EPermission, zoneAllowed bool, zone string) (bool, string, string) {
+	if !session.CanProvision(permission) {
+		return false, reasonInsufficientPermission,
+			fmt.Sprintf("API key with %q permission is not allowed to create servers", permission)
+	}
+	if !zoneAllowed {
+		return false, reasonZoneAccessDenied, fmt.Sprintf("API key is not allowed to access zone %q", zone)
+	}
+	return true, "", ""
+}
+
+// credentialsChecked returns true if the status of the cluster has the result of the credentials check
+// which is newer than the check interval and includes all the zones
+func credentialsChecked(cluster *infrav1.SakuraCloudCluster, zones []string, now time.Time) bool {
+	credentials := cluster.Status.Credentials
+	if credentials == nil || credentials.LastCheckTime == nil ||
+		util.GetCondition(cluster.Status.Conditions, infrav1.ConditionTypeCredentialsValid) == nil {
+		return false
+	}
+	if now.Sub(credentials.LastCheckTime.Time) >= config.CredentialsCheckInterval {
+		return false
+	}
+	for _, zone := range zones {
+		if !clusterutilv1.Contains(credentials.Zones, zone) && !clusterutilv1.Contains(credentials.DeniedZones, zone) {
+			return false
+		}
+	}
+	return true
+}
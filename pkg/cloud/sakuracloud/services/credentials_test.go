@@ -0,0 +1,98 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/config"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
+)
+
+func TestCheckCredentials(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	client, zone := newFakeSession(g)
+	authOp := &countingAuthStatusOp{AuthStatusAPI: fake.NewAuthStatusOp()}
+	sacloud.SetClientFactoryFunc(fake.ResourceAuthStatus, func(sacloud.APICaller) interface{} {
+		return authOp
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceAuthStatus, func(sacloud.APICaller) interface{} {
+		return fake.NewAuthStatusOp()
+	})
+
+	// the result of the check is recorded in the status
+	ctx := newFakeMachineContext(g, client, zone)
+	cluster, err := (&SakuraCloudService{}).CheckCredentials(ctx.ClusterContext)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(authOp.calls).To(gomega.Equal(1))
+	g.Expect(cluster.Status.Credentials.Zones).To(gomega.Equal([]string{zone}))
+	g.Expect(cluster.Status.Credentials.LastCheckTime).NotTo(gomega.BeNil())
+	g.Expect(util.GetCondition(cluster.Status.Conditions, infrav1.ConditionTypeCredentialsValid).Status).To(gomega.Equal(corev1.ConditionTrue))
+
+	// the recorded result is reused by the cluster and its machines
+	_, err = (&SakuraCloudService{}).CheckCredentials(ctx.ClusterContext)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	ok, _, _, err := checkMachineCredentials(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(authOp.calls).To(gomega.Equal(1))
+
+	// the recorded result is denied for the machine
+	cluster.Status.Credentials.Permission = string(sacloudtypes.Permissions.View)
+	ok, reason, _, err := checkMachineCredentials(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ok).To(gomega.BeFalse())
+	g.Expect(reason).To(gomega.Equal(reasonInsufficientPermission))
+	g.Expect(authOp.calls).To(gomega.Equal(1))
+
+	// the API key is checked again after the interval
+	cluster.Status.Credentials.LastCheckTime = &metav1.Time{Time: time.Now().Add(-config.CredentialsCheckInterval)}
+	_, err = (&SakuraCloudService{}).CheckCredentials(ctx.ClusterContext)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(authOp.calls).To(gomega.Equal(2))
+	g.Expect(cluster.Status.Credentials.Permission).To(gomega.BeEquivalentTo(sacloudtypes.Permissions.Create))
+
+	// the machine in the zone which isn't checked for the cluster checks the API key by itself
+	otherZone := zone + "-other"
+	ctx.SakuraCloudMachine.Spec.Zone = &otherZone
+	ok, _, _, err = checkMachineCredentials(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(authOp.calls).To(gomega.Equal(3))
+}
+
+// countingAuthStatusOp counts the requests reading the auth status
+type countingAuthStatusOp struct {
+	sacloud.AuthStatusAPI
+	calls int
+}
+
+func (o *countingAuthStatusOp) Read(ctx context.Context) (*sacloud.AuthStatus, error) {
+	o.calls++
+	return o.AuthStatusAPI.Read(ctx)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/record"
+)
+
+// dnsRecordName returns the name of the records relative to the DNS zone
+func dnsRecordName(spec *infrav1.DNSSpec, clusterName, host string) string {
+	subdomain := spec.Subdomain
+	if subdomain == "" {
+		subdomain = clusterName
+	}
+	return strings.ToLower(host + "." + subdomain)
+}
+
+// dnsRecordOwner returns the owner of the records of the cluster marked in the DNS zone
+func dnsRecordOwner(ctx *context.ClusterContext) string {
+	return ctx.Cluster.Namespace + "/" + ctx.Cluster.Name
+}
+
+// ReconcileAPIEndpointRecord points the DNS records of the API endpoint to the addresses of the control-plane machines
+func (s *SakuraCloudService) ReconcileAPIEndpointRecord(ctx *context.ClusterContext, addresses []string) (*infrav1.SakuraCloudCluster, error) {
+	cluster := ctx.SakuraCloudCluster
+	spec := cluster.Spec.DNS
+	if spec == nil {
+		return cluster, nil
+	}
+	if len(addresses) == 0 {
+		// keep the records while the control-plane machines are replaced
+		return cluster, nil
+	}
+
+	ref := &infrav1.DNSRecordReference{Zone: spec.Zone, Name: dnsRecordName(spec, ctx.Cluster.Name, "api")}
+	current := cluster.Status.APIEndpointRecord
+	if err := ctx.Session.ReconcileDNSRecords(ctx, &session.DNSRecordParameter{
+		Zone:  ref.Zone,
+		Name:  ref.Name,
+		Owner: dnsRecordOwner(ctx),
+		// the records in the status were created by this cluster
+		Adopt:     current != nil && *current == *ref,
+		Addresses: addresses,
+		TTL:       spec.TTL,
+	}); err != nil {
+		if session.IsDNSRecordConflictError(err) {
+			record.Warnf(cluster, "APIEndpointRecordConflict", "DNS record %s of the API endpoint is used by others", ref.FQDN())
+		}
+		return cluster, err
+	}
+
+	if current == nil || *current != *ref {
+		if current != nil {
+			// the DNS spec was changed
+			if err := ctx.Session.DeleteDNSRecords(ctx, current.Zone, current.Name, dnsRecordOwner(ctx)); err != nil {
+				return cluster, err
+			}
+		}
+		cluster.Status.APIEndpointRecord = ref
+		record.Eventf(cluster, "APIEndpointRecordCreated", "DNS record %s of the API endpoint is created", ref.FQDN())
+	}
+	return cluster, nil
+}
+
+// deleteAPIEndpointRecord deletes the DNS records of the API endpoint
+func deleteAPIEndpointRecord(ctx *context.ClusterContext) error {
+	ref := ctx.SakuraCloudCluster.Status.APIEndpointRecord
+	if ref == nil {
+		return nil
+	}
+	if err := ctx.Session.DeleteDNSRecords(ctx, ref.Zone, ref.Name, dnsRecordOwner(ctx)); err != nil {
+		return err
+	}
+	ctx.SakuraCloudCluster.Status.APIEndpointRecord = nil
+	record.Eventf(ctx.SakuraCloudCluster, "APIEndpointRecordDeleted", "DNS record %s of the API endpoint is deleted", ref.FQDN())
+	return nil
+}
+
+// reconcileNodeRecord creates the DNS record of the node.
+// The record isn't updated after that because the addresses of the servers don't change.
+func reconcileNodeRecord(ctx *context.MachineContext) error {
+	machine := ctx.SakuraCloudMachine
+	spec := ctx.SakuraCloudCluster.Spec.DNS
+	if spec == nil || !spec.NodeRecords || machine.Status.DNSRecord != nil {
+		return nil
+	}
+
+	var addresses []string
+	for _, address := range machine.Status.Addresses {
+		if address.Type == corev1.NodeExternalIP {
+			addresses = append(addresses, address.Address)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	ref := &infrav1.DNSRecordReference{Zone: spec.Zone, Name: dnsRecordName(spec, ctx.Cluster.Name, ctx.Machine.Name)}
+	if err := ctx.Session.ReconcileDNSRecords(ctx, &session.DNSRecordParameter{
+		Zone:      ref.Zone,
+		Name:      ref.Name,
+		Owner:     dnsRecordOwner(ctx.ClusterContext),
+		Addresses: addresses,
+		TTL:       spec.TTL,
+	}); err != nil {
+		if session.IsDNSRecordConflictError(err) {
+			record.Warnf(machine, "NodeRecordConflict", "DNS record %s of the node is used by others", ref.FQDN())
+		}
+		return err
+	}
+	machine.Status.DNSRecord = ref
+	record.Eventf(machine, "NodeRecordCreated", "DNS record %s of the node is created", ref.FQDN())
+	return nil
+}
+
+// deleteNodeRecord deletes the DNS record of the node
+func deleteNodeRecord(ctx *context.MachineContext) error {
+	machine := ctx.SakuraCloudMachine
+	ref := machine.Status.DNSRecord
+	if ref == nil {
+		return nil
+	}
+	if err := ctx.Session.DeleteDNSRecords(ctx, ref.Zone, ref.Name, dnsRecordOwner(ctx.ClusterContext)); err != nil {
+		return err
+	}
+	machine.Status.DNSRecord = nil
+	record.Eventf(machine, "NodeRecordDeleted", "DNS record %s of the node is deleted", ref.FQDN())
+	return nil
+}
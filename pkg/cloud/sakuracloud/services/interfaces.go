@@ -26,4 +26,32 @@ type SakuraCloudMachineInterface interface {
 
 	// DestroyVM powers off and removes a VM from the inventory
 	DestroyServer(ctx *context.MachineContext) (*infrav1.SakuraCloudMachine, error)
+
+	// RefreshServer reflects the live server record in the status without changing the server
+	RefreshServer(ctx *context.MachineContext) (*infrav1.SakuraCloudMachine, error)
+}
+
+type SakuraCloudClusterInterface interface {
+	// ReconcileCluster reconciles the SakuraCloud resources shared by the cluster's servers
+	ReconcileCluster(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error)
+
+	// DestroyCluster removes all SakuraCloud resources owned by the cluster
+	DestroyCluster(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error)
+
+	// ReconcileAPIEndpointRecord points the DNS records of the API endpoint to the control-plane machines
+	ReconcileAPIEndpointRecord(ctx *context.ClusterContext, addresses []string) (*infrav1.SakuraCloudCluster, error)
+
+	// CheckCredentials records the account and the permission of the API key in the status
+	CheckCredentials(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error)
+
+	// RefreshInventory summarizes the SakuraCloud resources owned by the cluster and their cost in the status
+	RefreshInventory(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error)
+}
+
+type SakuraCloudArchiveInterface interface {
+	// ReconcileArchive uploads the image and makes the archive available in all zones
+	ReconcileArchive(ctx *context.ArchiveContext) (*infrav1.SakuraCloudArchive, error)
+
+	// DestroyArchive removes the archives from all zones
+	DestroyArchive(ctx *context.ArchiveContext) (*infrav1.SakuraCloudArchive, error)
 }
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"sort"
+
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+)
+
+const (
+	roleControlPlane = "control-plane"
+	roleWorker       = "worker"
+)
+
+// RefreshInventory reads the SakuraCloud resources owned by the cluster in all zones, and summarizes them
+// and their estimated cost in the status
+func (s *SakuraCloudService) RefreshInventory(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error) {
+	resources := make(map[string]*session.ClusterResources)
+	for _, zone := range ctx.Zones() {
+		r, err := ctx.Session.FindClusterResources(ctx, zone, ctx.Cluster.Name, ctx.Cluster.Namespace)
+		if err != nil {
+			return ctx.SakuraCloudCluster, err
+		}
+		resources[zone] = r
+	}
+
+	inventory := buildInventory(resources)
+	inventory.LastChanged = metav1.Now()
+	if current := ctx.SakuraCloudCluster.Status.Inventory; current != nil {
+		// keep the timestamp so that the status is patched only when the resources change
+		inventory.LastChanged = current.LastChanged
+		if !equality.Semantic.DeepEqual(current, inventory) {
+			inventory.LastChanged = metav1.Now()
+		}
+	}
+	ctx.SakuraCloudCluster.Status.Inventory = inventory
+	updateClusterCost(ctx, resources)
+	return ctx.SakuraCloudCluster, nil
+}
+
+// buildInventory summarizes the resources keyed by zone
+func buildInventory(resources map[string]*session.ClusterResources) *infrav1.ClusterInventory {
+	inventory := &infrav1.ClusterInventory{}
+	counts := make(map[infrav1.InventoryServerCount]int)
+
+	for zone, r := range resources {
+		for _, sv := range r.Servers {
+			role := roleWorker
+			if hasTag(sv.Tags, "control-plane=true") {
+				role = roleControlPlane
+			}
+			inventory.Servers = append(inventory.Servers, infrav1.InventoryServer{
+				ID:             sv.ID.String(),
+				Name:           sv.Name,
+				Zone:           zone,
+				Role:           role,
+				InstanceStatus: string(sv.InstanceStatus),
+				CPUs:           sv.CPU,
+				MemoryGB:       sv.MemoryMB / 1024,
+			})
+			counts[infrav1.InventoryServerCount{Role: role, InstanceStatus: string(sv.InstanceStatus)}]++
+			inventory.TotalCPUs += sv.CPU
+			inventory.TotalMemoryGB += sv.MemoryMB / 1024
+		}
+		for _, disk := range r.Disks {
+			inventory.Disks = append(inventory.Disks, infrav1.InventoryResource{
+				Type:     "disk",
+				ID:       disk.ID.String(),
+				Name:     disk.Name,
+				Zone:     zone,
+				SizeGB:   disk.SizeMB / 1024,
+				ServerID: disk.ServerID.String(),
+			})
+			inventory.TotalDiskGB += disk.SizeMB / 1024
+		}
+		for _, isoImage := range r.ISOImages {
+			inventory.ISOImages = append(inventory.ISOImages, infrav1.InventoryResource{
+				Type: "isoImage",
+				ID:   isoImage.ID.String(),
+				Name: isoImage.Name,
+				Zone: zone,
+			})
+		}
+		for _, sw := range r.Switches {
+			inventory.Appliances = append(inventory.Appliances, infrav1.InventoryResource{
+				Type: "switch",
+				ID:   sw.ID.String(),
+				Name: sw.Name,
+				Zone: zone,
+			})
+		}
+		for _, lb := range r.LoadBalancers {
+			inventory.Appliances = append(inventory.Appliances, infrav1.InventoryResource{
+				Type: "loadBalancer",
+				ID:   lb.ID.String(),
+				Name: lb.Name,
+				Zone: zone,
+			})
+		}
+		for _, pf := range r.PacketFilters {
+			inventory.Appliances = append(inventory.Appliances, infrav1.InventoryResource{
+				Type: "packetFilter",
+				ID:   pf.ID.String(),
+				Name: pf.Name,
+				Zone: zone,
+			})
+		}
+		for _, archive := range r.Archives {
+			inventory.Archives = append(inventory.Archives, infrav1.InventoryResource{
+				Type:   "archive",
+				ID:     archive.ID.String(),
+				Name:   archive.Name,
+				Zone:   zone,
+				SizeGB: archive.SizeMB / 1024,
+			})
+		}
+	}
+
+	for count, n := range counts {
+		count.Count = n
+		inventory.ServerCounts = append(inventory.ServerCounts, count)
+	}
+
+	// keep the order stable to compare with the previous inventory
+	sort.Slice(inventory.Servers, func(i, j int) bool {
+		return inventory.Servers[i].Zone+"/"+inventory.Servers[i].Name < inventory.Servers[j].Zone+"/"+inventory.Servers[j].Name
+	})
+	sort.Slice(inventory.ServerCounts, func(i, j int) bool {
+		a, b := inventory.ServerCounts[i], inventory.ServerCounts[j]
+		return a.Role+"/"+a.InstanceStatus < b.Role+"/"+b.InstanceStatus
+	})
+	for _, items := range [][]infrav1.InventoryResource{inventory.Disks, inventory.ISOImages, inventory.Appliances, inventory.Archives} {
+		sortInventoryResources(items)
+	}
+	return inventory
+}
+
+func sortInventoryResources(items []infrav1.InventoryResource) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Zone != items[j].Zone {
+			return items[i].Zone < items[j].Zone
+		}
+		if items[i].Type != items[j].Type {
+			return items[i].Type < items[j].Type
+		}
+		return items[i].Name < items[j].Name
+	})
+}
+
+func hasTag(tags sacloudtypes.Tags, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+)
+
+func TestBuildInventory(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	inventory := buildInventory(map[string]*session.ClusterResources{
+		"tk1a": {
+			Servers: []*sacloud.Server{
+				{ID: 3, Name: "caps-example-md-0-b", CPU: 2, MemoryMB: 2048, InstanceStatus: sacloudtypes.ServerInstanceStatuses.Up},
+			},
+			Disks: []*sacloud.Disk{
+				{ID: 13, Name: "caps-example-md-0-b", SizeMB: 20 * 1024, ServerID: 3},
+			},
+		},
+		"is1a": {
+			Servers: []*sacloud.Server{
+				{ID: 2, Name: "caps-example-md-0-a", CPU: 2, MemoryMB: 2048, InstanceStatus: sacloudtypes.ServerInstanceStatuses.Up},
+				{ID: 1, Name: "caps-example-controlplane-0", CPU: 2, MemoryMB: 4096, InstanceStatus: sacloudtypes.ServerInstanceStatuses.Up,
+					Tags: sacloudtypes.Tags{"control-plane=true"}},
+			},
+			Disks: []*sacloud.Disk{
+				{ID: 11, Name: "caps-example-controlplane-0", SizeMB: 20 * 1024, ServerID: 1},
+				{ID: 12, Name: "caps-example-md-0-a", SizeMB: 40 * 1024, ServerID: 2},
+			},
+			PacketFilters: []*sacloud.PacketFilter{
+				{ID: 21, Name: "caps-example"},
+			},
+		},
+	})
+
+	g.Expect(inventory.Servers).To(gomega.HaveLen(3))
+	g.Expect(inventory.Servers[0].Name).To(gomega.Equal("caps-example-controlplane-0"))
+	g.Expect(inventory.Servers[0].Role).To(gomega.Equal("control-plane"))
+	g.Expect(inventory.Servers[2].Zone).To(gomega.Equal("tk1a"))
+	g.Expect(inventory.ServerCounts).To(gomega.Equal([]infrav1.InventoryServerCount{
+		{Role: "control-plane", InstanceStatus: "up", Count: 1},
+		{Role: "worker", InstanceStatus: "up", Count: 2},
+	}))
+	g.Expect(inventory.Disks).To(gomega.HaveLen(3))
+	g.Expect(inventory.Disks[0].ServerID).To(gomega.Equal("1"))
+	g.Expect(inventory.Appliances).To(gomega.Equal([]infrav1.InventoryResource{
+		{Type: "packetFilter", ID: "21", Name: "caps-example", Zone: "is1a"},
+	}))
+	g.Expect(inventory.TotalCPUs).To(gomega.Equal(6))
+	g.Expect(inventory.TotalMemoryGB).To(gomega.Equal(8))
+	g.Expect(inventory.TotalDiskGB).To(gomega.Equal(80))
+}
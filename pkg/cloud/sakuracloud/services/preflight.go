@@ -0,0 +1,128 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	clusterv1errors "sigs.k8s.io/cluster-api/errors"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/record"
+)
+
+// the reasons of the PreflightPassed condition
+const (
+	reasonServerPlanUnavailable = "ServerPlanUnavailable"
+	reasonQuotaExceeded         = "QuotaExceeded"
+	reasonInvalidDeletionPolicy = "InvalidDeletionPolicy"
+)
+
+// preflight checks the permission of the API key, the server plan and the account quota before provisioning the server.
+// It returns false if the server can't be provisioned now.
+func (s *SakuraCloudService) preflight(ctx *context.MachineContext) (bool, error) {
+	machine := ctx.SakuraCloudMachine
+
+	// the server waits until the API key is replaced
+	ok, reason, msg, err := checkMachineCredentials(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to check credentials")
+	}
+	if !ok {
+		setPreflightFailed(ctx, reason, msg)
+		return false, nil
+	}
+
+	// a misspelled disk name would make the deletion policy delete the disk
+	if err := validateDeletionPolicyDisks(&machine.Spec); err != nil {
+		setPreflightFailed(ctx, reasonInvalidDeletionPolicy, err.Error())
+		ctx.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, err.Error())
+		return false, nil
+	}
+
+	// validate the server plan against the plans available in the zone
+	if machine.Status.ServerPlan == nil {
+		plan, err := ctx.Session.FindServerPlan(ctx, ctx.Zone(), &machine.Spec)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to find server plan")
+		}
+		if plan == nil {
+			msg := fmt.Sprintf("server plan(cpus: %d, memoryGB: %d, commitment: %q, generation: %d) is not available in zone %q",
+				machine.Spec.CPUs, machine.Spec.MemoryGB, machine.Spec.Commitment, machine.Spec.Generation, ctx.Zone())
+			setPreflightFailed(ctx, reasonServerPlanUnavailable, msg)
+			ctx.SetMachineError(clusterv1errors.InvalidConfigurationMachineError, msg)
+			return false, nil
+		}
+		machine.Status.ServerPlan = &infrav1.ServerPlanInfo{
+			ID:         plan.ID.String(),
+			Name:       plan.Name,
+			CPUs:       plan.CPU,
+			MemoryGB:   plan.MemoryMB / 1024,
+			Commitment: infrav1.Commitment(plan.Commitment),
+			Generation: int(plan.Generation),
+		}
+	}
+
+	// the server waits until the resources are freed, e.g. by deleting other machines.
+	// The resources are reserved for the server until it's built
+	if err := ctx.Session.ReserveQuota(ctx, ctx.Zone(), ctx.Cluster.Name, ctx.Cluster.Namespace, ctx.Machine.Name, &machine.Spec); err != nil {
+		if session.IsQuotaExceededError(err) {
+			setPreflightFailed(ctx, reasonQuotaExceeded, err.Error())
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to check quota")
+	}
+
+	machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePreflightPassed,
+		corev1.ConditionTrue, "PreflightPassed", "")
+	return true, nil
+}
+
+// setPreflightFailed sets the PreflightPassed condition, and records an event when the condition changes
+func setPreflightFailed(ctx *context.MachineContext, reason, msg string) {
+	machine := ctx.SakuraCloudMachine
+	if condition := util.GetCondition(machine.Status.Conditions, infrav1.ConditionTypePreflightPassed); condition == nil ||
+		condition.Status != corev1.ConditionFalse || condition.Reason != reason {
+		record.Warnf(machine, reason, "server can't be provisioned: %s", msg)
+	}
+	machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePreflightPassed,
+		corev1.ConditionFalse, reason, msg)
+}
+
+// validateDeletionPolicyDisks returns an error if DeletionPolicyDisks has names other than boot and the additional disks
+func validateDeletionPolicyDisks(spec *infrav1.SakuraCloudMachineSpec) error {
+	names := map[string]bool{infrav1.BootDiskName: true}
+	for _, disk := range spec.AdditionalDisks {
+		names[disk.Name] = true
+	}
+	var unknown []string
+	for _, name := range spec.DeletionPolicyDisks {
+		if !names[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return errors.Errorf("unknown disks in deletionPolicyDisks: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
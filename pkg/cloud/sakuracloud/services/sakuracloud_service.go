@@ -16,15 +16,26 @@ limitations under the License.
 package services
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
 
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/constants"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/record"
+	"github.com/sacloud/libsacloud/v2/sacloud"
 	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
 	"sigs.k8s.io/cluster-api/errors"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // SakuraCloudService is a service for creating/updating/deleting virtual
@@ -36,12 +47,27 @@ func (s *SakuraCloudService) ReconcileServer(ctx *context.MachineContext) (*infr
 	// TODO Updateの考慮
 
 	if ctx.SakuraCloudMachine.Status.State == infrav1.InstanceStateReady {
-		return ctx.SakuraCloudMachine, nil
+		if _, err := s.reconcilePowerState(ctx); err != nil {
+			return ctx.SakuraCloudMachine, err
+		}
+		// the failure of the node record(e.g. the DNS zone is missing) doesn't stop the backup
+		nodeRecordErr := reconcileNodeRecord(ctx)
+		if err := s.reconcileBackup(ctx); err != nil {
+			return ctx.SakuraCloudMachine, err
+		}
+		return ctx.SakuraCloudMachine, nodeRecordErr
 	}
 
 	// If there is no pending task or no machine ref then no VM exits, create one
 	if ctx.SakuraCloudMachine.Status.State == infrav1.InstanceStatePending && ctx.SakuraCloudMachine.Status.JobRef == "" {
+		if ok, err := s.preflight(ctx); err != nil || !ok {
+			return ctx.SakuraCloudMachine, err
+		}
 
+		var planGeneration int
+		if ctx.SakuraCloudMachine.Status.ServerPlan != nil {
+			planGeneration = ctx.SakuraCloudMachine.Status.ServerPlan.Generation
+		}
 		jobID := ctx.Session.Provision(ctx, ctx.Zone(), &session.ServerBuildParameter{
 			ServerName:      ctx.Machine.Name,
 			ClusterName:     ctx.Cluster.Name,
@@ -49,6 +75,8 @@ func (s *SakuraCloudService) ReconcileServer(ctx *context.MachineContext) (*infr
 			IsControlPlane:  util.IsControlPlaneMachine(ctx.Machine),
 			SourceArchiveID: ctx.SakuraCloudMachine.Status.SourceArchive.ID,
 			BootstrapData:   *ctx.Machine.Spec.Bootstrap.Data,
+			PacketFilterID:  ctx.SakuraCloudCluster.Status.PacketFilterIDs[ctx.Zone()],
+			PlanGeneration:  planGeneration,
 			Spec:            ctx.SakuraCloudMachine.Spec,
 		})
 		ctx.SakuraCloudMachine.Status.JobRef = string(jobID)
@@ -61,14 +89,10 @@ func (s *SakuraCloudService) ReconcileServer(ctx *context.MachineContext) (*infr
 		return ctx.SakuraCloudMachine, nil // waiting for start
 	}
 
-	if job.Error != nil {
-		ctx.SetMachineError(errors.CreateMachineError, job.Error.Error())
-		return ctx.SakuraCloudMachine, job.Error
-	}
-
 	if job.Type != session.JobTypeProvisioning {
 		return ctx.SakuraCloudMachine, nil
 	}
+	ctx.SakuraCloudMachine.Status.ProvisioningQueuePosition = ctx.Session.ProvisioningQueuePosition(ctx.Zone(), string(job.ID))
 
 	if job.Reference != nil && !job.Reference.ServerID.IsEmpty() {
 		id := job.Reference.ServerID.String()
@@ -81,20 +105,24 @@ func (s *SakuraCloudService) ReconcileServer(ctx *context.MachineContext) (*infr
 			return ctx.SakuraCloudMachine, err
 		}
 
-		// TODO あとで修正
-		ctx.SakuraCloudMachine.Status.Addresses = []corev1.NodeAddress{
-			{
-				Type:    corev1.NodeExternalIP,
-				Address: sv.Interfaces[0].IPAddress,
-			},
-		}
+		ctx.SakuraCloudMachine.Status.Addresses = serverAddresses(sv)
+		updateMachineCost(ctx, sv)
 	}
 
 	switch job.State {
 	case session.JobStatePending, session.JobStateInFlight:
 		return ctx.SakuraCloudMachine, nil
 	case session.JobStateFailed:
-		ctx.SetMachineError(errors.CreateMachineError, job.Error.Error())
+		// retry temporary failures unless the server left by the build couldn't be deleted,
+		// which is adopted by the machine and cleaned up by deleting it
+		if session.IsRetryableError(job.Error) && ctx.SakuraCloudMachine.Spec.MachineRef == nil {
+			ctx.SakuraCloudMachine.Status.JobRef = ""
+			ctx.Session.DeleteJob(string(job.ID))
+			ctx.SakuraCloudMachine.Status.State = infrav1.InstanceStatePending
+			record.Warnf(ctx.SakuraCloudMachine, "ProvisioningRetried", "provisioning server failed temporarily, retrying: %v", job.Error)
+			return ctx.SakuraCloudMachine, job.Error
+		}
+		setMachineError(ctx, errors.CreateMachineError, job.Error)
 		return ctx.SakuraCloudMachine, job.Error
 	case session.JobStateDone:
 		ctx.SakuraCloudMachine.Status.JobRef = ""
@@ -105,24 +133,384 @@ func (s *SakuraCloudService) ReconcileServer(ctx *context.MachineContext) (*infr
 	return ctx.SakuraCloudMachine, nil
 }
 
+// powerOperations is the annotations requesting power operations and the jobs for them, in order of precedence
+var powerOperations = []struct {
+	annotation string
+	jobType    session.JobType
+}{
+	{annotation: constants.ShutdownRequestedAnnotationLabel, jobType: session.JobTypeShuttingDown},
+	{annotation: constants.RebootRequestedAnnotationLabel, jobType: session.JobTypeRebooting},
+	{annotation: constants.BootRequestedAnnotationLabel, jobType: session.JobTypeBooting},
+}
+
+// reasonShutdownRequested is the reason of the PoweredOn condition of servers shut down on purpose
+const reasonShutdownRequested = "ShutdownRequested"
+
+// reconcilePowerState reflects the live server record in the status, and runs the power operations
+// requested by the annotations or the power policy
+func (s *SakuraCloudService) reconcilePowerState(ctx *context.MachineContext) (*infrav1.SakuraCloudMachine, error) {
+	machine := ctx.SakuraCloudMachine
+	if machine.Spec.MachineRef == nil || machine.Spec.MachineRef.ID == nil {
+		return machine, nil
+	}
+
+	if machine.Status.JobRef != "" {
+		if done, err := s.reconcilePowerOperation(ctx); err != nil || !done {
+			return machine, err
+		}
+	}
+
+	sv, err := s.readServer(ctx)
+	if err != nil || sv == nil {
+		return machine, err
+	}
+
+	for _, op := range powerOperations {
+		requestedAt, ok := machine.Annotations[op.annotation]
+		if !ok {
+			continue
+		}
+		machine.Status.JobRef = string(startPowerOperation(ctx, op.jobType, sv.ID))
+		record.Eventf(machine, "PowerOperationRequested", "%s server %s(%s) as requested at %s", op.jobType, sv.Name, sv.ID, requestedAt)
+		return machine, nil
+	}
+
+	if sv.InstanceStatus.IsDown() && machine.Spec.PowerPolicy == infrav1.PowerPolicyAlwaysOn {
+		if condition := util.GetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn); condition != nil && condition.Reason == reasonShutdownRequested {
+			// the power policy doesn't apply to servers shut down on purpose
+			return machine, nil
+		}
+		machine.Status.JobRef = string(ctx.Session.Boot(ctx, ctx.Zone(), sv.ID))
+		machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn,
+			corev1.ConditionFalse, "Booting", "server is booted by the power policy")
+		record.Eventf(machine, "BootingServer", "booting server %s(%s) according to the power policy", sv.Name, sv.ID)
+	}
+	return machine, nil
+}
+
+// RefreshServer reflects the live server record in the status without changing the server
+func (s *SakuraCloudService) RefreshServer(ctx *context.MachineContext) (*infrav1.SakuraCloudMachine, error) {
+	machine := ctx.SakuraCloudMachine
+	if machine.Spec.MachineRef == nil || machine.Spec.MachineRef.ID == nil {
+		return machine, nil
+	}
+	_, err := s.readServer(ctx)
+	return machine, err
+}
+
+// readServer reads the server and updates the power state and the addresses in the status.
+// It returns nil if the server is not found.
+func (s *SakuraCloudService) readServer(ctx *context.MachineContext) (*sacloud.Server, error) {
+	machine := ctx.SakuraCloudMachine
+	serverID := sacloudtypes.StringID(*machine.Spec.MachineRef.ID)
+	sv, err := ctx.Session.Read(ctx, ctx.Zone(), serverID)
+	if err != nil {
+		if sacloud.IsNotFoundError(err) {
+			machine.Status.InstanceStatus = ""
+			machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn,
+				corev1.ConditionUnknown, "ServerNotFound", fmt.Sprintf("server %s is not found", serverID))
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	machine.Status.InstanceStatus = string(sv.InstanceStatus)
+	machine.Status.Addresses = serverAddresses(sv)
+	updateMachineCost(ctx, sv)
+
+	switch {
+	case sv.InstanceStatus.IsUp():
+		machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn,
+			corev1.ConditionTrue, "PoweredOn", "")
+	case sv.InstanceStatus.IsDown():
+		condition := util.GetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn)
+		if condition != nil && condition.Reason == reasonShutdownRequested {
+			break
+		}
+		if condition != nil && condition.Status == corev1.ConditionTrue {
+			record.Warnf(machine, "ServerPoweredOff", "server %s(%s) is powered off", sv.Name, sv.ID)
+		}
+		machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn,
+			corev1.ConditionFalse, "PoweredOff", "")
+	default:
+		// e.g. cleaning, migrating
+		machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn,
+			corev1.ConditionUnknown, "InstanceStatusChanging", fmt.Sprintf("instance status is %q", sv.InstanceStatus))
+	}
+	return sv, nil
+}
+
+// reconcilePowerOperation waits for the power operation referenced by JobRef.
+// It returns true when no operation is in progress.
+func (s *SakuraCloudService) reconcilePowerOperation(ctx *context.MachineContext) (bool, error) {
+	machine := ctx.SakuraCloudMachine
+	job := ctx.Session.JobByID(machine.Status.JobRef)
+	if job == nil || !isPowerOperation(job.Type) {
+		// the job was lost(e.g. controller restarted), the annotation is handled again
+		machine.Status.JobRef = ""
+		return true, nil
+	}
+
+	switch job.State {
+	case session.JobStatePending, session.JobStateInFlight:
+		return false, nil
+	case session.JobStateFailed:
+		machine.Status.JobRef = ""
+		ctx.Session.DeleteJob(string(job.ID))
+		if !session.IsRetryableError(job.Error) {
+			// temporary failures are retried by keeping the annotation
+			clearPowerOperationRequest(machine, job.Type)
+		}
+		record.Warnf(machine, "PowerOperationFailed", "%s server failed: %v", job.Type, job.Error)
+		return false, job.Error
+	case session.JobStateDone:
+		machine.Status.JobRef = ""
+		ctx.Session.DeleteJob(string(job.ID))
+		clearPowerOperationRequest(machine, job.Type)
+		if job.Type == session.JobTypeShuttingDown {
+			machine.Status.Conditions = util.SetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn,
+				corev1.ConditionFalse, reasonShutdownRequested, "server is shut down as requested")
+		}
+		record.Eventf(machine, "PowerOperationCompleted", "%s server completed", job.Type)
+	}
+	return true, nil
+}
+
+func startPowerOperation(ctx *context.MachineContext, jobType session.JobType, serverID sacloudtypes.ID) session.JobID {
+	switch jobType {
+	case session.JobTypeShuttingDown:
+		return ctx.Session.Shutdown(ctx, ctx.Zone(), serverID)
+	case session.JobTypeRebooting:
+		return ctx.Session.Reboot(ctx, ctx.Zone(), serverID)
+	default:
+		return ctx.Session.Boot(ctx, ctx.Zone(), serverID)
+	}
+}
+
+func isPowerOperation(jobType session.JobType) bool {
+	for _, op := range powerOperations {
+		if op.jobType == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// clearPowerOperationRequest removes the annotation requesting the power operation
+func clearPowerOperationRequest(machine *infrav1.SakuraCloudMachine, jobType session.JobType) {
+	for _, op := range powerOperations {
+		if op.jobType == jobType {
+			delete(machine.Annotations, op.annotation)
+		}
+	}
+}
+
+// the range of the delay before retrying failed backups
+const (
+	minBackupRetryDelay = 5 * time.Minute
+	maxBackupRetryDelay = 6 * time.Hour
+)
+
+// reconcileBackup backs up the disks according to the backup schedule, and lists the existing backups in the status
+func (s *SakuraCloudService) reconcileBackup(ctx *context.MachineContext) error {
+	machine := ctx.SakuraCloudMachine
+	if machine.Spec.MachineRef == nil || machine.Spec.MachineRef.ID == nil {
+		return nil
+	}
+
+	if machine.Status.BackupJobRef != "" {
+		job := ctx.Session.JobByID(machine.Status.BackupJobRef)
+		if job == nil {
+			// the job was lost(e.g. controller restarted), back up again
+			machine.Status.BackupJobRef = ""
+			return nil
+		}
+		switch job.State {
+		case session.JobStatePending, session.JobStateInFlight:
+			return nil
+		case session.JobStateFailed:
+			machine.Status.BackupJobRef = ""
+			ctx.Session.DeleteJob(string(job.ID))
+			now := metav1.Now()
+			machine.Status.BackupFailures++
+			machine.Status.LastBackupFailureTime = &now
+			record.Warnf(machine, "BackupFailed", "backing up disks failed, retrying after %s: %v",
+				backupRetryDelay(machine.Status.BackupFailures, ctx.BackupSpec()), job.Error)
+			return job.Error
+		case session.JobStateDone:
+			machine.Status.BackupJobRef = ""
+			ctx.Session.DeleteJob(string(job.ID))
+			now := metav1.Now()
+			machine.Status.LastBackupTime = &now
+			machine.Status.BackupFailures = 0
+			machine.Status.LastBackupFailureTime = nil
+			record.Eventf(machine, "BackupCompleted", "backed up %d disks", len(job.Reference.DiskArchiveIDs))
+		}
+	}
+
+	spec := ctx.BackupSpec()
+	if spec == nil && len(machine.Status.Backups) == 0 {
+		return nil
+	}
+
+	backups, err := ctx.Session.FindBackups(ctx, ctx.Zone(), ctx.Cluster.Name, ctx.Cluster.Namespace, ctx.Machine.Name)
+	if err != nil {
+		return err
+	}
+	machine.Status.Backups = nil
+	for _, backup := range backups {
+		machine.Status.Backups = append(machine.Status.Backups, infrav1.BackupInfo{
+			DiskName:  backup.DiskName,
+			ArchiveID: backup.ID.String(),
+			CreatedAt: metav1.NewTime(backup.CreatedAt),
+		})
+	}
+
+	if spec == nil || spec.Interval.Duration <= 0 {
+		return nil
+	}
+	if machine.Status.LastBackupTime != nil && time.Since(machine.Status.LastBackupTime.Time) < spec.Interval.Duration {
+		return nil
+	}
+	if machine.Status.LastBackupFailureTime != nil &&
+		time.Since(machine.Status.LastBackupFailureTime.Time) < backupRetryDelay(machine.Status.BackupFailures, spec) {
+		return nil
+	}
+	serverID := sacloudtypes.StringID(*machine.Spec.MachineRef.ID)
+	machine.Status.BackupJobRef = string(ctx.Session.Backup(ctx, ctx.Zone(), serverID, &session.ServerBackupParameter{
+		ServerName:  ctx.Machine.Name,
+		ClusterName: ctx.Cluster.Name,
+		NameSpace:   ctx.Cluster.Namespace,
+		Disks:       spec.Disks,
+		Retention:   spec.Retention,
+	}))
+	record.Eventf(machine, "BackingUp", "backing up disks of server %s", serverID)
+	return nil
+}
+
+// backupRetryDelay returns how long to wait before retrying the failed backup.
+// The delay doubles with each consecutive failure up to the backup interval.
+func backupRetryDelay(failures int, spec *infrav1.BackupSpec) time.Duration {
+	delay := minBackupRetryDelay
+	for i := 1; i < failures && delay < maxBackupRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxBackupRetryDelay {
+		delay = maxBackupRetryDelay
+	}
+	if spec != nil && spec.Interval.Duration > 0 && delay > spec.Interval.Duration {
+		delay = spec.Interval.Duration
+	}
+	return delay
+}
+
+// setMachineError sets the status error classified from the error, or fallback if the error has no specific status error
+func setMachineError(ctx *context.MachineContext, fallback errors.MachineStatusError, err error) {
+	ctx.SetMachineError(session.ClassifyError(err).MachineStatusError(fallback), err.Error())
+}
+
+// setClusterError sets the status error classified from the error, or fallback if the error has no specific status error
+func setClusterError(ctx *context.ClusterContext, fallback errors.ClusterStatusError, err error) {
+	ctx.SetClusterError(session.ClassifyError(err).ClusterStatusError(fallback), err.Error())
+}
+
+// serverAddresses returns the addresses of the server's NICs
+func serverAddresses(sv *sacloud.Server) []corev1.NodeAddress {
+	var addresses []corev1.NodeAddress
+	for _, nic := range sv.Interfaces {
+		if nic.IPAddress != "" {
+			addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: nic.IPAddress})
+		}
+		if nic.UserIPAddress != "" {
+			addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: nic.UserIPAddress})
+		}
+	}
+	return addresses
+}
+
+// recordRetainedResources records the disks and archives left by the deletion policy so that the data can be recovered.
+func recordRetainedResources(ctx *context.MachineContext, ref *session.CloudObjectRef) {
+	if ref == nil {
+		return
+	}
+	var retained []infrav1.RetainedResource
+	for name, id := range ref.RetainedDiskIDs {
+		retained = append(retained, infrav1.RetainedResource{
+			Type:     infrav1.RetainedResourceTypeDisk,
+			ID:       id.String(),
+			Zone:     ctx.Zone(),
+			DiskName: name,
+		})
+		record.Eventf(ctx.SakuraCloudMachine, "DiskRetained", "disk %s(%s) in %s is retained", name, id, ctx.Zone())
+	}
+	for name, id := range ref.DiskArchiveIDs {
+		retained = append(retained, infrav1.RetainedResource{
+			Type:     infrav1.RetainedResourceTypeArchive,
+			ID:       id.String(),
+			Zone:     ctx.Zone(),
+			DiskName: name,
+		})
+		record.Eventf(ctx.SakuraCloudMachine, "DiskArchived", "disk %s is archived to %s in %s", name, id, ctx.Zone())
+	}
+	sort.Slice(retained, func(i, j int) bool {
+		if retained[i].Type != retained[j].Type {
+			return retained[i].Type > retained[j].Type
+		}
+		return retained[i].DiskName < retained[j].DiskName
+	})
+	if len(retained) > 0 {
+		ctx.Logger.Info("resources are retained by the deletion policy", "resources", retained)
+	}
+	ctx.SakuraCloudMachine.Status.RetainedResources = retained
+}
+
 // DestroyVM powers off and removes a VM from the inventory
 func (s *SakuraCloudService) DestroyServer(ctx *context.MachineContext) (*infrav1.SakuraCloudMachine, error) {
 	if ctx.SakuraCloudMachine.Status.State == infrav1.InstanceStateNotFound {
 		return ctx.SakuraCloudMachine, nil
 	}
 
-	if ctx.SakuraCloudMachine.Status.State != infrav1.InstanceStateCleaning && ctx.SakuraCloudMachine.Status.JobRef == "" {
+	if ctx.SakuraCloudMachine.Status.JobRef == "" {
+		if err := deleteNodeRecord(ctx); err != nil {
+			return ctx.SakuraCloudMachine, err
+		}
 		if ctx.SakuraCloudMachine.Spec.MachineRef == nil {
 			// server already deleted
 			ctx.SakuraCloudMachine.Status.State = infrav1.InstanceStateNotFound
 			return ctx.SakuraCloudMachine, nil
 		}
+		if job := ctx.Session.JobByID(ctx.SakuraCloudMachine.Status.BackupJobRef); job != nil &&
+			(job.State == session.JobStatePending || job.State == session.JobStateInFlight) {
+			// wait for the backup so that the disks aren't deleted while being archived
+			return ctx.SakuraCloudMachine, nil
+		}
+
+		// the disks to retain or archive must be known before deleting any of them
+		if policy := ctx.SakuraCloudMachine.Spec.DeletionPolicy; policy != "" && policy != infrav1.DiskDeletionPolicyDelete {
+			if err := validateDeletionPolicyDisks(&ctx.SakuraCloudMachine.Spec); err != nil {
+				record.Warnf(ctx.SakuraCloudMachine, reasonInvalidDeletionPolicy, "server isn't deleted: %v", err)
+				return ctx.SakuraCloudMachine, err
+			}
+		}
 
 		serverID := sacloudtypes.StringID(*ctx.SakuraCloudMachine.Spec.MachineRef.ID)
-		jobID := ctx.Session.Cleanup(ctx, ctx.Zone(), serverID)
+		shutdownTimeout := ctx.ShutdownTimeout()
+		jobID := ctx.Session.Cleanup(ctx, ctx.Zone(), serverID, &session.ServerCleanupParameter{
+			ServerName:          ctx.Machine.Name,
+			ClusterName:         ctx.Cluster.Name,
+			NameSpace:           ctx.Cluster.Namespace,
+			ShutdownTimeout:     shutdownTimeout,
+			DeletionPolicy:      ctx.SakuraCloudMachine.Spec.DeletionPolicy,
+			DeletionPolicyDisks: ctx.SakuraCloudMachine.Spec.DeletionPolicyDisks,
+		})
 
 		ctx.SakuraCloudMachine.Status.JobRef = string(jobID)
 		ctx.SakuraCloudMachine.Status.State = infrav1.InstanceStateCleaning
+		if shutdownTimeout > 0 {
+			record.Eventf(ctx.SakuraCloudMachine, "DeletingServer", "deleting server %s after shutting it down gracefully within %s", serverID, shutdownTimeout)
+		} else {
+			record.Eventf(ctx.SakuraCloudMachine, "DeletingServer", "deleting server %s after powering it off forcibly", serverID)
+		}
 		return ctx.SakuraCloudMachine, nil
 	}
 
@@ -131,23 +519,43 @@ func (s *SakuraCloudService) DestroyServer(ctx *context.MachineContext) (*infrav
 		return ctx.SakuraCloudMachine, nil
 	}
 	if job.Type != session.JobTypeCleaning {
+		// wait for the power operation in progress, otherwise it races with shutting down the server
+		if isPowerOperation(job.Type) && (job.State == session.JobStatePending || job.State == session.JobStateInFlight) {
+			return ctx.SakuraCloudMachine, nil
+		}
+		if job.Type == session.JobTypeProvisioning {
+			// the build waiting in the queue is canceled, and the one in progress is waited for
+			// so that the server isn't created after the machine is deleted
+			if !ctx.Session.CancelJob(string(job.ID)) {
+				return ctx.SakuraCloudMachine, nil
+			}
+			if ctx.SakuraCloudMachine.Spec.MachineRef == nil && job.Reference != nil && !job.Reference.ServerID.IsEmpty() {
+				// the server created by the build is deleted by the cleanup
+				id := job.Reference.ServerID.String()
+				ctx.SakuraCloudMachine.Spec.MachineRef = &infrav1.SakuraCloudResourceReference{ID: &id}
+			}
+		}
 		// cleanup old job and requeue
 		ctx.SakuraCloudMachine.Status.JobRef = ""
 		ctx.Session.DeleteJob(string(job.ID))
 		return ctx.SakuraCloudMachine, nil
 	}
-	if job.Error != nil {
-		ctx.SetMachineError(errors.DeleteMachineError, job.Error.Error())
-		return ctx.SakuraCloudMachine, job.Error
-	}
 
 	switch job.State {
 	case session.JobStatePending, session.JobStateInFlight:
 		return ctx.SakuraCloudMachine, nil
 	case session.JobStateFailed:
-		ctx.SetMachineError(errors.CreateMachineError, job.Error.Error())
+		// the cleanup is started again on the next reconciliation
+		ctx.SakuraCloudMachine.Status.JobRef = ""
+		ctx.Session.DeleteJob(string(job.ID))
+		if !session.IsRetryableError(job.Error) {
+			setMachineError(ctx, errors.DeleteMachineError, job.Error)
+		}
 		return ctx.SakuraCloudMachine, job.Error
 	case session.JobStateDone:
+		record.Eventf(ctx.SakuraCloudMachine, "ServerDeleted", "server %s is deleted: %s", *ctx.SakuraCloudMachine.Spec.MachineRef.ID, job.Result)
+		recordRetainedResources(ctx, job.Reference)
+		clearMachineCost(ctx)
 		ctx.SakuraCloudMachine.Spec.MachineRef = nil
 
 		ctx.SakuraCloudMachine.Status.JobRef = ""
@@ -157,3 +565,262 @@ func (s *SakuraCloudService) DestroyServer(ctx *context.MachineContext) (*infrav
 
 	return ctx.SakuraCloudMachine, nil
 }
+
+// ReconcileCluster reconciles the SakuraCloud resources shared by the cluster's servers
+func (s *SakuraCloudService) ReconcileCluster(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error) {
+	ctx.SakuraCloudCluster.Status.ProvisioningQueue = nil
+	for _, zone := range ctx.Zones() {
+		waiting, running := ctx.Session.ProvisioningQueueDepth(zone)
+		ctx.SakuraCloudCluster.Status.ProvisioningQueue = append(ctx.SakuraCloudCluster.Status.ProvisioningQueue,
+			infrav1.ProvisioningQueueStatus{Zone: zone, Waiting: waiting, Running: running})
+	}
+
+	spec := ctx.SakuraCloudCluster.Spec.PacketFilter
+	if spec == nil {
+		spec = &infrav1.PacketFilterSpec{}
+	}
+	if spec.Disabled {
+		// the servers are disconnected from the packet filters, and servers created after this are not filtered
+		if ctx.SakuraCloudCluster.Status.PacketFilterIDs != nil {
+			for _, zone := range ctx.Zones() {
+				if err := ctx.Session.DetachPacketFilter(ctx, zone, ctx.Cluster.Name, ctx.Cluster.Namespace); err != nil {
+					return ctx.SakuraCloudCluster, err
+				}
+			}
+			record.Event(ctx.SakuraCloudCluster, "PacketFilterDetached", "packet filters are detached from the servers")
+		}
+		ctx.SakuraCloudCluster.Status.PacketFilterIDs = nil
+		return ctx.SakuraCloudCluster, nil
+	}
+
+	// allow all traffic between the servers of the cluster
+	var nodeAddresses []string
+	if len(spec.ClusterCIDRs) == 0 {
+		addresses, err := ctx.Session.FindClusterAddresses(ctx, ctx.Zones(), ctx.Cluster.Name, ctx.Cluster.Namespace)
+		if err != nil {
+			return ctx.SakuraCloudCluster, err
+		}
+		nodeAddresses = addresses
+	}
+
+	// packet filters are zonal resources
+	for _, zone := range ctx.Zones() {
+		packetFilter, err := ctx.Session.ReconcilePacketFilter(ctx, zone, &session.PacketFilterParameter{
+			ClusterName:   ctx.Cluster.Name,
+			NameSpace:     ctx.Cluster.Namespace,
+			Spec:          *spec,
+			NodeAddresses: nodeAddresses,
+		})
+		if err != nil {
+			if !session.IsRetryableError(err) {
+				setClusterError(ctx, errors.CreateClusterError, err)
+			}
+			return ctx.SakuraCloudCluster, err
+		}
+		// the servers created before the packet filter, or while it was disabled
+		if err := ctx.Session.ApplyPacketFilter(ctx, zone, ctx.Cluster.Name, ctx.Cluster.Namespace, packetFilter.ID); err != nil {
+			return ctx.SakuraCloudCluster, err
+		}
+		if ctx.SakuraCloudCluster.Status.PacketFilterIDs == nil {
+			ctx.SakuraCloudCluster.Status.PacketFilterIDs = map[string]string{}
+		}
+		if ctx.SakuraCloudCluster.Status.PacketFilterIDs[zone] != packetFilter.ID.String() {
+			ctx.SakuraCloudCluster.Status.PacketFilterIDs[zone] = packetFilter.ID.String()
+			record.Eventf(ctx.SakuraCloudCluster, "PacketFilterReconciled", "packet filter %s(%s) in zone %s is reconciled", packetFilter.Name, packetFilter.ID, zone)
+		}
+	}
+	return ctx.SakuraCloudCluster, nil
+}
+
+// DestroyCluster removes all SakuraCloud resources owned by the cluster
+func (s *SakuraCloudService) DestroyCluster(ctx *context.ClusterContext) (*infrav1.SakuraCloudCluster, error) {
+	if ctx.SakuraCloudCluster.Status.State == infrav1.ClusterStateDeleted {
+		return ctx.SakuraCloudCluster, nil
+	}
+
+	if ctx.SakuraCloudCluster.Status.JobRef == "" {
+		if err := deleteAPIEndpointRecord(ctx); err != nil {
+			return ctx.SakuraCloudCluster, err
+		}
+
+		// look up remaining resources so that deletion is confirmed by SakuraCloud
+		count := 0
+		for _, zone := range ctx.Zones() {
+			resources, err := ctx.Session.FindClusterResources(ctx, zone, ctx.Cluster.Name, ctx.Cluster.Namespace)
+			if err != nil {
+				return ctx.SakuraCloudCluster, err
+			}
+			count += resources.Count()
+		}
+		if count == 0 {
+			ctx.SakuraCloudCluster.Status.State = infrav1.ClusterStateDeleted
+			clearClusterCost(ctx)
+			record.Event(ctx.SakuraCloudCluster, "ClusterResourcesDeleted", "all SakuraCloud resources of the cluster are deleted")
+			return ctx.SakuraCloudCluster, nil
+		}
+
+		jobID := ctx.Session.CleanupCluster(ctx, ctx.Zones(), ctx.Cluster.Name, ctx.Cluster.Namespace, ctx.ShutdownTimeout())
+		ctx.SakuraCloudCluster.Status.JobRef = string(jobID)
+		ctx.SakuraCloudCluster.Status.State = infrav1.ClusterStateCleaning
+		record.Eventf(ctx.SakuraCloudCluster, "DeletingClusterResources", "deleting %d SakuraCloud resources of the cluster", count)
+		return ctx.SakuraCloudCluster, nil
+	}
+
+	job := ctx.Session.JobByID(ctx.SakuraCloudCluster.Status.JobRef)
+	if job == nil || job.Type != session.JobTypeClusterCleaning {
+		// the job was lost(e.g. controller restarted), look up the resources again
+		ctx.SakuraCloudCluster.Status.JobRef = ""
+		return ctx.SakuraCloudCluster, nil
+	}
+
+	switch job.State {
+	case session.JobStatePending, session.JobStateInFlight:
+		if job.Progress != "" {
+			ctx.Logger.V(6).Info("deleting cluster resources", "progress", job.Progress)
+		}
+		return ctx.SakuraCloudCluster, nil
+	case session.JobStateFailed:
+		ctx.SakuraCloudCluster.Status.JobRef = ""
+		ctx.Session.DeleteJob(string(job.ID))
+		record.Warnf(ctx.SakuraCloudCluster, "DeleteClusterResourcesFailed", "failed to delete SakuraCloud resources: %v", job.Error)
+		if !session.IsRetryableError(job.Error) {
+			setClusterError(ctx, errors.DeleteClusterError, job.Error)
+		}
+		return ctx.SakuraCloudCluster, job.Error
+	case session.JobStateDone:
+		// resources are looked up again on the next reconciliation
+		ctx.SakuraCloudCluster.Status.JobRef = ""
+		ctx.Session.DeleteJob(string(job.ID))
+	}
+
+	return ctx.SakuraCloudCluster, nil
+}
+
+// ReconcileArchive uploads the image and makes the archive available in all zones
+func (s *SakuraCloudService) ReconcileArchive(ctx *context.ArchiveContext) (*infrav1.SakuraCloudArchive, error) {
+	archive := ctx.SakuraCloudArchive
+	zones := archive.Zones()
+
+	// the archives are not imported again when the spec is changed, as servers may be being built from them
+	specHash := archiveSpecHash(&archive.Spec)
+	if archive.Status.JobRef == "" && archive.Status.SpecHash != "" && archive.Status.SpecHash != specHash {
+		if len(archive.Status.ArchiveIDs) != 0 {
+			msg := "only zones can be changed after the archive is imported, create a new SakuraCloudArchive to change the image"
+			if archive.Status.ErrorMessage == nil || *archive.Status.ErrorMessage != msg {
+				record.Warnf(archive, "ArchiveSpecChanged", "spec change is not applied: %s", msg)
+			}
+			ctx.SetArchiveError(msg)
+			return archive, nil
+		}
+		// the import has never succeeded, discard the archives left by the failed attempts and import the new spec
+		if err := ctx.Session.DeleteArchives(ctx, zones, archive.Name, archive.Namespace); err != nil {
+			return archive, err
+		}
+		archive.Status.SpecHash = ""
+	}
+
+	if archive.Status.State == infrav1.ArchiveStateAvailable && hasArchiveInZones(archive, zones) {
+		archive.Status.ErrorMessage = nil
+		return archive, nil
+	}
+
+	// archives already available in a zone are reused by the job, so zones added later are only uploaded to
+	if archive.Status.JobRef == "" {
+		jobID := ctx.Session.ImportArchive(ctx, &session.ArchiveImportParameter{
+			Name:      archive.Name,
+			NameSpace: archive.Namespace,
+			Zones:     zones,
+			Spec:      archive.Spec,
+		})
+		archive.Status.JobRef = string(jobID)
+		archive.Status.SpecHash = specHash
+		archive.Status.State = infrav1.ArchiveStateUploading
+		archive.Status.Ready = false
+		record.Eventf(archive, "ImportingArchive", "uploading image to zone %s", strings.Join(zones, ", "))
+		return archive, nil
+	}
+
+	job := ctx.Session.JobByID(archive.Status.JobRef)
+	if job == nil || job.Type != session.JobTypeArchiveImporting {
+		// the job was lost(e.g. controller restarted), start it again
+		archive.Status.JobRef = ""
+		return archive, nil
+	}
+
+	switch job.State {
+	case session.JobStatePending, session.JobStateInFlight:
+		if job.Progress != "" {
+			ctx.Logger.V(6).Info("importing archive", "progress", job.Progress)
+		}
+		return archive, nil
+	case session.JobStateFailed:
+		archive.Status.JobRef = ""
+		ctx.Session.DeleteJob(string(job.ID))
+		ctx.SetArchiveError(job.Error.Error())
+		record.Warnf(archive, "ImportArchiveFailed", "failed to import archive: %v", job.Error)
+		return archive, job.Error
+	case session.JobStateDone:
+		archiveIDs := make(map[string]string)
+		for zone, id := range job.Reference.ArchiveIDs {
+			archiveIDs[zone] = id.String()
+		}
+		archive.Status.ArchiveIDs = archiveIDs
+		archive.Status.State = infrav1.ArchiveStateAvailable
+		archive.Status.Ready = true
+		archive.Status.ErrorMessage = nil
+		archive.Status.JobRef = ""
+		ctx.Session.DeleteJob(string(job.ID))
+		record.Eventf(archive, "ArchiveAvailable", "archive is available in zone %s", strings.Join(zones, ", "))
+	}
+
+	return archive, nil
+}
+
+// DestroyArchive removes the archives from all zones
+func (s *SakuraCloudService) DestroyArchive(ctx *context.ArchiveContext) (*infrav1.SakuraCloudArchive, error) {
+	archive := ctx.SakuraCloudArchive
+	if archive.Status.State == infrav1.ArchiveStateDeleted {
+		return archive, nil
+	}
+
+	// wait for the upload to finish, otherwise the archive being uploaded is left behind
+	if archive.Status.JobRef != "" {
+		job := ctx.Session.JobByID(archive.Status.JobRef)
+		if job != nil && (job.State == session.JobStatePending || job.State == session.JobStateInFlight) {
+			return archive, nil
+		}
+		archive.Status.JobRef = ""
+		if job != nil {
+			ctx.Session.DeleteJob(string(job.ID))
+		}
+	}
+
+	archive.Status.State = infrav1.ArchiveStateCleaning
+	archive.Status.Ready = false
+	if err := ctx.Session.DeleteArchives(ctx, archive.Zones(), archive.Name, archive.Namespace); err != nil {
+		return archive, err
+	}
+
+	archive.Status.ArchiveIDs = nil
+	archive.Status.State = infrav1.ArchiveStateDeleted
+	record.Event(archive, "ArchiveDeleted", "archives are deleted from all zones")
+	return archive, nil
+}
+
+// archiveSpecHash returns the hash of the spec of the archive except the zones
+func archiveSpecHash(spec *infrav1.SakuraCloudArchiveSpec) string {
+	imported := spec.DeepCopy()
+	imported.Zone = ""
+	imported.Zones = nil
+	data, _ := json.Marshal(imported) // never fails
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16]
+}
+
+func hasArchiveInZones(archive *infrav1.SakuraCloudArchive, zones []string) bool {
+	for _, zone := range zones {
+		if archive.Status.ArchiveIDs[zone] == "" {
+			return false
+		}
+	}
+	return true
+}
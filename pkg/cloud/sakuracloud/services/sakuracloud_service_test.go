@@ -0,0 +1,393 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/klogr"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/constants"
+	sakuracloudcontext "github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/context"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/session"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/util"
+)
+
+var fakeZoneCount int32
+
+// newFakeSession returns a session using the in-memory fake of libsacloud, and the name of a zone which has no resources yet.
+// The fake doesn't implement the filters of Find, so each test uses its own zone.
+func newFakeSession(g *gomega.GomegaWithT) (*session.Client, string) {
+	fake.SwitchFactoryFuncToFake()
+	fake.PowerOnDuration = time.Millisecond
+	fake.PowerOffDuration = time.Millisecond
+	fake.DiskCopyDuration = time.Millisecond
+	sacloud.DefaultStatePollInterval = 10 * time.Millisecond
+
+	client, err := session.NewClient(&session.ClientOptions{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	return client, fmt.Sprintf("caps-services-test-%d", atomic.AddInt32(&fakeZoneCount, 1))
+}
+
+// newFakeMachineContext returns the context of a machine whose server is up
+func newFakeMachineContext(g *gomega.GomegaWithT, client *session.Client, zone string) *sakuracloudcontext.MachineContext {
+	ctx := context.Background()
+	serverOp := sacloud.NewServerOp(nil)
+	sv, err := serverOp.Create(ctx, zone, &sacloud.ServerCreateRequest{Name: "caps-example-md-0-a", CPU: 2, MemoryMB: 4096})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(serverOp.Boot(ctx, zone, sv.ID)).To(gomega.Succeed())
+	g.Eventually(func() bool {
+		sv, err := serverOp.Read(ctx, zone, sv.ID)
+		return err == nil && sv.InstanceStatus.IsUp()
+	}).Should(gomega.BeTrue())
+
+	id := sv.ID.String()
+	return &sakuracloudcontext.MachineContext{
+		ClusterContext: &sakuracloudcontext.ClusterContext{
+			Context:            ctx,
+			Cluster:            &clusterv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: "default"}},
+			SakuraCloudCluster: &infrav1.SakuraCloudCluster{Spec: infrav1.SakuraCloudClusterSpec{Zone: zone}},
+			Logger:             klogr.New(),
+			Session:            client,
+		},
+		Machine: &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "example-md-0-a", Namespace: "default"}},
+		SakuraCloudMachine: &infrav1.SakuraCloudMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "example-md-0-a", Namespace: "default", Annotations: map[string]string{}},
+			Spec:       infrav1.SakuraCloudMachineSpec{MachineRef: &infrav1.SakuraCloudResourceReference{ID: &id}},
+			Status:     infrav1.SakuraCloudMachineStatus{State: infrav1.InstanceStateReady},
+		},
+		Session: client,
+	}
+}
+
+// waitForJob waits for the job referenced by the machine to finish
+func waitForJob(g *gomega.GomegaWithT, ctx *sakuracloudcontext.MachineContext) {
+	g.Eventually(func() session.JobState {
+		job := ctx.Session.JobByID(ctx.SakuraCloudMachine.Status.JobRef)
+		if job == nil {
+			return ""
+		}
+		return job.State
+	}, 5*time.Second).Should(gomega.Or(gomega.BeEquivalentTo(session.JobStateDone), gomega.BeEquivalentTo(session.JobStateFailed)))
+}
+
+func TestReconcileArchive(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	client, _ := newFakeSession(g)
+
+	newArchiveContext := func(name string) *sakuracloudcontext.ArchiveContext {
+		spec := infrav1.SakuraCloudArchiveSpec{
+			Zone:   "caps-services-test-1",
+			Source: infrav1.ArchiveSource{URL: "https://example.com/ubuntu.img"},
+		}
+		return &sakuracloudcontext.ArchiveContext{
+			Context: context.Background(),
+			SakuraCloudArchive: &infrav1.SakuraCloudArchive{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec:       spec,
+				Status: infrav1.SakuraCloudArchiveStatus{
+					Ready:      true,
+					State:      infrav1.ArchiveStateAvailable,
+					ArchiveIDs: map[string]string{"caps-services-test-1": "1"},
+					SpecHash:   archiveSpecHash(&spec),
+				},
+			},
+			Logger:  klogr.New(),
+			Session: client,
+		}
+	}
+	s := &SakuraCloudService{}
+
+	// available in all zones
+	ctx := newArchiveContext("available")
+	archive, err := s.ReconcileArchive(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(archive.Status.JobRef).To(gomega.BeEmpty())
+	g.Expect(archive.Status.ErrorMessage).To(gomega.BeNil())
+
+	// zones added later are uploaded to
+	ctx = newArchiveContext("zone-added")
+	ctx.SakuraCloudArchive.Spec.Zones = []string{"caps-services-test-2"}
+	hash := ctx.SakuraCloudArchive.Status.SpecHash
+	archive, err = s.ReconcileArchive(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(archive.Status.JobRef).NotTo(gomega.BeEmpty())
+	g.Expect(archive.Status.State).To(gomega.BeEquivalentTo(infrav1.ArchiveStateUploading))
+	g.Expect(archive.Status.SpecHash).To(gomega.Equal(hash))
+
+	// the other changes are not applied to the imported archives
+	ctx = newArchiveContext("source-changed")
+	ctx.SakuraCloudArchive.Spec.Source.URL = "https://example.com/ubuntu-updated.img"
+	archive, err = s.ReconcileArchive(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(archive.Status.JobRef).To(gomega.BeEmpty())
+	g.Expect(archive.Status.State).To(gomega.BeEquivalentTo(infrav1.ArchiveStateAvailable))
+	g.Expect(archive.Status.ErrorMessage).NotTo(gomega.BeNil())
+
+	// the changes are applied if the import has never succeeded
+	ctx = newArchiveContext("failed")
+	ctx.SakuraCloudArchive.Status = infrav1.SakuraCloudArchiveStatus{
+		SpecHash: ctx.SakuraCloudArchive.Status.SpecHash,
+	}
+	ctx.SakuraCloudArchive.Spec.Source.URL = "https://example.com/ubuntu-fixed.img"
+	archive, err = s.ReconcileArchive(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(archive.Status.JobRef).NotTo(gomega.BeEmpty())
+	g.Expect(archive.Status.SpecHash).To(gomega.Equal(archiveSpecHash(&archive.Spec)))
+}
+
+func TestArchiveSpecHash(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	spec := &infrav1.SakuraCloudArchiveSpec{
+		Zone:   "is1a",
+		Source: infrav1.ArchiveSource{URL: "https://example.com/ubuntu.img"},
+		Tags:   []string{"k8s-version=1.16.2"},
+	}
+	hash := archiveSpecHash(spec)
+
+	zonesChanged := spec.DeepCopy()
+	zonesChanged.Zone = "tk1a"
+	zonesChanged.Zones = []string{"is1a"}
+	g.Expect(archiveSpecHash(zonesChanged)).To(gomega.Equal(hash))
+
+	tagsChanged := spec.DeepCopy()
+	tagsChanged.Tags = []string{"k8s-version=1.16.3"}
+	g.Expect(archiveSpecHash(tagsChanged)).NotTo(gomega.Equal(hash))
+
+	sizeChanged := spec.DeepCopy()
+	sizeChanged.SizeGB = 40
+	g.Expect(archiveSpecHash(sizeChanged)).NotTo(gomega.Equal(hash))
+}
+
+func TestReconcilePowerState(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	client, zone := newFakeSession(g)
+	ctx := newFakeMachineContext(g, client, zone)
+	machine := ctx.SakuraCloudMachine
+	s := &SakuraCloudService{}
+
+	// no operation is requested
+	_, err := s.reconcilePowerState(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Status.JobRef).To(gomega.BeEmpty())
+	g.Expect(util.GetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn).Status).To(gomega.BeEquivalentTo("True"))
+
+	// shutdown takes precedence over reboot and boot
+	machine.Annotations[constants.BootRequestedAnnotationLabel] = "2019-11-01T00:00:00Z"
+	machine.Annotations[constants.RebootRequestedAnnotationLabel] = "2019-11-01T00:00:00Z"
+	machine.Annotations[constants.ShutdownRequestedAnnotationLabel] = "2019-11-01T00:00:00Z"
+	_, err = s.reconcilePowerState(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ctx.Session.JobByID(machine.Status.JobRef).Type).To(gomega.BeEquivalentTo(session.JobTypeShuttingDown))
+
+	// the annotation of the completed operation is cleared, and the next one is started
+	waitForJob(g, ctx)
+	_, err = s.reconcilePowerState(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Annotations).NotTo(gomega.HaveKey(constants.ShutdownRequestedAnnotationLabel))
+	g.Expect(machine.Annotations).To(gomega.HaveKey(constants.RebootRequestedAnnotationLabel))
+	g.Expect(util.GetCondition(machine.Status.Conditions, infrav1.ConditionTypePoweredOn).Reason).To(gomega.Equal(reasonShutdownRequested))
+	g.Expect(ctx.Session.JobByID(machine.Status.JobRef).Type).To(gomega.BeEquivalentTo(session.JobTypeRebooting))
+
+	waitForJob(g, ctx)
+	_, err = s.reconcilePowerState(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Annotations).NotTo(gomega.HaveKey(constants.RebootRequestedAnnotationLabel))
+	g.Expect(ctx.Session.JobByID(machine.Status.JobRef).Type).To(gomega.BeEquivalentTo(session.JobTypeBooting))
+
+	waitForJob(g, ctx)
+	_, err = s.reconcilePowerState(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Annotations).To(gomega.BeEmpty())
+	g.Expect(machine.Status.JobRef).To(gomega.BeEmpty())
+
+	// the request failed permanently is cleared too
+	machine.Annotations[constants.BootRequestedAnnotationLabel] = "2019-11-01T00:00:00Z"
+	machine.Status.JobRef = string(ctx.Session.Boot(ctx, zone, sacloudtypes.ID(999999999999)))
+	waitForJob(g, ctx)
+	_, err = s.reconcilePowerState(ctx)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(machine.Annotations).To(gomega.BeEmpty())
+	g.Expect(machine.Status.JobRef).To(gomega.BeEmpty())
+}
+
+func TestDestroyServerWaitsForPowerOperation(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	client, zone := newFakeSession(g)
+	ctx := newFakeMachineContext(g, client, zone)
+	machine := ctx.SakuraCloudMachine
+	s := &SakuraCloudService{}
+
+	fake.PowerOffDuration = 500 * time.Millisecond
+	defer func() { fake.PowerOffDuration = time.Millisecond }()
+
+	machine.Annotations[constants.ShutdownRequestedAnnotationLabel] = "2019-11-01T00:00:00Z"
+	_, err := s.reconcilePowerState(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	shutdownJob := machine.Status.JobRef
+	g.Expect(shutdownJob).NotTo(gomega.BeEmpty())
+
+	// the cleanup isn't started while the server is shutting down
+	now := metav1.Now()
+	machine.DeletionTimestamp = &now
+	_, err = s.DestroyServer(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Status.JobRef).To(gomega.Equal(shutdownJob))
+	g.Expect(machine.Status.State).To(gomega.BeEquivalentTo(infrav1.InstanceStateReady))
+
+	// the cleanup is started after the shutdown
+	waitForJob(g, ctx)
+	_, err = s.DestroyServer(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Status.JobRef).To(gomega.BeEmpty())
+	_, err = s.DestroyServer(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(ctx.Session.JobByID(machine.Status.JobRef).Type).To(gomega.BeEquivalentTo(session.JobTypeCleaning))
+	g.Expect(machine.Status.State).To(gomega.BeEquivalentTo(infrav1.InstanceStateCleaning))
+
+	waitForJob(g, ctx)
+}
+
+func TestReconcileServerNodeRecord(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	client, zone := newFakeSession(g)
+	ctx := newFakeMachineContext(g, client, zone)
+	ctx.SakuraCloudCluster.Spec.DNS = &infrav1.DNSSpec{Zone: "caps-services-test.example.com", NodeRecords: true}
+	machine := ctx.SakuraCloudMachine
+	machine.Name = "example-md-0-a-xxxxx"
+	machine.Spec.Backup = &infrav1.BackupSpec{Interval: metav1.Duration{Duration: time.Hour}}
+	s := &SakuraCloudService{}
+
+	// the fake doesn't assign the addresses of the shared segment
+	sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return &addressedServerOp{ServerAPI: fake.NewServerOp(), address: "192.0.2.10"}
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return fake.NewServerOp()
+	})
+
+	// the disks are backed up even if the DNS zone is missing
+	_, err := s.ReconcileServer(ctx)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(machine.Status.DNSRecord).To(gomega.BeNil())
+	g.Expect(machine.Status.BackupJobRef).NotTo(gomega.BeEmpty())
+	g.Eventually(func() session.JobState {
+		return ctx.Session.JobByID(machine.Status.BackupJobRef).State
+	}, 5*time.Second).Should(gomega.Or(gomega.BeEquivalentTo(session.JobStateDone), gomega.BeEquivalentTo(session.JobStateFailed)))
+	ctx.Session.DeleteJob(machine.Status.BackupJobRef)
+	machine.Status.BackupJobRef = ""
+	machine.Spec.Backup = nil
+
+	// the record is named after the Machine
+	dnsOp := sacloud.NewDNSOp(nil)
+	dns, err := dnsOp.Create(ctx, &sacloud.DNSCreateRequest{Name: "caps-services-test.example.com"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	defer dnsOp.Delete(ctx, dns.ID) // ignore error
+	_, err = s.ReconcileServer(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Status.DNSRecord).To(gomega.Equal(&infrav1.DNSRecordReference{Zone: dns.Name, Name: "example-md-0-a.example"}))
+
+	// the record deleted with the DNS zone doesn't block the deletion
+	g.Expect(dnsOp.Delete(ctx, dns.ID)).To(gomega.Succeed())
+	g.Expect(deleteNodeRecord(ctx)).To(gomega.Succeed())
+	g.Expect(machine.Status.DNSRecord).To(gomega.BeNil())
+}
+
+type addressedServerOp struct {
+	sacloud.ServerAPI
+	address string
+}
+
+func (o *addressedServerOp) Read(ctx context.Context, zone string, id sacloudtypes.ID) (*sacloud.Server, error) {
+	sv, err := o.ServerAPI.Read(ctx, zone, id)
+	if err != nil {
+		return nil, err
+	}
+	sv.Interfaces = append(sv.Interfaces, &sacloud.InterfaceView{IPAddress: o.address})
+	return sv, nil
+}
+
+func TestBackupRetryDelay(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	daily := &infrav1.BackupSpec{Interval: metav1.Duration{Duration: 24 * time.Hour}}
+	g.Expect(backupRetryDelay(1, daily)).To(gomega.Equal(5 * time.Minute))
+	g.Expect(backupRetryDelay(2, daily)).To(gomega.Equal(10 * time.Minute))
+	g.Expect(backupRetryDelay(4, daily)).To(gomega.Equal(40 * time.Minute))
+	g.Expect(backupRetryDelay(100, daily)).To(gomega.Equal(6 * time.Hour))
+
+	// never longer than the interval
+	hourly := &infrav1.BackupSpec{Interval: metav1.Duration{Duration: time.Hour}}
+	g.Expect(backupRetryDelay(10, hourly)).To(gomega.Equal(time.Hour))
+}
+
+func TestValidateDeletionPolicyDisks(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	spec := &infrav1.SakuraCloudMachineSpec{
+		AdditionalDisks: []infrav1.AdditionalDisk{{Name: "etcd"}},
+	}
+	g.Expect(validateDeletionPolicyDisks(spec)).To(gomega.Succeed())
+
+	spec.DeletionPolicyDisks = []string{"boot", "etcd"}
+	g.Expect(validateDeletionPolicyDisks(spec)).To(gomega.Succeed())
+
+	spec.DeletionPolicyDisks = []string{"boot", "etc", "data"}
+	err := validateDeletionPolicyDisks(spec)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("etc, data"))
+}
+
+func TestDestroyServerRejectsUnknownDeletionPolicyDisks(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	client, zone := newFakeSession(g)
+	ctx := newFakeMachineContext(g, client, zone)
+	machine := ctx.SakuraCloudMachine
+	machine.Spec.DeletionPolicy = infrav1.DiskDeletionPolicyRetain
+	machine.Spec.DeletionPolicyDisks = []string{"bot"}
+	s := &SakuraCloudService{}
+
+	// the server isn't touched, otherwise the boot disk would be deleted
+	_, err := s.DestroyServer(ctx)
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(machine.Status.JobRef).To(gomega.BeEmpty())
+	g.Expect(machine.Status.State).To(gomega.BeEquivalentTo(infrav1.InstanceStateReady))
+
+	machine.Spec.DeletionPolicyDisks = []string{"boot"}
+	_, err = s.DestroyServer(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(machine.Status.State).To(gomega.BeEquivalentTo(infrav1.InstanceStateCleaning))
+
+	waitForJob(g, ctx)
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/ostype"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+// KubernetesVersionTagPrefix is the prefix of the tag which holds the Kubernetes version installed in an archive
+const KubernetesVersionTagPrefix = "k8s-version="
+
+// AmbiguousArchiveError is returned by FindArchive when multiple archives
+// match and the selection policy doesn't choose one of them.
+type AmbiguousArchiveError struct {
+	Archives []*sacloud.Archive
+}
+
+func (e *AmbiguousArchiveError) Error() string {
+	var names []string
+	for _, archive := range e.Archives {
+		names = append(names, fmt.Sprintf("%s(%s)", archive.Name, archive.ID))
+	}
+	return fmt.Sprintf("%d archives match the filters: %s", len(e.Archives), strings.Join(names, ", "))
+}
+
+func (s *serverClient) ReadArchive(ctx context.Context, zone string, archiveID sacloudtypes.ID) (*sacloud.Archive, error) {
+	return s.archiveOp().Read(ctx, zone, archiveID)
+}
+
+// FindArchive returns the archive referenced by filters and/or OS type, or nil if no archive matches
+func (s *serverClient) FindArchive(ctx context.Context, zone string, ref *infrav1.SourceArchiveReference) (*sacloud.Archive, error) {
+	condition, namePrefixes, err := buildArchiveFindCondition(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	searched, err := s.archiveOp().Find(ctx, zone, condition)
+	if err != nil {
+		return nil, err
+	}
+	return selectArchive(searched.Archives, namePrefixes, ref.Selection)
+}
+
+// KubernetesVersionTag returns the tag of archives for the Kubernetes version, e.g. k8s-version=1.16.2 for v1.16.2
+func KubernetesVersionTag(version string) string {
+	return KubernetesVersionTagPrefix + strings.TrimPrefix(version, "v")
+}
+
+// ArchiveReferenceForKubernetesVersion returns a copy of ref which only matches archives for the Kubernetes version
+func ArchiveReferenceForKubernetesVersion(ref *infrav1.SourceArchiveReference, version string) *infrav1.SourceArchiveReference {
+	narrowed := ref.DeepCopy()
+	narrowed.Filters = append(narrowed.Filters, infrav1.Filter{
+		Name:   keys.Tags,
+		Values: []string{KubernetesVersionTag(version)},
+	})
+	return narrowed
+}
+
+func buildArchiveFindCondition(ref *infrav1.SourceArchiveReference) (*sacloud.FindCondition, []string, error) {
+	filter := search.Filter{}
+	var tags []string
+	var namePrefixes []string
+
+	if ref.OSType != "" {
+		osType := ostype.StrToOSType(ref.OSType)
+		criteria, ok := ostype.ArchiveCriteria[osType]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown OS type: %q", ref.OSType)
+		}
+		for key, value := range criteria {
+			if key == search.Key(keys.Tags) {
+				// TagsAndEqual holds the tags as a slice
+				for _, condition := range value.(*search.EqualExpression).Conditions {
+					if values, ok := condition.([]string); ok {
+						tags = append(tags, values...)
+					}
+				}
+				continue
+			}
+			filter[key] = value
+		}
+	}
+
+	for _, f := range ref.Filters {
+		if f.Name == "Tags" || f.Name == keys.Tags {
+			// tags are only matched exactly by SakuraCloud API
+			if f.MatchType != "" && f.MatchType != infrav1.FilterMatchTypeExact {
+				return nil, nil, fmt.Errorf("%s match is not supported by filter %q", f.MatchType, f.Name)
+			}
+			tags = append(tags, f.Values...)
+			continue
+		}
+		switch f.MatchType {
+		case infrav1.FilterMatchTypePartial:
+			filter[search.Key(f.Name)] = search.PartialMatch(f.Values...)
+		case infrav1.FilterMatchTypePrefix:
+			if f.Name != keys.Name {
+				return nil, nil, fmt.Errorf("prefix match is not supported by filter %q", f.Name)
+			}
+			// SakuraCloud API has no prefix match, so the results are narrowed by selectArchive
+			filter[search.Key(f.Name)] = search.PartialMatch(f.Values...)
+			namePrefixes = append(namePrefixes, f.Values...)
+		default:
+			filter[search.Key(f.Name)] = search.ExactMatch(f.Values...)
+		}
+	}
+
+	if len(tags) > 0 {
+		filter[search.Key(keys.Tags)] = search.TagsAndEqual(tags...)
+	}
+
+	return &sacloud.FindCondition{
+		Sort: search.SortKeys{
+			{Key: "CreatedAt", Order: search.SortDesc},
+		},
+		Filter: filter,
+	}, namePrefixes, nil
+}
+
+func selectArchive(archives []*sacloud.Archive, namePrefixes []string, policy infrav1.ArchiveSelectionPolicy) (*sacloud.Archive, error) {
+	var matched []*sacloud.Archive
+	for _, archive := range archives {
+		if hasPrefixes(archive.Name, namePrefixes) {
+			matched = append(matched, archive)
+		}
+	}
+
+	switch {
+	case len(matched) == 0:
+		return nil, nil
+	case len(matched) == 1:
+		return matched[0], nil
+	case policy == infrav1.ArchiveSelectionNewest:
+		sort.SliceStable(matched, func(i, j int) bool {
+			return matched[i].CreatedAt.After(matched[j].CreatedAt)
+		})
+		return matched[0], nil
+	default:
+		return nil, &AmbiguousArchiveError{Archives: matched}
+	}
+}
+
+func hasPrefixes(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
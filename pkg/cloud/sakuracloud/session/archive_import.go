@@ -0,0 +1,323 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sacloud/ftps"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+const defaultArchiveSizeGB = 20
+
+type archiveClient struct {
+	caller     sacloud.APICaller
+	jobs       *jobRegistry
+	httpClient *http.Client
+	sources    *ArchiveSourceOptions
+}
+
+// ArchiveSourceOptions restricts the images uploaded by SakuraCloudArchives,
+// which are read by the controller on behalf of anyone who can create SakuraCloudArchives
+type ArchiveSourceOptions struct {
+	// ImageDir is the directory containing the images referred by path.
+	// If empty, path sources are rejected
+	ImageDir string
+	// URLSchemes is the URL schemes images can be downloaded with
+	URLSchemes []string
+	// URLHosts is the hosts images can be downloaded from. If empty, URL sources are rejected
+	URLHosts []string
+}
+
+// resolvePath returns the path of the image in the image directory.
+// Paths leading outside the directory, including via symbolic links, are rejected.
+func (o *ArchiveSourceOptions) resolvePath(path string) (string, error) {
+	if o.ImageDir == "" {
+		return "", errors.New("path sources are not allowed because no image directory is configured")
+	}
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("path %q must be relative to the image directory", path)
+	}
+	dir, err := filepath.EvalSymlinks(o.ImageDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, path))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside the image directory", path)
+	}
+	return resolved, nil
+}
+
+// checkURL returns an error if images can't be downloaded from the URL
+func (o *ArchiveSourceOptions) checkURL(u *url.URL) error {
+	if !containsFold(o.URLSchemes, u.Scheme) {
+		return fmt.Errorf("URL scheme %q is not allowed, allowed schemes: %s", u.Scheme, strings.Join(o.URLSchemes, ", "))
+	}
+	if !containsFold(o.URLHosts, u.Hostname()) {
+		return fmt.Errorf("host %q is not allowed, allowed hosts: %s", u.Hostname(), strings.Join(o.URLHosts, ", "))
+	}
+	return nil
+}
+
+// newDownloadClient returns the HTTP client downloading images, which follows only the redirects to the allowed URLs
+func newDownloadClient(transport http.RoundTripper, sources *ArchiveSourceOptions) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return sources.checkURL(req.URL)
+		},
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *archiveClient) archiveOp() sacloud.ArchiveAPI {
+	return sacloud.NewArchiveOp(a.caller)
+}
+
+type ArchiveImportParameter struct {
+	Name      string
+	NameSpace string
+	Zones     []string
+	Spec      infrav1.SakuraCloudArchiveSpec
+}
+
+// ImportArchive uploads the image to a new archive in each zone
+func (a *archiveClient) ImportArchive(ctx context.Context, param *ArchiveImportParameter) JobID {
+	jobID := JobID(fmt.Sprintf("import-archive/%s/%s", param.NameSpace, param.Name))
+	status := &JobStatus{
+		ID:    jobID,
+		Type:  JobTypeArchiveImporting,
+		State: JobStatePending,
+	}
+	a.jobs.set(jobID, status)
+
+	a.jobs.run(status, func() {
+		status.setState(JobStateInFlight)
+
+		status.setProgress("fetching image")
+		image, err := a.openArchiveSource(ctx, &param.Spec.Source)
+		if err != nil {
+			status.fail(err)
+			return
+		}
+		defer image.Close() // ignore error
+
+		archiveIDs := make(map[string]sacloudtypes.ID)
+		for _, zone := range param.Zones {
+			status.setProgress(fmt.Sprintf("uploading image to %s", zone))
+			archive, err := a.importArchive(ctx, zone, param, image)
+			if err != nil {
+				status.fail(err)
+				return
+			}
+			archiveIDs[zone] = archive.ID
+		}
+
+		status.setReference(&CloudObjectRef{ArchiveIDs: archiveIDs})
+		status.setProgress("")
+		status.setState(JobStateDone)
+	})
+
+	return jobID
+}
+
+func (a *archiveClient) importArchive(ctx context.Context, zone string, param *ArchiveImportParameter, image *os.File) (*sacloud.Archive, error) {
+	name := clusterResourceName(param.Name, param.NameSpace)
+
+	// an archive left by the previous attempt is reused only if the upload has completed
+	current, err := a.findImportedArchive(ctx, zone, param)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		if current.Availability.IsAvailable() {
+			return current, nil
+		}
+		if err := a.archiveOp().Delete(ctx, zone, current.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return nil, err
+		}
+	}
+
+	sizeGB := param.Spec.SizeGB
+	if sizeGB == 0 {
+		sizeGB = defaultArchiveSizeGB
+	}
+	archive, ftpServer, err := a.archiveOp().CreateBlank(ctx, zone, &sacloud.ArchiveCreateBlankRequest{
+		SizeMB:      sizeGB * 1024,
+		Name:        name,
+		Description: param.Spec.Description,
+		Tags:        archiveTags(param.Name, param.NameSpace, param.Spec.Tags),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := image.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	ftpsClient := ftps.NewClient(ftpServer.User, ftpServer.Password, ftpServer.HostName)
+	if err := ftpsClient.UploadFile(name+".img", image); err != nil {
+		return nil, &uploadError{err: err}
+	}
+
+	// close FTP
+	if err := a.archiveOp().CloseFTP(ctx, zone, archive.ID); err != nil {
+		return nil, err
+	}
+
+	available, err := sacloud.WaiterForReady(func() (interface{}, error) {
+		return a.archiveOp().Read(ctx, zone, archive.ID)
+	}).WaitForState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return available.(*sacloud.Archive), nil
+}
+
+func (a *archiveClient) findImportedArchive(ctx context.Context, zone string, param *ArchiveImportParameter) (*sacloud.Archive, error) {
+	archives, err := a.findImportedArchives(ctx, zone, param.Name, param.NameSpace)
+	if err != nil {
+		return nil, err
+	}
+	for _, archive := range archives {
+		return archive, nil
+	}
+	return nil, nil
+}
+
+func (a *archiveClient) findImportedArchives(ctx context.Context, zone, name, nameSpace string) ([]*sacloud.Archive, error) {
+	searched, err := a.archiveOp().Find(ctx, zone, &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Tags): search.TagsAndEqual(archiveTags(name, nameSpace, nil)...),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return searched.Archives, nil
+}
+
+// DeleteArchives deletes the archives imported by a SakuraCloudArchive, including the ones left by failed uploads
+func (a *archiveClient) DeleteArchives(ctx context.Context, zones []string, name, nameSpace string) error {
+	for _, zone := range zones {
+		archives, err := a.findImportedArchives(ctx, zone, name, nameSpace)
+		if err != nil {
+			return err
+		}
+		for _, archive := range archives {
+			if err := a.archiveOp().Delete(ctx, zone, archive.ID); err != nil && !sacloud.IsNotFoundError(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openArchiveSource returns the image file, downloading it to a temporary file if needed.
+func (a *archiveClient) openArchiveSource(ctx context.Context, source *infrav1.ArchiveSource) (*os.File, error) {
+	switch {
+	case source.Path != "" && source.URL != "":
+		return nil, errors.New("only one of url and path can be specified as the source of the archive")
+	case source.Path != "":
+		path, err := a.sources.resolvePath(source.Path)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(path)
+	case source.URL != "":
+		u, err := url.Parse(source.URL)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.sources.checkURL(u); err != nil {
+			return nil, err
+		}
+		return a.downloadArchiveSource(ctx, source.URL)
+	default:
+		return nil, errors.New("url or path must be specified as the source of the archive")
+	}
+}
+
+func (a *archiveClient) downloadArchiveSource(ctx context.Context, url string) (*os.File, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close() // ignore error
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image from %s: %s", url, res.Status)
+	}
+
+	file, err := ioutil.TempFile("", "caps-archive-")
+	if err != nil {
+		return nil, err
+	}
+	// unlink the file so that it is removed when closed
+	os.Remove(file.Name()) // ignore error
+
+	if _, err := io.Copy(file, res.Body); err != nil {
+		file.Close() // ignore error
+		return nil, err
+	}
+	return file, nil
+}
+
+// archiveTags returns the tags which identify the archives imported by a SakuraCloudArchive.
+func archiveTags(name, nameSpace string, additional []string) sacloudtypes.Tags {
+	tags := sacloudtypes.Tags{
+		fmt.Sprintf("archive=%s", name),
+		fmt.Sprintf("ns=%s", nameSpace),
+	}
+	return append(tags, additional...)
+}
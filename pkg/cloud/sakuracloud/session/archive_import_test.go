@@ -0,0 +1,173 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestOpenArchiveSourcePath(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	root, err := ioutil.TempDir("", "caps-archive-test-")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	defer os.RemoveAll(root) // ignore error
+
+	imageDir := filepath.Join(root, "images")
+	g.Expect(os.MkdirAll(filepath.Join(imageDir, "ubuntu"), 0755)).To(gomega.Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(imageDir, "ubuntu", "k8s.img"), []byte("image"), 0644)).To(gomega.Succeed())
+	g.Expect(ioutil.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644)).To(gomega.Succeed())
+	g.Expect(os.Symlink(filepath.Join(root, "secret"), filepath.Join(imageDir, "link.img"))).To(gomega.Succeed())
+
+	open := func(sources *ArchiveSourceOptions, path string) (string, error) {
+		client := &archiveClient{sources: sources}
+		file, err := client.openArchiveSource(context.Background(), &infrav1.ArchiveSource{Path: path})
+		if err != nil {
+			return "", err
+		}
+		defer file.Close() // ignore error
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadAll(file)
+		return string(data), err
+	}
+
+	allowed := &ArchiveSourceOptions{ImageDir: imageDir}
+	data, err := open(allowed, "ubuntu/k8s.img")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(data).To(gomega.Equal("image"))
+
+	// paths leading outside the image directory
+	for _, path := range []string{
+		filepath.Join(root, "secret"),
+		"../secret",
+		"ubuntu/../../secret",
+		"link.img",
+	} {
+		_, err := open(allowed, path)
+		g.Expect(err).To(gomega.HaveOccurred(), path)
+	}
+
+	// no image directory is configured
+	_, err = open(&ArchiveSourceOptions{}, "ubuntu/k8s.img")
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestOpenArchiveSourceURL(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/k8s.img", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("image")) // ignore error
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	open := func(sources *ArchiveSourceOptions, rawURL string) (string, error) {
+		client := &archiveClient{sources: sources, httpClient: newDownloadClient(http.DefaultTransport, sources)}
+		file, err := client.openArchiveSource(context.Background(), &infrav1.ArchiveSource{URL: rawURL})
+		if err != nil {
+			return "", err
+		}
+		defer file.Close() // ignore error
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadAll(file)
+		return string(data), err
+	}
+
+	allowed := &ArchiveSourceOptions{URLSchemes: []string{"http"}, URLHosts: []string{serverURL.Hostname()}}
+	data, err := open(allowed, server.URL+"/k8s.img")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(data).To(gomega.Equal("image"))
+
+	// redirected to a host which is not allowed
+	_, err = open(allowed, server.URL+"/redirect")
+	g.Expect(err).To(gomega.MatchError(gomega.ContainSubstring(`host "169.254.169.254" is not allowed`)))
+
+	// scheme which is not allowed
+	_, err = open(&ArchiveSourceOptions{URLSchemes: []string{"https"}, URLHosts: []string{serverURL.Hostname()}}, server.URL+"/k8s.img")
+	g.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("is not allowed")))
+	_, err = open(allowed, "file:///etc/passwd")
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	// no host is allowed
+	_, err = open(&ArchiveSourceOptions{URLSchemes: []string{"http"}}, server.URL+"/k8s.img")
+	g.Expect(err).To(gomega.MatchError(gomega.ContainSubstring("is not allowed")))
+
+	// both or none of url and path
+	_, err = (&archiveClient{sources: allowed}).openArchiveSource(context.Background(), &infrav1.ArchiveSource{URL: server.URL, Path: "k8s.img"})
+	g.Expect(err).To(gomega.HaveOccurred())
+	_, err = (&archiveClient{sources: allowed}).openArchiveSource(context.Background(), &infrav1.ArchiveSource{})
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestImportArchiveZones(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	ctx := context.Background()
+	client := &archiveClient{jobs: &jobRegistry{}}
+	param := &ArchiveImportParameter{Name: "ubuntu", NameSpace: "default"}
+	tags := archiveTags(param.Name, param.NameSpace, nil)
+
+	// the archive imported by the previous attempt in the first zone
+	imported := newFakeZone()
+	archive, err := client.archiveOp().Create(ctx, imported, &sacloud.ArchiveCreateRequest{Name: "caps-ubuntu", Tags: tags})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	_, err = sacloud.WaiterForReady(func() (interface{}, error) {
+		return client.archiveOp().Read(ctx, imported, archive.ID)
+	}).WaitForState(ctx)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	// the archive left by the upload interrupted in the second zone
+	interrupted := newFakeZone()
+	_, _, err = client.archiveOp().CreateBlank(ctx, interrupted, &sacloud.ArchiveCreateBlankRequest{Name: "caps-ubuntu", SizeMB: 20 * 1024, Tags: tags})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	// available archives are reused without uploading the image again
+	reused, err := client.importArchive(ctx, imported, param, nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(reused.ID).To(gomega.Equal(archive.ID))
+
+	// the archives are deleted from all zones, including the ones being uploaded
+	g.Expect(client.DeleteArchives(ctx, []string{imported, interrupted}, param.Name, param.NameSpace)).To(gomega.Succeed())
+	for _, zone := range []string{imported, interrupted} {
+		archives, err := client.findImportedArchives(ctx, zone, param.Name, param.NameSpace)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(archives).To(gomega.BeEmpty(), zone)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestBuildArchiveFindCondition(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	condition, prefixes, err := buildArchiveFindCondition(&infrav1.SourceArchiveReference{
+		SakuraCloudResourceReference: infrav1.SakuraCloudResourceReference{
+			Filters: []infrav1.Filter{
+				{Name: "Name", Values: []string{"k8s-node-"}, MatchType: infrav1.FilterMatchTypePrefix},
+				{Name: "Tags", Values: []string{"k8s"}},
+			},
+		},
+		OSType: "ubuntu",
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(prefixes).To(gomega.Equal([]string{"k8s-node-"}))
+	g.Expect(condition.Filter[search.Key(keys.Name)]).To(gomega.Equal(search.PartialMatch("k8s-node-")))
+	g.Expect(condition.Filter[search.Key(keys.Tags)]).To(gomega.Equal(search.TagsAndEqual("current-stable", "distro-ubuntu", "k8s")))
+
+	// narrowed to the Kubernetes version of the Machine
+	ref := &infrav1.SourceArchiveReference{
+		SakuraCloudResourceReference: infrav1.SakuraCloudResourceReference{
+			Filters: []infrav1.Filter{{Name: "Tags", Values: []string{"k8s"}}},
+		},
+		MatchKubernetesVersion: true,
+	}
+	condition, _, err = buildArchiveFindCondition(ArchiveReferenceForKubernetesVersion(ref, "v1.16.2"))
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(condition.Filter[search.Key(keys.Tags)]).To(gomega.Equal(search.TagsAndEqual("k8s", "k8s-version=1.16.2")))
+	g.Expect(ref.Filters).To(gomega.HaveLen(1))
+
+	_, _, err = buildArchiveFindCondition(&infrav1.SourceArchiveReference{OSType: "unknown"})
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	_, _, err = buildArchiveFindCondition(&infrav1.SourceArchiveReference{
+		SakuraCloudResourceReference: infrav1.SakuraCloudResourceReference{
+			Filters: []infrav1.Filter{{Name: "Tags", Values: []string{"k8s"}, MatchType: infrav1.FilterMatchTypePrefix}},
+		},
+	})
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	_, _, err = buildArchiveFindCondition(&infrav1.SourceArchiveReference{
+		SakuraCloudResourceReference: infrav1.SakuraCloudResourceReference{
+			Filters: []infrav1.Filter{{Name: "Tags", Values: []string{"k8s"}, MatchType: infrav1.FilterMatchTypePartial}},
+		},
+	})
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	_, _, err = buildArchiveFindCondition(&infrav1.SourceArchiveReference{
+		SakuraCloudResourceReference: infrav1.SakuraCloudResourceReference{
+			Filters: []infrav1.Filter{{Name: "Tags", Values: []string{"k8s"}, MatchType: infrav1.FilterMatchTypeExact}},
+		},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	_, _, err = buildArchiveFindCondition(&infrav1.SourceArchiveReference{
+		SakuraCloudResourceReference: infrav1.SakuraCloudResourceReference{
+			Filters: []infrav1.Filter{{Name: "Description", Values: []string{"k8s"}, MatchType: infrav1.FilterMatchTypePrefix}},
+		},
+	})
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestSelectArchive(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	now := time.Now()
+	archives := []*sacloud.Archive{
+		{ID: 1, Name: "k8s-node-1.15", CreatedAt: now.Add(-time.Hour)},
+		{ID: 2, Name: "k8s-node-1.16", CreatedAt: now},
+		{ID: 3, Name: "my-k8s-node-1.16", CreatedAt: now.Add(time.Hour)},
+	}
+
+	archive, err := selectArchive(nil, nil, infrav1.ArchiveSelectionUnique)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(archive).To(gomega.BeNil())
+
+	archive, err = selectArchive(archives[:1], nil, infrav1.ArchiveSelectionUnique)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(archive.ID.Int64()).To(gomega.Equal(int64(1)))
+
+	_, err = selectArchive(archives, []string{"k8s-node-"}, infrav1.ArchiveSelectionUnique)
+	g.Expect(err).To(gomega.BeAssignableToTypeOf(&AmbiguousArchiveError{}))
+
+	archive, err = selectArchive(archives, []string{"k8s-node-"}, infrav1.ArchiveSelectionNewest)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(archive.ID.Int64()).To(gomega.Equal(int64(2)))
+}
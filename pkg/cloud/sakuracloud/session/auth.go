@@ -0,0 +1,56 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+// authClient reads the account and the permission of the API key.
+// The results are not cached here because the permission of the API key can be changed
+// while the controller is running. The callers cache them in the status of the clusters.
+type authClient struct {
+	caller sacloud.APICaller
+}
+
+// AuthStatus returns the account and the permission of the API key
+func (a *authClient) AuthStatus(ctx context.Context) (*sacloud.AuthStatus, error) {
+	return sacloud.NewAuthStatusOp(a.caller).Read(ctx)
+}
+
+// CheckZoneAccess returns an error if the API key isn't allowed to access the zone.
+// Use IsAccessDeniedError to distinguish denied access from the other errors.
+func (a *authClient) CheckZoneAccess(ctx context.Context, zone string) error {
+	_, err := sacloud.NewServerOp(a.caller).Find(ctx, zone, &sacloud.FindCondition{Count: 1})
+	return err
+}
+
+// CanProvision returns true if the permission allows to create and delete the resources
+func CanProvision(permission sacloudtypes.EPermission) bool {
+	return permission == sacloudtypes.Permissions.Create
+}
+
+// IsAccessDeniedError returns true if the API rejected the request because of the credentials or the permission
+func IsAccessDeniedError(err error) bool {
+	if apiError, ok := err.(sacloud.APIError); ok {
+		return apiError.ResponseCode() == http.StatusUnauthorized || apiError.ResponseCode() == http.StatusForbidden
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+func TestIsAccessDeniedError(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(IsAccessDeniedError(sacloud.NewAPIError(http.MethodGet, nil, "", http.StatusUnauthorized, nil))).To(gomega.BeTrue())
+	g.Expect(IsAccessDeniedError(sacloud.NewAPIError(http.MethodGet, nil, "", http.StatusForbidden, nil))).To(gomega.BeTrue())
+	g.Expect(IsAccessDeniedError(sacloud.NewAPIError(http.MethodGet, nil, "", http.StatusServiceUnavailable, nil))).To(gomega.BeFalse())
+	g.Expect(IsAccessDeniedError(errors.New("connection refused"))).To(gomega.BeFalse())
+
+	g.Expect(CanProvision(sacloudtypes.Permissions.Create)).To(gomega.BeTrue())
+	g.Expect(CanProvision(sacloudtypes.Permissions.View)).To(gomega.BeFalse())
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+const (
+	defaultBackupRetention = 3
+	backupDiskTagPrefix    = "backup-of-disk="
+)
+
+type ServerBackupParameter struct {
+	ServerName  string
+	ClusterName string
+	NameSpace   string
+	// Disks is the names of the disks backed up, all disks if empty
+	Disks []string
+	// Retention is the number of the backups kept for each disk
+	Retention int
+}
+
+// DiskBackup is an archive holding a backup of a disk of the server
+type DiskBackup struct {
+	*sacloud.Archive
+	// DiskName is the name of the disk in the machine, boot or the name of the additional disk
+	DiskName string
+}
+
+// Backup creates archives of the disks of the server, and deletes the backups exceeding the retention
+func (s *serverClient) Backup(ctx context.Context, zone string, serverID sacloudtypes.ID, param *ServerBackupParameter) JobID {
+	jobID := JobID(fmt.Sprintf("backup/%s/%s", zone, serverID))
+	status := &JobStatus{
+		ID:    jobID,
+		Type:  JobTypeBackingUp,
+		State: JobStatePending,
+		Reference: &CloudObjectRef{
+			ServerID:       serverID,
+			DiskArchiveIDs: make(map[string]sacloudtypes.ID),
+		},
+	}
+	s.jobs.set(jobID, status)
+
+	s.jobs.run(status, func() {
+		status.setState(JobStateInFlight)
+
+		sv, err := s.serverOp().Read(ctx, zone, serverID)
+		if err != nil {
+			status.fail(err)
+			return
+		}
+
+		for _, disk := range sv.Disks {
+			name := machineDiskName(param.ServerName, disk.Name)
+			if !isSelectedDisk(param.Disks, name) {
+				continue
+			}
+			status.setProgress(fmt.Sprintf("backing up disk %s(%s)", disk.Name, disk.ID))
+			archive, err := s.backupDisk(ctx, zone, disk, name, param)
+			if err != nil {
+				// the backups of the other disks are deleted too, so that a failed run leaves no partial backup.
+				// The archives which can't be deleted now are deleted by pruneBackups later
+				for _, id := range status.Reference.DiskArchiveIDs {
+					s.archiveOp().Delete(ctx, zone, id) // ignore error
+				}
+				status.update(func(job *JobStatus) {
+					job.Reference.DiskArchiveIDs = make(map[string]sacloudtypes.ID)
+				})
+				status.fail(err)
+				return
+			}
+			status.update(func(job *JobStatus) {
+				job.Reference.DiskArchiveIDs[name] = archive.ID
+			})
+		}
+
+		status.setProgress("deleting old backups")
+		if err := s.pruneBackups(ctx, zone, param); err != nil {
+			status.fail(err)
+			return
+		}
+
+		status.setProgress("")
+		status.setState(JobStateDone)
+	})
+
+	return jobID
+}
+
+func (s *serverClient) backupDisk(ctx context.Context, zone string, disk *sacloud.ServerConnectedDisk, name string, param *ServerBackupParameter) (*sacloud.Archive, error) {
+	archive, err := s.archiveOp().Create(ctx, zone, &sacloud.ArchiveCreateRequest{
+		SourceDiskID: disk.ID,
+		Name:         fmt.Sprintf("%s-%s", disk.Name, time.Now().Format("20060102-150405")),
+		Description:  fmt.Sprintf("backup of %s/%s", param.NameSpace, param.ServerName),
+		Tags:         append(backupTags(param.ClusterName, param.NameSpace, param.ServerName), backupDiskTagPrefix+name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	available, err := sacloud.WaiterForReady(func() (interface{}, error) {
+		return s.archiveOp().Read(ctx, zone, archive.ID)
+	}).WaitForState(ctx)
+	if err != nil {
+		s.archiveOp().Delete(ctx, zone, archive.ID) // ignore error
+		return nil, err
+	}
+	return available.(*sacloud.Archive), nil
+}
+
+// pruneBackups deletes the oldest backups of each disk exceeding the retention
+func (s *serverClient) pruneBackups(ctx context.Context, zone string, param *ServerBackupParameter) error {
+	retention := param.Retention
+	if retention <= 0 {
+		retention = defaultBackupRetention
+	}
+
+	backups, err := s.FindBackups(ctx, zone, param.ClusterName, param.NameSpace, param.ServerName)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	// newest first
+	for i := len(backups) - 1; i >= 0; i-- {
+		backup := backups[i]
+		// the archives left by the failed backups are deleted regardless of the retention
+		if !backup.Availability.IsFailed() {
+			counts[backup.DiskName]++
+			if counts[backup.DiskName] <= retention {
+				continue
+			}
+		}
+		if err := s.archiveOp().Delete(ctx, zone, backup.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindBackups returns the backups of the disks of the server, oldest first
+func (s *serverClient) FindBackups(ctx context.Context, zone, clusterName, nameSpace, serverName string) ([]*DiskBackup, error) {
+	searched, err := s.archiveOp().Find(ctx, zone, &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Tags): search.TagsAndEqual(backupTags(clusterName, nameSpace, serverName)...),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []*DiskBackup
+	for _, archive := range searched.Archives {
+		backups = append(backups, &DiskBackup{Archive: archive, DiskName: backupDiskName(archive.Tags)})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.Before(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+// DeleteBackups deletes all backups of the disks of the server
+func (s *serverClient) DeleteBackups(ctx context.Context, zone, clusterName, nameSpace, serverName string) error {
+	backups, err := s.FindBackups(ctx, zone, clusterName, nameSpace, serverName)
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		if err := s.archiveOp().Delete(ctx, zone, backup.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupTags returns the tags which identify the backups of the server.
+// The backups have the cluster tags so that they are deleted with the cluster.
+func backupTags(clusterName, nameSpace, serverName string) sacloudtypes.Tags {
+	return append(clusterTags(clusterName, nameSpace), fmt.Sprintf("backup-of-machine=%s", serverName))
+}
+
+func backupDiskName(tags sacloudtypes.Tags) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, backupDiskTagPrefix) {
+			return strings.TrimPrefix(tag, backupDiskTagPrefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+func TestBackup(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	jobs := &jobRegistry{}
+	events := jobs.subscribe()
+	s := &serverClient{jobs: jobs}
+	param := &ServerBackupParameter{ServerName: "caps-example-md-0-a", ClusterName: "caps-example", NameSpace: "default", Retention: 1}
+
+	// a server with the boot disk and an additional disk
+	sv, err := s.serverOp().Create(ctx, zone, &sacloud.ServerCreateRequest{Name: param.ServerName, CPU: 2, MemoryMB: 4096})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	var dataDiskID sacloudtypes.ID
+	for _, name := range []string{param.ServerName, param.ServerName + "-data"} {
+		disk, err := s.diskOp().Create(ctx, zone, &sacloud.DiskCreateRequest{Name: name, SizeMB: 20 * 1024}, nil)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(s.diskOp().ConnectToServer(ctx, zone, disk.ID, sv.ID)).To(gomega.Succeed())
+		dataDiskID = disk.ID
+	}
+
+	// the backups exceeding the retention are deleted
+	for i := 0; i < 2; i++ {
+		jobID := s.Backup(ctx, zone, sv.ID, param)
+		g.Eventually(events, "5s").Should(gomega.Receive(gomega.Equal(JobEvent{ID: jobID, State: JobStateDone})))
+		jobs.delete(jobID)
+	}
+	backups, err := s.FindBackups(ctx, zone, param.ClusterName, param.NameSpace, param.ServerName)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(backups).To(gomega.HaveLen(2))
+	g.Expect([]string{backups[0].DiskName, backups[1].DiskName}).To(gomega.ConsistOf("boot", "data"))
+
+	// a failed run leaves no partial backup
+	sacloud.SetClientFactoryFunc(fake.ResourceArchive, func(sacloud.APICaller) interface{} {
+		return &failingArchiveOp{ArchiveAPI: fake.NewArchiveOp(), sourceDiskID: dataDiskID}
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceArchive, func(sacloud.APICaller) interface{} {
+		return fake.NewArchiveOp()
+	})
+	jobID := s.Backup(ctx, zone, sv.ID, param)
+	g.Eventually(events, "5s").Should(gomega.Receive(gomega.Equal(JobEvent{ID: jobID, State: JobStateFailed})))
+	failed, err := s.FindBackups(ctx, zone, param.ClusterName, param.NameSpace, param.ServerName)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(failed).To(gomega.Equal(backups))
+}
+
+// failingArchiveOp fails to create the archives of the disk
+type failingArchiveOp struct {
+	sacloud.ArchiveAPI
+	sourceDiskID sacloudtypes.ID
+}
+
+func (o *failingArchiveOp) Create(ctx context.Context, zone string, param *sacloud.ArchiveCreateRequest) (*sacloud.Archive, error) {
+	if param.SourceDiskID == o.sourceDiskID {
+		return nil, errors.New("failed to create archive")
+	}
+	return o.ArchiveAPI.Create(ctx, zone, param)
+}
@@ -17,8 +17,12 @@ package session
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
 	"github.com/sacloud/cluster-api-provider-sakuracloud/version"
@@ -27,45 +31,165 @@ import (
 
 type Client struct {
 	ServerAPI
-	jobs *jobRegistry
+	ClusterAPI
+	ArchiveAPI
+	AuthAPI
+	DNSAPI
+	jobs   *jobRegistry
+	queue  *provisionQueue
+	prices *PriceTable
 }
 
-func NewClient() *Client {
+// ClientOptions is the settings of the SakuraCloud API client
+type ClientOptions struct {
+	// RootURL overrides the root URL of the API
+	RootURL string
+	// ProxyURL is the URL of the HTTP proxy. If empty, the proxy environment variables are used
+	ProxyURL string
+	// Timeout is the timeout of each request
+	Timeout time.Duration
+	// RetryMax and RetryInterval are the retries of the requests failed because the API is busy
+	RetryMax      int
+	RetryInterval time.Duration
+	// RateLimitPerSec is the maximum number of requests per second. 0 or less means no limit
+	RateLimitPerSec int
+	AcceptLanguage  string
+	// MaxConcurrentProvisions is the maximum number of servers provisioned at once in each zone.
+	// 0 means no limit
+	MaxConcurrentProvisions int
+	// PriceTable is the prices used to estimate the cost of the resources.
+	// If nil, DefaultPriceTable is used
+	PriceTable *PriceTable
+	// Quota is the limits of the resources of the account checked before provisioning servers
+	Quota ResourceQuota
+	// ArchiveSources restricts the images uploaded by SakuraCloudArchives
+	ArchiveSources ArchiveSourceOptions
+}
+
+func NewClient(opts *ClientOptions) (*Client, error) {
 	ua := fmt.Sprintf("cluster-api-provider-sakuracloud/v%s (%s)", version.Version, infrav1.GroupVersion.String())
 
-	caller := &sacloud.Client{
-		AccessToken:            os.Getenv("SAKURACLOUD_ACCESS_TOKEN"),
-		AccessTokenSecret:      os.Getenv("SAKURACLOUD_ACCESS_TOKEN_SECRET"),
-		DefaultTimeoutDuration: sacloud.APIDefaultTimeoutDuration,
-		UserAgent:              ua,
-		AcceptLanguage:         sacloud.APIDefaultAcceptLanguage,
-		RetryMax:               sacloud.APIDefaultRetryMax,
-		RetryInterval:          sacloud.APIDefaultRetryInterval,
-		HTTPClient:             http.DefaultClient,
+	if opts.RootURL != "" {
+		// libsacloud reads the root URL from the package variable
+		sacloud.SakuraCloudAPIRoot = strings.TrimRight(opts.RootURL, "/")
 	}
 
-	caller.HTTPClient.Transport = &sacloud.RateLimitRoundTripper{
-		Transport:       caller.HTTPClient.Transport,
-		RateLimitPerSec: 3,
+	transport, err := newTransport(opts.ProxyURL)
+	if err != nil {
+		return nil, err
 	}
 
+	apiTransport := rateLimitedTransport(transport, opts.RateLimitPerSec)
 	if os.Getenv("SAKURACLOUD_TRACE") != "" {
-		caller.HTTPClient.Transport = &sacloud.TracingRoundTripper{
-			Transport: caller.HTTPClient.Transport,
+		apiTransport = &sacloud.TracingRoundTripper{
+			Transport: apiTransport,
 		}
 	}
 
+	caller := &sacloud.Client{
+		AccessToken:            os.Getenv("SAKURACLOUD_ACCESS_TOKEN"),
+		AccessTokenSecret:      os.Getenv("SAKURACLOUD_ACCESS_TOKEN_SECRET"),
+		DefaultTimeoutDuration: opts.Timeout,
+		UserAgent:              ua,
+		AcceptLanguage:         opts.AcceptLanguage,
+		RetryMax:               opts.RetryMax,
+		RetryInterval:          opts.RetryInterval,
+		HTTPClient: &http.Client{
+			Transport: apiTransport,
+			Timeout:   opts.Timeout,
+		},
+	}
+
+	// images are downloaded without the rate limit and the timeout of the API requests
+	sources := opts.ArchiveSources
+	downloadClient := newDownloadClient(transport, &sources)
+
 	jobs := &jobRegistry{}
+	queue := newProvisionQueue(opts.MaxConcurrentProvisions)
+	prices := opts.PriceTable
+	if prices == nil {
+		prices = &DefaultPriceTable
+	}
 	return &Client{
-		ServerAPI: &serverClient{caller: caller, jobs: jobs},
-		jobs:      jobs,
+		ServerAPI:  &serverClient{caller: caller, jobs: jobs, queue: queue, quota: &opts.Quota, reservations: newQuotaReservations()},
+		ClusterAPI: &clusterClient{caller: caller, jobs: jobs},
+		ArchiveAPI: &archiveClient{caller: caller, jobs: jobs, httpClient: downloadClient, sources: &sources},
+		AuthAPI:    &authClient{caller: caller},
+		DNSAPI:     &dnsClient{caller: caller},
+		jobs:       jobs,
+		queue:      queue,
+		prices:     prices,
+	}, nil
+}
+
+// rateLimitedTransport returns the transport limiting the requests per second.
+// RateLimitRoundTripper panics with a rate limit less than 1, which is treated as unlimited.
+func rateLimitedTransport(transport http.RoundTripper, rateLimitPerSec int) http.RoundTripper {
+	if rateLimitPerSec <= 0 {
+		return transport
 	}
+	return &sacloud.RateLimitRoundTripper{
+		Transport:       transport,
+		RateLimitPerSec: rateLimitPerSec,
+	}
+}
+
+// newTransport returns a transport with the same settings as http.DefaultTransport except for the proxy
+func newTransport(proxyURL string) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %s", proxyURL, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
 }
 
+// JobByID returns a snapshot of the job, or nil if the job isn't found
 func (c *Client) JobByID(id string) *JobStatus {
-	return c.jobs.get(JobID(id))
+	status := c.jobs.get(JobID(id))
+	if status == nil {
+		return nil
+	}
+	return status.snapshot()
 }
 
+// DeleteJob removes the job, canceling it if it's waiting to start
 func (c *Client) DeleteJob(id string) {
 	c.jobs.delete(JobID(id))
 }
+
+// CancelJob cancels the job if it's waiting to start, e.g. in the provisioning queue.
+// It returns false if the job is running, which must be waited for.
+func (c *Client) CancelJob(id string) bool {
+	return c.jobs.cancel(JobID(id))
+}
+
+// SubscribeJobs returns a channel receiving the state transitions of the jobs
+func (c *Client) SubscribeJobs() <-chan JobEvent {
+	return c.jobs.subscribe()
+}
+
+// ProvisioningQueuePosition returns the 1-based position of the provisioning job in the queue of the zone,
+// or 0 if it isn't waiting
+func (c *Client) ProvisioningQueuePosition(zone, jobID string) int {
+	return c.queue.position(zone, JobID(jobID))
+}
+
+// ProvisioningQueueDepth returns the number of the servers waiting and being provisioned in the zone
+func (c *Client) ProvisioningQueueDepth(zone string) (waiting, running int) {
+	return c.queue.depth(zone)
+}
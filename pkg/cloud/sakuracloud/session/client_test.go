@@ -0,0 +1,59 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+)
+
+func TestNewTransport(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	transport, err := newTransport("http://proxy.example.com:3128")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	req, err := http.NewRequest(http.MethodGet, "https://secure.sakura.ad.jp/cloud/zone/is1a/api/cloud/1.1/server", nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	proxy, err := transport.Proxy(req)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(proxy.String()).To(gomega.Equal("http://proxy.example.com:3128"))
+
+	_, err = newTransport("://proxy.example.com")
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestRateLimitedTransport(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	transport, err := newTransport("")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	limited := rateLimitedTransport(transport, 3)
+	g.Expect(limited).To(gomega.BeAssignableToTypeOf(&sacloud.RateLimitRoundTripper{}))
+
+	// no limit instead of the panic of the rate limiter
+	g.Expect(rateLimitedTransport(transport, 0)).To(gomega.BeIdenticalTo(transport))
+	g.Expect(rateLimitedTransport(transport, -1)).To(gomega.BeIdenticalTo(transport))
+	g.Expect(func() {
+		_, err := NewClient(&ClientOptions{RateLimitPerSec: 0})
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+	}).NotTo(gomega.Panic())
+}
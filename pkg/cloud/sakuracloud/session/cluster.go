@@ -0,0 +1,259 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+type clusterClient struct {
+	caller sacloud.APICaller
+	jobs   *jobRegistry
+}
+
+func (c *clusterClient) serverOp() sacloud.ServerAPI {
+	return sacloud.NewServerOp(c.caller)
+}
+
+func (c *clusterClient) diskOp() sacloud.DiskAPI {
+	return sacloud.NewDiskOp(c.caller)
+}
+
+func (c *clusterClient) switchOp() sacloud.SwitchAPI {
+	return sacloud.NewSwitchOp(c.caller)
+}
+
+func (c *clusterClient) loadBalancerOp() sacloud.LoadBalancerAPI {
+	return sacloud.NewLoadBalancerOp(c.caller)
+}
+
+func (c *clusterClient) isoImageOp() sacloud.CDROMAPI {
+	return sacloud.NewCDROMOp(c.caller)
+}
+
+func (c *clusterClient) archiveOp() sacloud.ArchiveAPI {
+	return sacloud.NewArchiveOp(c.caller)
+}
+
+func (c *clusterClient) interfaceOp() sacloud.InterfaceAPI {
+	return sacloud.NewInterfaceOp(c.caller)
+}
+
+func (c *clusterClient) packetFilterOp() sacloud.PacketFilterAPI {
+	return sacloud.NewPacketFilterOp(c.caller)
+}
+
+func (c *clusterClient) FindClusterResources(ctx context.Context, zone, clusterName, nameSpace string) (*ClusterResources, error) {
+	condition := &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Tags): search.TagsAndEqual(clusterTags(clusterName, nameSpace)...),
+		},
+	}
+	resources := &ClusterResources{}
+
+	servers, err := c.serverOp().Find(ctx, zone, condition)
+	if err != nil {
+		return nil, err
+	}
+	resources.Servers = servers.Servers
+
+	disks, err := c.diskOp().Find(ctx, zone, condition)
+	if err != nil {
+		return nil, err
+	}
+	resources.Disks = disks.Disks
+
+	switches, err := c.switchOp().Find(ctx, zone, condition)
+	if err != nil {
+		return nil, err
+	}
+	resources.Switches = switches.Switches
+
+	loadBalancers, err := c.loadBalancerOp().Find(ctx, zone, condition)
+	if err != nil {
+		return nil, err
+	}
+	resources.LoadBalancers = loadBalancers.LoadBalancers
+
+	isoImages, err := c.isoImageOp().Find(ctx, zone, condition)
+	if err != nil {
+		return nil, err
+	}
+	resources.ISOImages = isoImages.CDROMs
+
+	// backups of the disks
+	archives, err := c.archiveOp().Find(ctx, zone, condition)
+	if err != nil {
+		return nil, err
+	}
+	resources.Archives = archives.Archives
+
+	// packet filters can't have tags, so they are looked up by name
+	packetFilter, err := c.findPacketFilter(ctx, zone, clusterResourceName(clusterName, nameSpace))
+	if err != nil {
+		return nil, err
+	}
+	if packetFilter != nil {
+		resources.PacketFilters = append(resources.PacketFilters, packetFilter)
+	}
+
+	return resources, nil
+}
+
+func (c *clusterClient) CleanupCluster(ctx context.Context, zones []string, clusterName, nameSpace string, shutdownTimeout time.Duration) JobID {
+	jobID := JobID(fmt.Sprintf("cleanup-cluster/%s/%s", nameSpace, clusterName))
+	status := &JobStatus{
+		ID:    jobID,
+		Type:  JobTypeClusterCleaning,
+		State: JobStatePending,
+	}
+	c.jobs.set(jobID, status)
+
+	c.jobs.run(status, func() {
+		status.setState(JobStateInFlight)
+
+		for _, zone := range zones {
+			if err := c.cleanupZone(ctx, zone, clusterName, nameSpace, shutdownTimeout, status); err != nil {
+				status.fail(err)
+				return
+			}
+		}
+
+		status.setProgress("")
+		status.setState(JobStateDone)
+	})
+
+	return jobID
+}
+
+func (c *clusterClient) cleanupZone(ctx context.Context, zone, clusterName, nameSpace string, shutdownTimeout time.Duration, status *JobStatus) error {
+	resources, err := c.FindClusterResources(ctx, zone, clusterName, nameSpace)
+	if err != nil {
+		return err
+	}
+
+	// servers left behind by SakuraCloudMachines
+	for _, sv := range resources.Servers {
+		status.setProgress(fmt.Sprintf("deleting server %s(%s) in %s", sv.Name, sv.ID, zone))
+		if err := c.deleteServer(ctx, zone, sv, shutdownTimeout); err != nil {
+			return err
+		}
+	}
+
+	// disks which are not connected to any server, e.g. left by failed provisioning
+	for _, disk := range resources.Disks {
+		if !disk.ServerID.IsEmpty() {
+			continue // deleted with the server
+		}
+		status.setProgress(fmt.Sprintf("deleting disk %s(%s) in %s", disk.Name, disk.ID, zone))
+		if err := c.diskOp().Delete(ctx, zone, disk.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+
+	// load balancers must be deleted before the switches they are connected to
+	for _, lb := range resources.LoadBalancers {
+		status.setProgress(fmt.Sprintf("deleting load balancer %s(%s) in %s", lb.Name, lb.ID, zone))
+		if err := c.deleteLoadBalancer(ctx, zone, lb); err != nil {
+			return err
+		}
+	}
+
+	for _, sw := range resources.Switches {
+		status.setProgress(fmt.Sprintf("deleting switch %s(%s) in %s", sw.Name, sw.ID, zone))
+		if err := c.switchOp().Delete(ctx, zone, sw.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+
+	for _, isoImage := range resources.ISOImages {
+		status.setProgress(fmt.Sprintf("deleting ISO image %s(%s) in %s", isoImage.Name, isoImage.ID, zone))
+		if err := c.isoImageOp().Delete(ctx, zone, isoImage.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+
+	for _, archive := range resources.Archives {
+		status.setProgress(fmt.Sprintf("deleting archive %s(%s) in %s", archive.Name, archive.ID, zone))
+		if err := c.archiveOp().Delete(ctx, zone, archive.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+
+	for _, pf := range resources.PacketFilters {
+		status.setProgress(fmt.Sprintf("deleting packet filter %s(%s) in %s", pf.Name, pf.ID, zone))
+		if err := c.packetFilterOp().Delete(ctx, zone, pf.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteServer shuts down the server in the same way as the machines being deleted, and deletes it with its disks
+func (c *clusterClient) deleteServer(ctx context.Context, zone string, sv *sacloud.Server, shutdownTimeout time.Duration) error {
+	if sv.InstanceStatus.IsUp() {
+		servers := &serverClient{caller: c.caller}
+		if _, err := servers.shutdownWithTimeout(ctx, zone, sv.ID, shutdownTimeout); err != nil {
+			return err
+		}
+	}
+
+	var diskIDs []sacloudtypes.ID
+	for _, disk := range sv.Disks {
+		diskIDs = append(diskIDs, disk.ID)
+	}
+	if err := c.serverOp().DeleteWithDisks(ctx, zone, sv.ID, &sacloud.ServerDeleteWithDisksRequest{IDs: diskIDs}); err != nil && !sacloud.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *clusterClient) deleteLoadBalancer(ctx context.Context, zone string, lb *sacloud.LoadBalancer) error {
+	if lb.InstanceStatus.IsUp() {
+		if err := c.loadBalancerOp().Shutdown(ctx, zone, lb.ID, &sacloud.ShutdownOption{Force: true}); err != nil {
+			return err
+		}
+		if _, err := sacloud.WaiterForDown(func() (interface{}, error) {
+			return c.loadBalancerOp().Read(ctx, zone, lb.ID)
+		}).WaitForState(ctx); err != nil {
+			return err
+		}
+	}
+	if err := c.loadBalancerOp().Delete(ctx, zone, lb.ID); err != nil && !sacloud.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// clusterTags returns the tags which identify resources owned by the cluster.
+func clusterTags(clusterName, nameSpace string) sacloudtypes.Tags {
+	return sacloudtypes.Tags{
+		fmt.Sprintf("cluster=%s", clusterName),
+		fmt.Sprintf("ns=%s", nameSpace),
+	}
+}
+
+// clusterResourceName returns the name of cluster-scoped resources which can't have tags.
+func clusterResourceName(clusterName, nameSpace string) string {
+	return fmt.Sprintf("caps-%s-%s", nameSpace, clusterName)
+}
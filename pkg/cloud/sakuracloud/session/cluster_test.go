@@ -0,0 +1,85 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+)
+
+func TestCleanupCluster(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// the servers are shut down gracefully
+	op := &shutdownRecordingServerOp{ServerAPI: fake.NewServerOp()}
+	sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return op
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return fake.NewServerOp()
+	})
+
+	ctx := context.Background()
+	zones := []string{newFakeZone(), newFakeZone()}
+	jobs := &jobRegistry{}
+	events := jobs.subscribe()
+	c := &clusterClient{jobs: jobs}
+	tags := clusterTags("caps-example", "default")
+
+	for _, zone := range zones {
+		// a running server with its disk
+		sv, err := c.serverOp().Create(ctx, zone, &sacloud.ServerCreateRequest{Name: "caps-example-controlplane-0", CPU: 2, MemoryMB: 4096, Tags: tags})
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		disk, err := c.diskOp().Create(ctx, zone, &sacloud.DiskCreateRequest{Name: "caps-example-controlplane-0", SizeMB: 20 * 1024, Tags: tags}, nil)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(c.diskOp().ConnectToServer(ctx, zone, disk.ID, sv.ID)).To(gomega.Succeed())
+		g.Expect(c.serverOp().Boot(ctx, zone, sv.ID)).To(gomega.Succeed())
+		g.Eventually(func() bool {
+			sv, err := c.serverOp().Read(ctx, zone, sv.ID)
+			return err == nil && sv.InstanceStatus.IsUp()
+		}).Should(gomega.BeTrue())
+
+		// a disk left by failed provisioning, an ISO image, a backup and the packet filter
+		_, err = c.diskOp().Create(ctx, zone, &sacloud.DiskCreateRequest{Name: "caps-example-md-0-xxxxx", SizeMB: 20 * 1024, Tags: tags}, nil)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		_, _, err = c.isoImageOp().Create(ctx, zone, &sacloud.CDROMCreateRequest{Name: "caps-example-controlplane-0", SizeMB: 5 * 1024, Tags: tags})
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		_, _, err = c.archiveOp().CreateBlank(ctx, zone, &sacloud.ArchiveCreateBlankRequest{Name: "caps-example-controlplane-0-boot", SizeMB: 20 * 1024, Tags: tags})
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		_, err = c.packetFilterOp().Create(ctx, zone, &sacloud.PacketFilterCreateRequest{Name: clusterResourceName("caps-example", "default")})
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+
+		resources, err := c.FindClusterResources(ctx, zone, "caps-example", "default")
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(resources.Count()).To(gomega.Equal(6))
+	}
+
+	jobID := c.CleanupCluster(ctx, zones, "caps-example", "default", time.Second)
+	g.Eventually(events, "5s").Should(gomega.Receive(gomega.Equal(JobEvent{ID: jobID, State: JobStateDone})))
+	g.Expect(op.takeRequests()).To(gomega.Equal([]bool{false, false}))
+
+	for _, zone := range zones {
+		resources, err := c.FindClusterResources(ctx, zone, "caps-example", "default")
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(resources.Count()).To(gomega.BeZero())
+	}
+}
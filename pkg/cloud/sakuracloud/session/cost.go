@@ -0,0 +1,166 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+// isoImageSizeGB is the size of the ISO images created to hold the cloud-init data of the servers
+const isoImageSizeGB = 5
+
+// the types of the resources in a cost estimate
+const (
+	CostTypeServer    = "server"
+	CostTypeDisk      = "disk"
+	CostTypeISOImage  = "isoImage"
+	CostTypeAppliance = "appliance"
+	CostTypeArchive   = "archive"
+)
+
+// Price is the hourly and monthly price in JPY
+type Price struct {
+	Hourly  float64 `json:"hourly"`
+	Monthly float64 `json:"monthly"`
+}
+
+func (p Price) times(n int) Price {
+	return Price{Hourly: p.Hourly * float64(n), Monthly: p.Monthly * float64(n)}
+}
+
+func (p Price) add(o Price) Price {
+	return Price{Hourly: p.Hourly + o.Hourly, Monthly: p.Monthly + o.Monthly}
+}
+
+// PriceTable is the unit prices used to estimate the cost of the resources
+type PriceTable struct {
+	ServerCore     Price `json:"serverCore"`
+	ServerMemoryGB Price `json:"serverMemoryGB"`
+	SSDDiskGB      Price `json:"ssdDiskGB"`
+	HDDDiskGB      Price `json:"hddDiskGB"`
+	ArchiveGB      Price `json:"archiveGB"`
+	ISOImageGB     Price `json:"isoImageGB"`
+	Switch         Price `json:"switch"`
+	LoadBalancer   Price `json:"loadBalancer"`
+	PacketFilter   Price `json:"packetFilter"`
+}
+
+// DefaultPriceTable is the prices used unless overridden by LoadPriceTable, excluding tax.
+// They are rough per-unit approximations written by hand, not the list prices: the servers have
+// prices per plan and the disks per plan and size, which the unit prices don't reproduce exactly.
+// The list prices are served by the ServiceClass API of libsacloud, but the servers, disks and archives
+// returned by this version of libsacloud don't have their service classes, so they can't be looked up.
+// Set the prices of the price list of SakuraCloud with --price-table-file for accurate estimates.
+var DefaultPriceTable = PriceTable{
+	ServerCore:     Price{Hourly: 8, Monthly: 1600},
+	ServerMemoryGB: Price{Hourly: 4, Monthly: 800},
+	SSDDiskGB:      Price{Hourly: 0.2, Monthly: 44},
+	HDDDiskGB:      Price{Hourly: 0.1, Monthly: 20},
+	ArchiveGB:      Price{Hourly: 0.2, Monthly: 44},
+	ISOImageGB:     Price{Hourly: 0.1, Monthly: 22},
+	Switch:         Price{Hourly: 3, Monthly: 2000},
+	LoadBalancer:   Price{Hourly: 30, Monthly: 20000},
+	PacketFilter:   Price{},
+}
+
+// LoadPriceTable reads the price table from the JSON file.
+// The prices missing in the file are taken from DefaultPriceTable.
+func LoadPriceTable(path string) (*PriceTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table := DefaultPriceTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// Cost is the estimated cost keyed by the type of the resources
+type Cost map[string]Price
+
+func (c Cost) add(costType string, price Price) {
+	c[costType] = c[costType].add(price)
+}
+
+// Merge adds the cost of other resources
+func (c Cost) Merge(o Cost) {
+	for costType, price := range o {
+		c.add(costType, price)
+	}
+}
+
+// Total returns the sum of the cost of all resources
+func (c Cost) Total() Price {
+	var total Price
+	for _, price := range c {
+		total = total.add(price)
+	}
+	return total
+}
+
+func (t *PriceTable) diskPrice(planID sacloudtypes.ID, sizeMB int) Price {
+	if planID == sacloudtypes.DiskPlans.HDD {
+		return t.HDDDiskGB.times(sizeMB / 1024)
+	}
+	return t.SSDDiskGB.times(sizeMB / 1024)
+}
+
+// EstimateServerCost estimates the cost of the server and its disks and ISO image.
+// isoImage is the ISO image inserted in the server, or nil if it isn't read,
+// in which case the size of the ISO images created for the servers is assumed.
+func (c *Client) EstimateServerCost(sv *sacloud.Server, isoImage *sacloud.CDROM) Cost {
+	t := c.prices
+	cost := Cost{}
+	cost.add(CostTypeServer, t.ServerCore.times(sv.CPU).add(t.ServerMemoryGB.times(sv.MemoryMB/1024)))
+	for _, disk := range sv.Disks {
+		cost.add(CostTypeDisk, t.diskPrice(disk.DiskPlanID, disk.SizeMB))
+	}
+	switch {
+	case isoImage != nil:
+		cost.add(CostTypeISOImage, t.ISOImageGB.times(isoImage.SizeMB/1024))
+	case !sv.CDROMID.IsEmpty():
+		cost.add(CostTypeISOImage, t.ISOImageGB.times(isoImageSizeGB))
+	}
+	return cost
+}
+
+// EstimateResourcesCost estimates the cost of the resources owned by a cluster
+func (c *Client) EstimateResourcesCost(r *ClusterResources) Cost {
+	t := c.prices
+	cost := Cost{}
+	for _, sv := range r.Servers {
+		cost.add(CostTypeServer, t.ServerCore.times(sv.CPU).add(t.ServerMemoryGB.times(sv.MemoryMB/1024)))
+	}
+	for _, disk := range r.Disks {
+		cost.add(CostTypeDisk, t.diskPrice(disk.DiskPlanID, disk.SizeMB))
+	}
+	for _, isoImage := range r.ISOImages {
+		cost.add(CostTypeISOImage, t.ISOImageGB.times(isoImage.SizeMB/1024))
+	}
+	for _, archive := range r.Archives {
+		cost.add(CostTypeArchive, t.ArchiveGB.times(archive.SizeMB/1024))
+	}
+	cost.add(CostTypeAppliance, t.Switch.times(len(r.Switches)))
+	cost.add(CostTypeAppliance, t.LoadBalancer.times(len(r.LoadBalancers)))
+	cost.add(CostTypeAppliance, t.PacketFilter.times(len(r.PacketFilters)))
+	return cost
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+func TestEstimateCost(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	c := &Client{prices: &PriceTable{
+		ServerCore:     Price{Hourly: 10, Monthly: 1000},
+		ServerMemoryGB: Price{Hourly: 5, Monthly: 500},
+		SSDDiskGB:      Price{Hourly: 0.5, Monthly: 50},
+		HDDDiskGB:      Price{Hourly: 0.1, Monthly: 10},
+		ISOImageGB:     Price{Hourly: 0.2, Monthly: 20},
+		Switch:         Price{Hourly: 3, Monthly: 300},
+	}}
+
+	sv := &sacloud.Server{
+		CPU:      2,
+		MemoryMB: 4 * 1024,
+		Disks: []*sacloud.ServerConnectedDisk{
+			{SizeMB: 20 * 1024, DiskPlanID: sacloudtypes.DiskPlans.SSD},
+			{SizeMB: 100 * 1024, DiskPlanID: sacloudtypes.DiskPlans.HDD},
+		},
+		CDROMID: 1,
+	}
+
+	// the size of the inserted ISO image is used
+	cost := c.EstimateServerCost(sv, &sacloud.CDROM{ID: 1, SizeMB: 10 * 1024})
+	g.Expect(cost[CostTypeISOImage]).To(gomega.Equal(Price{Hourly: 2, Monthly: 200}))
+
+	// the size of the ISO images created for the servers is assumed if the ISO image isn't read
+	cost = c.EstimateServerCost(sv, nil)
+	g.Expect(cost).To(gomega.Equal(Cost{
+		CostTypeServer:   {Hourly: 40, Monthly: 4000},
+		CostTypeDisk:     {Hourly: 20, Monthly: 2000},
+		CostTypeISOImage: {Hourly: 1, Monthly: 100},
+	}))
+
+	cost.Merge(c.EstimateResourcesCost(&ClusterResources{
+		Switches: []*sacloud.Switch{{}},
+	}))
+	g.Expect(cost[CostTypeAppliance]).To(gomega.Equal(Price{Hourly: 3, Monthly: 300}))
+	g.Expect(cost.Total()).To(gomega.Equal(Price{Hourly: 64, Monthly: 6400}))
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	f, err := ioutil.TempFile("", "caps-price-table-")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	defer os.Remove(f.Name()) // ignore error
+	_, err = f.WriteString(`{"serverCore": {"hourly": 1, "monthly": 100}}`)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(f.Close()).To(gomega.Succeed())
+
+	table, err := LoadPriceTable(f.Name())
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(table.ServerCore).To(gomega.Equal(Price{Hourly: 1, Monthly: 100}))
+	g.Expect(table.ServerMemoryGB).To(gomega.Equal(DefaultPriceTable.ServerMemoryGB))
+}
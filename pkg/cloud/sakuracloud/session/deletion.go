@@ -0,0 +1,173 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+// applyDeletionPolicy retains or archives the disks selected by the deletion policy,
+// and returns the IDs of the disks to delete with the server.
+func (s *serverClient) applyDeletionPolicy(ctx context.Context, zone string, sv *sacloud.Server, param *ServerCleanupParameter, status *JobStatus) ([]sacloudtypes.ID, error) {
+	var deleteIDs []sacloudtypes.ID
+	for _, disk := range sv.Disks {
+		name := machineDiskName(param.ServerName, disk.Name)
+		if param.DeletionPolicy == infrav1.DiskDeletionPolicyDelete || param.DeletionPolicy == "" ||
+			!isSelectedDisk(param.DeletionPolicyDisks, name) {
+			deleteIDs = append(deleteIDs, disk.ID)
+			continue
+		}
+
+		switch param.DeletionPolicy {
+		case infrav1.DiskDeletionPolicyRetain:
+			status.setProgress(fmt.Sprintf("retaining disk %s(%s)", disk.Name, disk.ID))
+			if err := s.retainDisk(ctx, zone, disk.ID, param); err != nil {
+				return nil, err
+			}
+			status.update(func(job *JobStatus) {
+				if job.Reference.RetainedDiskIDs == nil {
+					job.Reference.RetainedDiskIDs = make(map[string]sacloudtypes.ID)
+				}
+				job.Reference.RetainedDiskIDs[name] = disk.ID
+			})
+		case infrav1.DiskDeletionPolicyArchive:
+			status.setProgress(fmt.Sprintf("archiving disk %s(%s)", disk.Name, disk.ID))
+			archive, err := s.archiveDisk(ctx, zone, disk, param)
+			if err != nil {
+				return nil, err
+			}
+			status.update(func(job *JobStatus) {
+				if job.Reference.DiskArchiveIDs == nil {
+					job.Reference.DiskArchiveIDs = make(map[string]sacloudtypes.ID)
+				}
+				job.Reference.DiskArchiveIDs[name] = archive.ID
+			})
+			deleteIDs = append(deleteIDs, disk.ID)
+		default:
+			return nil, fmt.Errorf("unknown deletion policy: %s", param.DeletionPolicy)
+		}
+	}
+	return deleteIDs, nil
+}
+
+// retainDisk replaces the cluster tags of the disk so that it isn't deleted with the cluster.
+func (s *serverClient) retainDisk(ctx context.Context, zone string, diskID sacloudtypes.ID, param *ServerCleanupParameter) error {
+	disk, err := s.diskOp().Read(ctx, zone, diskID)
+	if err != nil {
+		return err
+	}
+	_, err = s.diskOp().Update(ctx, zone, diskID, &sacloud.DiskUpdateRequest{
+		Name:        disk.Name,
+		Description: disk.Description,
+		Tags:        retainedTags(param.ClusterName, param.NameSpace, param.ServerName, disk.Tags),
+		IconID:      disk.IconID,
+		Connection:  disk.Connection,
+	})
+	return err
+}
+
+// archiveDisk creates an archive of the disk, or returns the one created by the previous attempt.
+func (s *serverClient) archiveDisk(ctx context.Context, zone string, disk *sacloud.ServerConnectedDisk, param *ServerCleanupParameter) (*sacloud.Archive, error) {
+	tags := append(retainedTags(param.ClusterName, param.NameSpace, param.ServerName, nil),
+		fmt.Sprintf("source-disk=%s", disk.ID))
+
+	searched, err := s.archiveOp().Find(ctx, zone, &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Tags): search.TagsAndEqual(tags...),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, archive := range searched.Archives {
+		if archive.Availability.IsAvailable() {
+			return archive, nil
+		}
+	}
+
+	archive, err := s.archiveOp().Create(ctx, zone, &sacloud.ArchiveCreateRequest{
+		SourceDiskID: disk.ID,
+		Name:         disk.Name,
+		Description:  fmt.Sprintf("archived on deletion of %s/%s", param.NameSpace, param.ServerName),
+		Tags:         tags,
+	})
+	if err != nil {
+		return nil, err
+	}
+	available, err := sacloud.WaiterForReady(func() (interface{}, error) {
+		return s.archiveOp().Read(ctx, zone, archive.ID)
+	}).WaitForState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return available.(*sacloud.Archive), nil
+}
+
+// machineDiskName returns the name of the disk in the machine, boot or the name of the additional disk.
+func machineDiskName(serverName, diskName string) string {
+	if diskName == serverName {
+		return infrav1.BootDiskName
+	}
+	return strings.TrimPrefix(diskName, serverName+"-")
+}
+
+// isSelectedDisk returns true if the disk is in names, or names is empty
+func isSelectedDisk(names []string, name string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// retainedTags returns the tags of the resources retained by the deletion policy.
+// The cluster tags are replaced so that the resources aren't deleted with the cluster.
+func retainedTags(clusterName, nameSpace, serverName string, current sacloudtypes.Tags) sacloudtypes.Tags {
+	owned := clusterTags(clusterName, nameSpace)
+	tags := sacloudtypes.Tags{
+		fmt.Sprintf("retained-from-cluster=%s", clusterName),
+		fmt.Sprintf("retained-from-ns=%s", nameSpace),
+		fmt.Sprintf("retained-from-machine=%s", serverName),
+	}
+	for _, tag := range current {
+		if !containsTag(owned, tag) && !containsTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func containsTag(tags sacloudtypes.Tags, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+func TestMachineDiskName(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(machineDiskName("caps-example-controlplane-0", "caps-example-controlplane-0")).To(gomega.Equal("boot"))
+	g.Expect(machineDiskName("caps-example-controlplane-0", "caps-example-controlplane-0-etcd")).To(gomega.Equal("etcd"))
+
+	g.Expect(isSelectedDisk(nil, "boot")).To(gomega.BeTrue())
+	g.Expect(isSelectedDisk([]string{"etcd"}, "etcd")).To(gomega.BeTrue())
+	g.Expect(isSelectedDisk([]string{"etcd"}, "boot")).To(gomega.BeFalse())
+}
+
+func TestRetainedTags(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	tags := retainedTags("caps-example", "default", "caps-example-controlplane-0", sacloudtypes.Tags{
+		"cluster=caps-example", "ns=default", "control-plane=true", "zone=is1a", "etcd",
+	})
+	g.Expect(tags).To(gomega.Equal(sacloudtypes.Tags{
+		"retained-from-cluster=caps-example",
+		"retained-from-ns=default",
+		"retained-from-machine=caps-example-controlplane-0",
+		"control-plane=true",
+		"zone=is1a",
+		"etcd",
+	}))
+}
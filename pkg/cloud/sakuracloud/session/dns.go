@@ -0,0 +1,228 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+const defaultDNSRecordTTL = 60
+
+type dnsClient struct {
+	caller sacloud.APICaller
+}
+
+func (d *dnsClient) dnsOp() sacloud.DNSAPI {
+	return sacloud.NewDNSOp(d.caller)
+}
+
+// DNSRecordParameter is the A records of a name in a SakuraCloud DNS zone
+type DNSRecordParameter struct {
+	// Zone is the name of the DNS zone, e.g. example.com
+	Zone string
+	// Name is the name of the records relative to the zone
+	Name string
+	// Owner identifies the owner of the records, e.g. the namespace and the name of the cluster.
+	// The records are marked with a TXT record of the owner, and the records of the other owners are not changed
+	Owner string
+	// Adopt takes over the A records of the name not marked by any owner,
+	// e.g. the records created before the records were marked
+	Adopt bool
+	// Addresses is the IP addresses of the records. All records of the name are deleted if empty
+	Addresses []string
+	// TTL is the TTL of the records. Defaults to 60
+	TTL int
+}
+
+// DNSRecordConflictError is returned when the name already has A records not owned by the owner
+type DNSRecordConflictError struct {
+	Zone string
+	Name string
+}
+
+func (e *DNSRecordConflictError) Error() string {
+	return fmt.Sprintf("DNS records %s.%s are not owned by this cluster", e.Name, e.Zone)
+}
+
+// IsDNSRecordConflictError returns true if the error is a DNSRecordConflictError
+func IsDNSRecordConflictError(err error) bool {
+	_, ok := err.(*DNSRecordConflictError)
+	return ok
+}
+
+// ReconcileDNSRecords replaces the A records of the name with the addresses.
+// It returns a DNSRecordConflictError if the name has A records of the others.
+func (d *dnsClient) ReconcileDNSRecords(ctx context.Context, param *DNSRecordParameter) error {
+	dns, err := d.findDNSZone(ctx, param.Zone)
+	if err != nil {
+		return err
+	}
+	if dns == nil {
+		return fmt.Errorf("DNS zone %q is not found in SakuraCloud DNS", param.Zone)
+	}
+	return d.updateDNSRecords(ctx, dns, param)
+}
+
+// DeleteDNSRecords deletes the A records of the name owned by the owner.
+// The records are already deleted if the DNS zone is not found.
+func (d *dnsClient) DeleteDNSRecords(ctx context.Context, zone, name, owner string) error {
+	dns, err := d.findDNSZone(ctx, zone)
+	if err != nil || dns == nil {
+		return err
+	}
+	err = d.updateDNSRecords(ctx, dns, &DNSRecordParameter{Zone: zone, Name: name, Owner: owner, Adopt: true})
+	if sacloud.IsNotFoundError(err) {
+		// the DNS zone was deleted in the meantime
+		return nil
+	}
+	return err
+}
+
+func (d *dnsClient) updateDNSRecords(ctx context.Context, dns *sacloud.DNS, param *DNSRecordParameter) error {
+	ttl := param.TTL
+	if ttl == 0 {
+		ttl = defaultDNSRecordTTL
+	}
+	if !ownsDNSRecords(dns.Records, param.Name, param.Owner, param.Adopt) {
+		if len(param.Addresses) == 0 {
+			// nothing to delete
+			return nil
+		}
+		return &DNSRecordConflictError{Zone: param.Zone, Name: param.Name}
+	}
+	records := desiredDNSRecords(dns.Records, param.Name, param.Owner, param.Addresses, ttl)
+	if equalDNSRecords(dns.Records, records) {
+		return nil
+	}
+
+	// SettingsHash rejects the update if the records were changed by others in the meantime
+	_, err := d.dnsOp().Update(ctx, dns.ID, &sacloud.DNSUpdateRequest{
+		Description:  dns.Description,
+		Tags:         dns.Tags,
+		IconID:       dns.IconID,
+		Records:      records,
+		SettingsHash: dns.SettingsHash,
+	})
+	return err
+}
+
+// findDNSZone returns the DNS zone, or nil if it's not found
+func (d *dnsClient) findDNSZone(ctx context.Context, zone string) (*sacloud.DNS, error) {
+	searched, err := d.dnsOp().Find(ctx, &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Name): search.ExactMatch(zone),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, dns := range searched.DNS {
+		if dns.Name == zone {
+			return dns, nil
+		}
+	}
+	return nil, nil
+}
+
+// dnsOwnerRecordPrefix is the prefix of the TXT records marking the owner of the A records of the same name
+const dnsOwnerRecordPrefix = "heritage=cluster-api-provider-sakuracloud,owner="
+
+func dnsOwnerRecordData(owner string) string {
+	return dnsOwnerRecordPrefix + owner
+}
+
+// ownsDNSRecords returns true if the A records of the name are owned by the owner or the name has no A records.
+// If adopt is true, the A records not marked by any owner are also owned.
+func ownsDNSRecords(current []*sacloud.DNSRecord, name, owner string, adopt bool) bool {
+	hasRecords, marked := false, false
+	for _, record := range current {
+		if record.Name != name {
+			continue
+		}
+		switch {
+		case record.Type == sacloudtypes.DNSRecordTypes.A:
+			hasRecords = true
+		case record.Type == sacloudtypes.DNSRecordTypes.TXT && strings.HasPrefix(record.RData, dnsOwnerRecordPrefix):
+			if record.RData == dnsOwnerRecordData(owner) {
+				return true
+			}
+			marked = true
+		}
+	}
+	return !hasRecords || (adopt && !marked)
+}
+
+// desiredDNSRecords returns the records with the A records of the name replaced with the addresses
+// and marked with the TXT record of the owner
+func desiredDNSRecords(current []*sacloud.DNSRecord, name, owner string, addresses []string, ttl int) []*sacloud.DNSRecord {
+	var records []*sacloud.DNSRecord
+	for _, record := range current {
+		if record.Name == name && (record.Type == sacloudtypes.DNSRecordTypes.A ||
+			record.Type == sacloudtypes.DNSRecordTypes.TXT && record.RData == dnsOwnerRecordData(owner)) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if len(addresses) == 0 {
+		return records
+	}
+	records = append(records, &sacloud.DNSRecord{
+		Name:  name,
+		Type:  sacloudtypes.DNSRecordTypes.TXT,
+		RData: dnsOwnerRecordData(owner),
+		TTL:   ttl,
+	})
+
+	sorted := append([]string{}, addresses...)
+	sort.Strings(sorted)
+	for _, address := range sorted {
+		records = append(records, &sacloud.DNSRecord{
+			Name:  name,
+			Type:  sacloudtypes.DNSRecordTypes.A,
+			RData: address,
+			TTL:   ttl,
+		})
+	}
+	return records
+}
+
+func equalDNSRecords(a, b []*sacloud.DNSRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	key := func(r *sacloud.DNSRecord) string {
+		return fmt.Sprintf("%s/%s/%s/%d", r.Name, r.Type, r.RData, r.TTL)
+	}
+	counts := make(map[string]int)
+	for _, r := range a {
+		counts[key(r)]++
+	}
+	for _, r := range b {
+		counts[key(r)]--
+		if counts[key(r)] < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+func TestDesiredDNSRecords(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	current := []*sacloud.DNSRecord{
+		{Name: "www", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.1", TTL: 3600},
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.10", TTL: 60},
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.TXT, RData: "owner", TTL: 60},
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.TXT, RData: dnsOwnerRecordData("default/caps"), TTL: 60},
+	}
+
+	desired := desiredDNSRecords(current, "api.caps", "default/caps", []string{"192.0.2.12", "192.0.2.11"}, 60)
+	g.Expect(desired).To(gomega.Equal([]*sacloud.DNSRecord{
+		current[0],
+		current[2],
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.TXT, RData: dnsOwnerRecordData("default/caps"), TTL: 60},
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.11", TTL: 60},
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.12", TTL: 60},
+	}))
+	g.Expect(equalDNSRecords(current, desired)).To(gomega.BeFalse())
+
+	// the order of the records doesn't matter
+	reordered := []*sacloud.DNSRecord{desired[4], desired[3], desired[2], desired[1], desired[0]}
+	g.Expect(equalDNSRecords(desired, reordered)).To(gomega.BeTrue())
+
+	// no addresses deletes the records of the name and the owner record
+	deleted := desiredDNSRecords(desired, "api.caps", "default/caps", nil, 60)
+	g.Expect(deleted).To(gomega.Equal([]*sacloud.DNSRecord{current[0], current[2]}))
+}
+
+func TestOwnsDNSRecords(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	records := []*sacloud.DNSRecord{
+		{Name: "www", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.1", TTL: 3600},
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.10", TTL: 60},
+		{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.TXT, RData: dnsOwnerRecordData("default/caps"), TTL: 60},
+	}
+
+	// the names without A records are free
+	g.Expect(ownsDNSRecords(records, "api.other", "default/caps", false)).To(gomega.BeTrue())
+	g.Expect(ownsDNSRecords(records, "api.caps", "default/caps", false)).To(gomega.BeTrue())
+	g.Expect(ownsDNSRecords(records, "api.caps", "default/other", false)).To(gomega.BeFalse())
+	g.Expect(ownsDNSRecords(records, "api.caps", "default/other", true)).To(gomega.BeFalse())
+
+	// the records not marked are taken over only when adopted
+	g.Expect(ownsDNSRecords(records, "www", "default/caps", false)).To(gomega.BeFalse())
+	g.Expect(ownsDNSRecords(records, "www", "default/caps", true)).To(gomega.BeTrue())
+}
+
+func TestReconcileDNSRecords(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	ctx := context.Background()
+	d := &dnsClient{}
+	dns, err := d.dnsOp().Create(ctx, &sacloud.DNSCreateRequest{
+		Name:    "caps-dns-test.example.com",
+		Records: []*sacloud.DNSRecord{{Name: "www", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.1", TTL: 3600}},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	defer d.dnsOp().Delete(ctx, dns.ID) // ignore error
+
+	param := &DNSRecordParameter{Zone: dns.Name, Name: "api.caps", Owner: "default/caps", Addresses: []string{"192.0.2.10"}}
+	g.Expect(d.ReconcileDNSRecords(ctx, param)).To(gomega.Succeed())
+
+	// the records of the other cluster and the records created by hand are kept
+	other := &DNSRecordParameter{Zone: dns.Name, Name: "api.caps", Owner: "default/other", Addresses: []string{"192.0.2.20"}}
+	g.Expect(IsDNSRecordConflictError(d.ReconcileDNSRecords(ctx, other))).To(gomega.BeTrue())
+	g.Expect(d.DeleteDNSRecords(ctx, dns.Name, "api.caps", "default/other")).To(gomega.Succeed())
+	byHand := &DNSRecordParameter{Zone: dns.Name, Name: "www", Owner: "default/caps", Addresses: []string{"192.0.2.20"}}
+	g.Expect(IsDNSRecordConflictError(d.ReconcileDNSRecords(ctx, byHand))).To(gomega.BeTrue())
+
+	dns, err = d.dnsOp().Read(ctx, dns.ID)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(dns.Records).To(gomega.ConsistOf(
+		&sacloud.DNSRecord{Name: "www", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.1", TTL: 3600},
+		&sacloud.DNSRecord{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.TXT, RData: dnsOwnerRecordData("default/caps"), TTL: 60},
+		&sacloud.DNSRecord{Name: "api.caps", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.10", TTL: 60},
+	))
+
+	// the owner deletes the records
+	g.Expect(d.DeleteDNSRecords(ctx, dns.Name, "api.caps", "default/caps")).To(gomega.Succeed())
+	dns, err = d.dnsOp().Read(ctx, dns.ID)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(dns.Records).To(gomega.ConsistOf(
+		&sacloud.DNSRecord{Name: "www", Type: sacloudtypes.DNSRecordTypes.A, RData: "192.0.2.1", TTL: 3600},
+	))
+	// the records already deleted
+	g.Expect(d.DeleteDNSRecords(ctx, dns.Name, "api.caps", "default/caps")).To(gomega.Succeed())
+
+	// the records are deleted with the DNS zone
+	g.Expect(d.dnsOp().Delete(ctx, dns.ID)).To(gomega.Succeed())
+	g.Expect(d.ReconcileDNSRecords(ctx, param)).NotTo(gomega.Succeed())
+	g.Expect(d.DeleteDNSRecords(ctx, dns.Name, "api.caps", "default/caps")).To(gomega.Succeed())
+}
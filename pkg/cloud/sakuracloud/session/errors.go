@@ -0,0 +1,136 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	clusterv1errors "sigs.k8s.io/cluster-api/errors"
+)
+
+// ErrorKind is the kind of the errors returned by the SakuraCloud API
+type ErrorKind int
+
+const (
+	// ErrorKindUnknown is an error which isn't expected to be solved by retrying
+	ErrorKindUnknown ErrorKind = iota
+	// ErrorKindRetryable is a temporary error, e.g. the API is busy or unreachable
+	ErrorKindRetryable
+	// ErrorKindInvalidConfiguration is an error caused by the spec or the credentials,
+	// e.g. a bad request or a referenced resource not found
+	ErrorKindInvalidConfiguration
+	// ErrorKindInsufficientResources is an error caused by the resource limits of the account or the zone
+	ErrorKindInsufficientResources
+)
+
+// ClassifyError returns the kind of the error
+func ClassifyError(err error) ErrorKind {
+	err = errors.Cause(err)
+	if err == nil {
+		return ErrorKindUnknown
+	}
+
+	switch e := err.(type) {
+	case *QuotaExceededError:
+		return ErrorKindInsufficientResources
+	case sacloud.APIError:
+		return classifyAPIError(e)
+	case net.Error, *uploadError:
+		return ErrorKindRetryable
+	case *invalidConfigurationError:
+		return ErrorKindInvalidConfiguration
+	}
+	if err == context.DeadlineExceeded || err.Error() == waiterTimeoutMessage {
+		return ErrorKindRetryable
+	}
+	return ErrorKindUnknown
+}
+
+// waiterTimeoutMessage is the message of the error returned by the libsacloud waiters when they time out.
+// libsacloud has no type for the error.
+const waiterTimeoutMessage = "AsyncWaitForState is timed out"
+
+// uploadError is an error of the FTPS uploads of the images.
+// The uploads are retried because they usually fail because of the network.
+type uploadError struct {
+	err error
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("failed to upload via FTPS: %s", e.err)
+}
+
+// invalidConfigurationError is an error in the spec detected before calling the API
+type invalidConfigurationError struct {
+	message string
+}
+
+func (e *invalidConfigurationError) Error() string {
+	return e.message
+}
+
+func classifyAPIError(err sacloud.APIError) ErrorKind {
+	code := strings.ToLower(err.Code())
+	switch {
+	case strings.HasPrefix(code, "limit_") || strings.Contains(code, "not_enough") || strings.Contains(code, "insufficient"):
+		// e.g. limit_count_in_account
+		return ErrorKindInsufficientResources
+	case code == "busy" || strings.Contains(code, "temporarily"):
+		return ErrorKindRetryable
+	}
+
+	switch err.ResponseCode() {
+	case http.StatusConflict, http.StatusLocked, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrorKindRetryable
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusMethodNotAllowed, http.StatusUnprocessableEntity:
+		return ErrorKindInvalidConfiguration
+	}
+	return ErrorKindUnknown
+}
+
+// IsRetryableError returns true if the operation failed with the error may succeed when retried
+func IsRetryableError(err error) bool {
+	return ClassifyError(err) == ErrorKindRetryable
+}
+
+// MachineStatusError returns the status error of machines for the kind,
+// or fallback if the kind has no specific status error
+func (k ErrorKind) MachineStatusError(fallback clusterv1errors.MachineStatusError) clusterv1errors.MachineStatusError {
+	switch k {
+	case ErrorKindInvalidConfiguration:
+		return clusterv1errors.InvalidConfigurationMachineError
+	case ErrorKindInsufficientResources:
+		return clusterv1errors.InsufficientResourcesMachineError
+	}
+	return fallback
+}
+
+// ClusterStatusError returns the status error of clusters for the kind,
+// or fallback if the kind has no specific status error
+func (k ErrorKind) ClusterStatusError(fallback clusterv1errors.ClusterStatusError) clusterv1errors.ClusterStatusError {
+	if k == ErrorKindInvalidConfiguration {
+		return clusterv1errors.InvalidConfigurationClusterError
+	}
+	return fallback
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	clusterv1errors "sigs.k8s.io/cluster-api/errors"
+)
+
+func apiError(responseCode int, errorCode string) error {
+	return sacloud.NewAPIError(http.MethodPost, nil, "", responseCode, &sacloud.APIErrorResponse{ErrorCode: errorCode})
+}
+
+func TestClassifyError(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	g.Expect(ClassifyError(apiError(http.StatusServiceUnavailable, ""))).To(gomega.Equal(ErrorKindRetryable))
+	g.Expect(ClassifyError(apiError(http.StatusConflict, "still_creating"))).To(gomega.Equal(ErrorKindRetryable))
+	g.Expect(ClassifyError(apiError(http.StatusBadRequest, "bad_request"))).To(gomega.Equal(ErrorKindInvalidConfiguration))
+	g.Expect(ClassifyError(apiError(http.StatusNotFound, "not_found"))).To(gomega.Equal(ErrorKindInvalidConfiguration))
+	g.Expect(ClassifyError(apiError(http.StatusConflict, "limit_count_in_account"))).To(gomega.Equal(ErrorKindInsufficientResources))
+	g.Expect(ClassifyError(&QuotaExceededError{Zone: "is1a"})).To(gomega.Equal(ErrorKindInsufficientResources))
+
+	g.Expect(ClassifyError(&net.OpError{Op: "dial", Err: errors.New("connection refused")})).To(gomega.Equal(ErrorKindRetryable))
+	g.Expect(ClassifyError(pkgerrors.Wrap(context.DeadlineExceeded, "waiting"))).To(gomega.Equal(ErrorKindRetryable))
+	g.Expect(ClassifyError(&uploadError{err: errors.New("Storefile FTP failed")})).To(gomega.Equal(ErrorKindRetryable))
+	g.Expect(ClassifyError(errors.New("invalid user data"))).To(gomega.Equal(ErrorKindUnknown))
+	g.Expect(ClassifyError(nil)).To(gomega.Equal(ErrorKindUnknown))
+
+	// the timeout of the libsacloud waiters
+	waiter := &sacloud.StatePollWaiter{
+		ReadFunc:       func() (interface{}, error) { return &sacloud.Server{}, nil },
+		StateCheckFunc: func(interface{}) (bool, error) { return false, nil },
+		Timeout:        time.Millisecond,
+		PollInterval:   time.Millisecond,
+	}
+	_, err := waiter.WaitForState(context.Background())
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(ClassifyError(pkgerrors.Wrap(err, "waiting for the server"))).To(gomega.Equal(ErrorKindRetryable))
+
+	g.Expect(ErrorKindInsufficientResources.MachineStatusError(clusterv1errors.CreateMachineError)).
+		To(gomega.Equal(clusterv1errors.InsufficientResourcesMachineError))
+	g.Expect(ErrorKindUnknown.MachineStatusError(clusterv1errors.DeleteMachineError)).
+		To(gomega.Equal(clusterv1errors.DeleteMachineError))
+	g.Expect(ErrorKindInvalidConfiguration.ClusterStatusError(clusterv1errors.CreateClusterError)).
+		To(gomega.Equal(clusterv1errors.InvalidConfigurationClusterError))
+}
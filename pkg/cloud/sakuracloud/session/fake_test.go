@@ -0,0 +1,43 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+)
+
+// the tests calling the API use the in-memory fake of libsacloud
+func init() {
+	fake.SwitchFactoryFuncToFake()
+	fake.PowerOnDuration = time.Millisecond
+	fake.PowerOffDuration = time.Millisecond
+	fake.DiskCopyDuration = time.Millisecond
+	sacloud.DefaultStatePollInterval = 10 * time.Millisecond
+}
+
+var fakeZoneCount int32
+
+// newFakeZone returns the name of a zone which has no resources yet.
+// The fake doesn't implement the filters of Find, so each test uses its own zone.
+func newFakeZone() string {
+	return fmt.Sprintf("caps-test-%d", atomic.AddInt32(&fakeZoneCount, 1))
+}
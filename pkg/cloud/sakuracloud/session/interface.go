@@ -17,6 +17,7 @@ package session
 
 import (
 	"context"
+	"time"
 
 	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
 	"github.com/sacloud/libsacloud/v2/sacloud"
@@ -25,10 +26,45 @@ import (
 
 type ServerAPI interface {
 	Read(ctx context.Context, zone string, serverID sacloudtypes.ID) (*sacloud.Server, error)
-	Cleanup(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID
+	ReadISOImage(ctx context.Context, zone string, isoImageID sacloudtypes.ID) (*sacloud.CDROM, error)
+	Boot(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID
+	Shutdown(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID
+	Reboot(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID
+	Cleanup(ctx context.Context, zone string, serverID sacloudtypes.ID, param *ServerCleanupParameter) JobID
 	Provision(ctx context.Context, zone string, param *ServerBuildParameter) JobID
-	FindArchive(ctx context.Context, zone string, filters []infrav1.Filter) (*sacloud.Archive, error)
+	FindArchive(ctx context.Context, zone string, ref *infrav1.SourceArchiveReference) (*sacloud.Archive, error)
 	ReadArchive(ctx context.Context, zone string, archiveID sacloudtypes.ID) (*sacloud.Archive, error)
+	FindServerPlan(ctx context.Context, zone string, spec *infrav1.SakuraCloudMachineSpec) (*sacloud.ServerPlan, error)
+	ReserveQuota(ctx context.Context, zone, clusterName, nameSpace, serverName string, spec *infrav1.SakuraCloudMachineSpec) error
+	Backup(ctx context.Context, zone string, serverID sacloudtypes.ID, param *ServerBackupParameter) JobID
+	FindBackups(ctx context.Context, zone, clusterName, nameSpace, serverName string) ([]*DiskBackup, error)
+	DeleteBackups(ctx context.Context, zone, clusterName, nameSpace, serverName string) error
+}
+
+type ClusterAPI interface {
+	FindClusterResources(ctx context.Context, zone, clusterName, nameSpace string) (*ClusterResources, error)
+	// CleanupCluster deletes the resources left by the cluster.
+	// The servers are shut down via ACPI and powered off forcibly after the shutdown timeout
+	CleanupCluster(ctx context.Context, zones []string, clusterName, nameSpace string, shutdownTimeout time.Duration) JobID
+	ReconcilePacketFilter(ctx context.Context, zone string, param *PacketFilterParameter) (*sacloud.PacketFilter, error)
+	FindClusterAddresses(ctx context.Context, zones []string, clusterName, nameSpace string) ([]string, error)
+	ApplyPacketFilter(ctx context.Context, zone, clusterName, nameSpace string, packetFilterID sacloudtypes.ID) error
+	DetachPacketFilter(ctx context.Context, zone, clusterName, nameSpace string) error
+}
+
+type AuthAPI interface {
+	AuthStatus(ctx context.Context) (*sacloud.AuthStatus, error)
+	CheckZoneAccess(ctx context.Context, zone string) error
+}
+
+type DNSAPI interface {
+	ReconcileDNSRecords(ctx context.Context, param *DNSRecordParameter) error
+	DeleteDNSRecords(ctx context.Context, zone, name, owner string) error
+}
+
+type ArchiveAPI interface {
+	ImportArchive(ctx context.Context, param *ArchiveImportParameter) JobID
+	DeleteArchives(ctx context.Context, zones []string, name, nameSpace string) error
 }
 
 type ServerBuildParameter struct {
@@ -38,5 +74,44 @@ type ServerBuildParameter struct {
 	IsControlPlane  bool
 	SourceArchiveID string
 	BootstrapData   string
-	Spec            infrav1.SakuraCloudMachineSpec
+	PacketFilterID  string
+	// PlanGeneration is the generation of the server plan found by FindServerPlan. Spec.Generation is used if 0
+	PlanGeneration int
+	Spec           infrav1.SakuraCloudMachineSpec
+}
+
+type ServerCleanupParameter struct {
+	ServerName  string
+	ClusterName string
+	NameSpace   string
+
+	// ShutdownTimeout is how long to wait for the ACPI shutdown before powering off forcibly.
+	// 0 powers off forcibly without waiting.
+	ShutdownTimeout time.Duration
+
+	// DeletionPolicy is what is done with the disks selected by DeletionPolicyDisks
+	DeletionPolicy      infrav1.DiskDeletionPolicy
+	DeletionPolicyDisks []string
+}
+
+// ClusterResources represents SakuraCloud resources owned by a cluster
+type ClusterResources struct {
+	Servers       []*sacloud.Server
+	Disks         []*sacloud.Disk
+	Switches      []*sacloud.Switch
+	LoadBalancers []*sacloud.LoadBalancer
+	ISOImages     []*sacloud.CDROM
+	PacketFilters []*sacloud.PacketFilter
+	Archives      []*sacloud.Archive
+}
+
+// IsEmpty returns true if the cluster owns no resources
+func (r *ClusterResources) IsEmpty() bool {
+	return len(r.Servers) == 0 && len(r.Disks) == 0 && len(r.Switches) == 0 && len(r.LoadBalancers) == 0 &&
+		len(r.ISOImages) == 0 && len(r.PacketFilters) == 0 && len(r.Archives) == 0
+}
+
+// Count returns the number of resources owned by the cluster
+func (r *ClusterResources) Count() int {
+	return len(r.Servers) + len(r.Disks) + len(r.Switches) + len(r.LoadBalancers) + len(r.ISOImages) + len(r.PacketFilters) + len(r.Archives)
 }
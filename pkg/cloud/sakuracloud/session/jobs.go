@@ -16,6 +16,7 @@ limitations under the License.
 package session
 
 import (
+	"context"
 	"sync"
 
 	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
@@ -23,20 +24,105 @@ import (
 
 type JobID string
 
+// JobStatus is the status of a job.
+// The fields are updated by the job under the lock, and JobByID returns snapshots of them.
 type JobStatus struct {
 	ID        JobID
 	Type      JobType
 	State     JobState
 	Reference *CloudObjectRef
-	Error     error
+	Progress  string
+	// Result describes how the job was completed, e.g. how the server was shut down
+	Result string
+	Error  error
+
+	// cancelWait cancels the job waiting to start, e.g. in the provisioning queue
+	cancelWait context.CancelFunc
+	canceled   bool
+	mu         sync.Mutex
+}
+
+// cancelPending cancels the job if it's waiting to start, and returns true if it's canceled
+func (s *JobStatus) cancelPending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancelWait == nil || s.State != JobStatePending {
+		return false
+	}
+	s.canceled = true
+	s.cancelWait()
+	return true
+}
+
+// start marks the job in flight, and returns false if the job was canceled while waiting to start
+func (s *JobStatus) start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.canceled {
+		return false
+	}
+	s.State = JobStateInFlight
+	return true
+}
+
+// update changes the fields under the lock
+func (s *JobStatus) update(f func(job *JobStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *JobStatus) setState(state JobState) {
+	s.update(func(job *JobStatus) { job.State = state })
+}
+
+func (s *JobStatus) setProgress(progress string) {
+	s.update(func(job *JobStatus) { job.Progress = progress })
+}
+
+func (s *JobStatus) setResult(result string) {
+	s.update(func(job *JobStatus) { job.Result = result })
+}
+
+func (s *JobStatus) setReference(ref *CloudObjectRef) {
+	s.update(func(job *JobStatus) { job.Reference = ref })
+}
+
+// fail marks the job failed with the error
+func (s *JobStatus) fail(err error) {
+	s.update(func(job *JobStatus) {
+		job.Error = err
+		job.State = JobStateFailed
+	})
+}
+
+// snapshot returns a copy of the job which isn't changed by the job
+func (s *JobStatus) snapshot() *JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &JobStatus{
+		ID:        s.ID,
+		Type:      s.Type,
+		State:     s.State,
+		Reference: s.Reference.deepCopy(),
+		Progress:  s.Progress,
+		Result:    s.Result,
+		Error:     s.Error,
+	}
 }
 
 type JobType string
 
 const (
-	JobTypePending      JobState = ""
-	JobTypeProvisioning          = "provisioning"
-	JobTypeCleaning              = "cleaning"
+	JobTypePending          JobState = ""
+	JobTypeProvisioning              = "provisioning"
+	JobTypeCleaning                  = "cleaning"
+	JobTypeClusterCleaning           = "cluster-cleaning"
+	JobTypeArchiveImporting          = "archive-importing"
+	JobTypeBooting                   = "booting"
+	JobTypeShuttingDown              = "shutting-down"
+	JobTypeRebooting                 = "rebooting"
+	JobTypeBackingUp                 = "backing-up"
 )
 
 type JobState string
@@ -51,10 +137,46 @@ const (
 type CloudObjectRef struct {
 	ServerID   sacloudtypes.ID
 	ISOImageID sacloudtypes.ID
+	ArchiveIDs map[string]sacloudtypes.ID
+	// RetainedDiskIDs and DiskArchiveIDs are keyed by the disk name in the machine
+	RetainedDiskIDs map[string]sacloudtypes.ID
+	DiskArchiveIDs  map[string]sacloudtypes.ID
+}
+
+func (r *CloudObjectRef) deepCopy() *CloudObjectRef {
+	if r == nil {
+		return nil
+	}
+	copyIDs := func(ids map[string]sacloudtypes.ID) map[string]sacloudtypes.ID {
+		if ids == nil {
+			return nil
+		}
+		copied := make(map[string]sacloudtypes.ID, len(ids))
+		for k, v := range ids {
+			copied[k] = v
+		}
+		return copied
+	}
+	return &CloudObjectRef{
+		ServerID:        r.ServerID,
+		ISOImageID:      r.ISOImageID,
+		ArchiveIDs:      copyIDs(r.ArchiveIDs),
+		RetainedDiskIDs: copyIDs(r.RetainedDiskIDs),
+		DiskArchiveIDs:  copyIDs(r.DiskArchiveIDs),
+	}
+}
+
+// JobEvent notifies a state transition of a job
+type JobEvent struct {
+	ID    JobID
+	State JobState
 }
 
 type jobRegistry struct {
 	jobs sync.Map
+
+	mu          sync.Mutex
+	subscribers []chan JobEvent
 }
 
 func (j *jobRegistry) get(id JobID) *JobStatus {
@@ -69,6 +191,53 @@ func (j *jobRegistry) set(id JobID, status *JobStatus) {
 	j.jobs.Store(id, status)
 }
 
+// delete removes the job, canceling it if it's waiting to start
 func (j *jobRegistry) delete(id JobID) {
+	if status := j.get(id); status != nil {
+		status.cancelPending()
+	}
 	j.jobs.Delete(id)
 }
+
+// cancel cancels the job if it's waiting to start.
+// It returns false if the job is running, which can't be canceled.
+func (j *jobRegistry) cancel(id JobID) bool {
+	status := j.get(id)
+	if status == nil || status.cancelPending() {
+		return true
+	}
+	state := status.snapshot().State
+	return state != JobStatePending && state != JobStateInFlight
+}
+
+// run runs the job in a goroutine, and notifies the subscribers when it's finished
+func (j *jobRegistry) run(status *JobStatus, f func()) {
+	go func() {
+		defer j.notify(status)
+		f()
+	}()
+}
+
+// notify sends the current state of the job to the subscribers.
+// The event is dropped if a subscriber isn't ready, the jobs are polled as a fallback.
+func (j *jobRegistry) notify(status *JobStatus) {
+	event := JobEvent{ID: status.ID, State: status.snapshot().State}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (j *jobRegistry) subscribe() <-chan JobEvent {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ch := make(chan JobEvent, jobEventBufferSize)
+	j.subscribers = append(j.subscribers, ch)
+	return ch
+}
+
+const jobEventBufferSize = 1024
@@ -0,0 +1,94 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestJobRegistryNotifiesFinishedJobs(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	jobs := &jobRegistry{}
+	events := jobs.subscribe()
+
+	status := &JobStatus{ID: "cleanup/is1a/123456789012", Type: JobTypeCleaning, State: JobStatePending}
+	jobs.set(status.ID, status)
+	jobs.run(status, func() {
+		status.State = JobStateDone
+	})
+
+	g.Eventually(events).Should(gomega.Receive(gomega.Equal(JobEvent{ID: status.ID, State: JobStateDone})))
+}
+
+func TestCancelQueuedBuild(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	jobs := &jobRegistry{}
+	events := jobs.subscribe()
+	s := &serverClient{jobs: jobs, queue: newProvisionQueue(1)}
+
+	// the queue is full
+	g.Expect(s.queue.acquire(ctx, zone, "build/running", "default/caps-example", false)).To(gomega.Succeed())
+	defer s.queue.release(zone)
+
+	// canceled while waiting in the queue
+	jobID := s.Provision(ctx, zone, &ServerBuildParameter{ServerName: "caps-example-md-0-a", ClusterName: "caps-example", NameSpace: "default"})
+	g.Eventually(func() int { return s.queue.position(zone, jobID) }).Should(gomega.Equal(1))
+	g.Expect(jobs.cancel(jobID)).To(gomega.BeTrue())
+	g.Eventually(events).Should(gomega.Receive(gomega.Equal(JobEvent{ID: jobID, State: JobStateFailed})))
+	g.Expect(jobs.get(jobID).Error).To(gomega.Equal(context.Canceled))
+	g.Expect(s.queue.position(zone, jobID)).To(gomega.BeZero())
+
+	// deleting the job cancels it too
+	jobID = s.Provision(ctx, zone, &ServerBuildParameter{ServerName: "caps-example-md-0-b", ClusterName: "caps-example", NameSpace: "default"})
+	g.Eventually(func() int { return s.queue.position(zone, jobID) }).Should(gomega.Equal(1))
+	status := jobs.get(jobID)
+	jobs.delete(jobID)
+	g.Eventually(events).Should(gomega.Receive(gomega.Equal(JobEvent{ID: jobID, State: JobStateFailed})))
+	g.Expect(status.Error).To(gomega.Equal(context.Canceled))
+	waiting, running := s.queue.depth(zone)
+	g.Expect(waiting).To(gomega.BeZero())
+	g.Expect(running).To(gomega.Equal(1))
+}
+
+func TestCancelJob(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	jobs := &jobRegistry{}
+
+	// running jobs can't be canceled
+	running := &JobStatus{ID: "build/is1a/default/caps-example/caps-example-md-0-a", Type: JobTypeProvisioning, State: JobStateInFlight}
+	jobs.set(running.ID, running)
+	g.Expect(jobs.cancel(running.ID)).To(gomega.BeFalse())
+
+	// pending jobs without the cancel func, e.g. power operations, are waited for
+	pending := &JobStatus{ID: "booting/is1a/123456789012", Type: JobTypeBooting, State: JobStatePending}
+	jobs.set(pending.ID, pending)
+	g.Expect(jobs.cancel(pending.ID)).To(gomega.BeFalse())
+
+	// finished and unknown jobs
+	done := &JobStatus{ID: "cleanup/is1a/123456789012", Type: JobTypeCleaning, State: JobStateDone}
+	jobs.set(done.ID, done)
+	g.Expect(jobs.cancel(done.ID)).To(gomega.BeTrue())
+	g.Expect(jobs.cancel("unknown")).To(gomega.BeTrue())
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+const (
+	// maxPacketFilterExpressions is the maximum number of the rules of a packet filter on SakuraCloud
+	maxPacketFilterExpressions = 30
+
+	defaultNodePortRange = "30000-32767"
+	apiServerPort        = "6443"
+	sshPort              = "22"
+	ephemeralPortRange   = "32768-65535"
+)
+
+type PacketFilterParameter struct {
+	ClusterName string
+	NameSpace   string
+	Spec        infrav1.PacketFilterSpec
+	// NodeAddresses is the addresses of the servers of the cluster, allowed one by one if Spec.ClusterCIDRs is empty
+	NodeAddresses []string
+}
+
+func (c *clusterClient) ReconcilePacketFilter(ctx context.Context, zone string, param *PacketFilterParameter) (*sacloud.PacketFilter, error) {
+	sources := param.Spec.ClusterCIDRs
+	if len(sources) == 0 {
+		sources = param.NodeAddresses
+	}
+	expressions, err := buildPacketFilterExpressions(&param.Spec, sources)
+	if err != nil {
+		return nil, err
+	}
+	name := clusterResourceName(param.ClusterName, param.NameSpace)
+
+	current, err := c.findPacketFilter(ctx, zone, name)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return c.packetFilterOp().Create(ctx, zone, &sacloud.PacketFilterCreateRequest{
+			Name:       name,
+			Expression: expressions,
+		})
+	}
+
+	if packetFilterExpressionsEqual(current.Expression, expressions) {
+		return current, nil
+	}
+	return c.packetFilterOp().Update(ctx, zone, current.ID, &sacloud.PacketFilterUpdateRequest{
+		Name:        current.Name,
+		Description: current.Description,
+		Expression:  expressions,
+	})
+}
+
+func (c *clusterClient) findPacketFilter(ctx context.Context, zone, name string) (*sacloud.PacketFilter, error) {
+	searched, err := c.packetFilterOp().Find(ctx, zone, &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Name): search.ExactMatch(name),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the name filter of SakuraCloud API is a partial match
+	for _, pf := range searched.PacketFilters {
+		if pf.Name == name {
+			return pf, nil
+		}
+	}
+	return nil, nil
+}
+
+// FindClusterAddresses returns the IP addresses of the NICs of the servers of the cluster in the zones
+func (c *clusterClient) FindClusterAddresses(ctx context.Context, zones []string, clusterName, nameSpace string) ([]string, error) {
+	var addresses []string
+	for _, zone := range zones {
+		servers, err := c.findClusterServers(ctx, zone, clusterName, nameSpace)
+		if err != nil {
+			return nil, err
+		}
+		for _, sv := range servers {
+			for _, iface := range sv.Interfaces {
+				address := iface.IPAddress
+				if address == "" {
+					address = iface.UserIPAddress
+				}
+				if address != "" && !containsString(addresses, address) {
+					addresses = append(addresses, address)
+				}
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// ApplyPacketFilter connects the NICs of the servers of the cluster in the shared segment to the packet filter,
+// including the servers created before the packet filter or while it was disabled.
+// A NIC can have only one packet filter, so the NICs connected to other packet filters are reconnected.
+func (c *clusterClient) ApplyPacketFilter(ctx context.Context, zone, clusterName, nameSpace string, packetFilterID sacloudtypes.ID) error {
+	servers, err := c.findClusterServers(ctx, zone, clusterName, nameSpace)
+	if err != nil {
+		return err
+	}
+	for _, sv := range servers {
+		for _, iface := range sv.Interfaces {
+			if iface.SwitchScope != sacloudtypes.Scopes.Shared || iface.PacketFilterID == packetFilterID {
+				continue
+			}
+			if !iface.PacketFilterID.IsEmpty() {
+				if err := c.interfaceOp().DisconnectFromPacketFilter(ctx, zone, iface.ID); err != nil {
+					return err
+				}
+			}
+			if err := c.interfaceOp().ConnectToPacketFilter(ctx, zone, iface.ID, packetFilterID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DetachPacketFilter disconnects the NICs of the servers of the cluster from the packet filter of the cluster.
+// The packet filter itself is deleted with the cluster.
+func (c *clusterClient) DetachPacketFilter(ctx context.Context, zone, clusterName, nameSpace string) error {
+	packetFilter, err := c.findPacketFilter(ctx, zone, clusterResourceName(clusterName, nameSpace))
+	if err != nil || packetFilter == nil {
+		return err
+	}
+
+	servers, err := c.findClusterServers(ctx, zone, clusterName, nameSpace)
+	if err != nil {
+		return err
+	}
+	for _, sv := range servers {
+		for _, iface := range sv.Interfaces {
+			if iface.PacketFilterID != packetFilter.ID {
+				continue
+			}
+			if err := c.interfaceOp().DisconnectFromPacketFilter(ctx, zone, iface.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *clusterClient) findClusterServers(ctx context.Context, zone, clusterName, nameSpace string) ([]*sacloud.Server, error) {
+	servers, err := c.serverOp().Find(ctx, zone, &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Tags): search.TagsAndEqual(clusterTags(clusterName, nameSpace)...),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return servers.Servers, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func buildPacketFilterExpressions(spec *infrav1.PacketFilterSpec, clusterSources []string) ([]*sacloud.PacketFilterExpression, error) {
+	var expressions []*sacloud.PacketFilterExpression
+	allow := func(protocol sacloudtypes.Protocol, source, port, description string) {
+		expressions = append(expressions, &sacloud.PacketFilterExpression{
+			Protocol:        protocol,
+			SourceNetwork:   sacloudtypes.PacketFilterNetwork(source),
+			DestinationPort: sacloudtypes.PacketFilterPort(port),
+			Action:          sacloudtypes.Actions.Allow,
+			Description:     description,
+		})
+	}
+	allowFrom := func(protocol sacloudtypes.Protocol, sources []string, port, description string) {
+		if len(sources) == 0 {
+			allow(protocol, "", port, description)
+			return
+		}
+		for _, source := range sources {
+			allow(protocol, source, port, description)
+		}
+	}
+
+	// intra-cluster traffic
+	for _, source := range clusterSources {
+		allow(sacloudtypes.Protocols.IP, source, "", "intra-cluster")
+	}
+
+	allowFrom(sacloudtypes.Protocols.TCP, spec.APIServerCIDRs, apiServerPort, "api-server")
+
+	nodePortRange := spec.NodePortRange
+	if nodePortRange == "" {
+		nodePortRange = defaultNodePortRange
+	}
+	allowFrom(sacloudtypes.Protocols.TCP, spec.NodePortCIDRs, nodePortRange, "node-port")
+
+	for _, source := range spec.SSHCIDRs {
+		allow(sacloudtypes.Protocols.TCP, source, sshPort, "ssh")
+	}
+
+	for _, rule := range spec.Rules {
+		action := sacloudtypes.Action(rule.Action)
+		if action == "" {
+			action = sacloudtypes.Actions.Allow
+		}
+		expressions = append(expressions, &sacloud.PacketFilterExpression{
+			Protocol:        sacloudtypes.Protocol(rule.Protocol),
+			SourceNetwork:   sacloudtypes.PacketFilterNetwork(rule.SourceNetwork),
+			SourcePort:      sacloudtypes.PacketFilterPort(rule.SourcePort),
+			DestinationPort: sacloudtypes.PacketFilterPort(rule.DestinationPort),
+			Action:          action,
+			Description:     rule.Description,
+		})
+	}
+
+	// packet filters are stateless, so responses for connections from the servers must be allowed explicitly
+	allow(sacloudtypes.Protocols.TCP, "", ephemeralPortRange, "response")
+	allow(sacloudtypes.Protocols.UDP, "", ephemeralPortRange, "response")
+	allow(sacloudtypes.Protocols.ICMP, "", "", "icmp")
+	allow(sacloudtypes.Protocols.Fragment, "", "", "fragment")
+
+	expressions = append(expressions, &sacloud.PacketFilterExpression{
+		Protocol:    sacloudtypes.Protocols.IP,
+		Action:      sacloudtypes.Actions.Deny,
+		Description: "deny-all",
+	})
+
+	if len(expressions) > maxPacketFilterExpressions {
+		return nil, fmt.Errorf("packet filter has too many rules: %d (max: %d)", len(expressions), maxPacketFilterExpressions)
+	}
+	return expressions, nil
+}
+
+func packetFilterExpressionsEqual(current, desired []*sacloud.PacketFilterExpression) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+	for i := range current {
+		if *current[i] != *desired[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestBuildPacketFilterExpressions(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// defaults
+	expressions, err := buildPacketFilterExpressions(&infrav1.PacketFilterSpec{}, nil)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(expressions).To(gomega.HaveLen(7))
+	g.Expect(expressions[0].DestinationPort).To(gomega.Equal(sacloudtypes.PacketFilterPort("6443")))
+	g.Expect(expressions[0].SourceNetwork).To(gomega.BeEmpty())
+	g.Expect(expressions[1].DestinationPort).To(gomega.Equal(sacloudtypes.PacketFilterPort("30000-32767")))
+	last := expressions[len(expressions)-1]
+	g.Expect(last.Protocol).To(gomega.Equal(sacloudtypes.Protocols.IP))
+	g.Expect(last.Action).To(gomega.Equal(sacloudtypes.Actions.Deny))
+
+	// node addresses, SSH and additional rules
+	expressions, err = buildPacketFilterExpressions(&infrav1.PacketFilterSpec{
+		APIServerCIDRs: []string{"192.0.2.0/24"},
+		SSHCIDRs:       []string{"198.51.100.1"},
+		Rules: []infrav1.PacketFilterRule{
+			{Protocol: "udp", DestinationPort: "53"},
+		},
+	}, []string{"203.0.113.11", "203.0.113.12"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(expressions).To(gomega.HaveLen(11))
+	g.Expect(expressions[0].SourceNetwork).To(gomega.Equal(sacloudtypes.PacketFilterNetwork("203.0.113.11")))
+	g.Expect(expressions[0].Protocol).To(gomega.Equal(sacloudtypes.Protocols.IP))
+	g.Expect(expressions[2].SourceNetwork).To(gomega.Equal(sacloudtypes.PacketFilterNetwork("192.0.2.0/24")))
+	g.Expect(expressions[4].DestinationPort).To(gomega.Equal(sacloudtypes.PacketFilterPort("22")))
+	g.Expect(expressions[5].Protocol).To(gomega.Equal(sacloudtypes.Protocols.UDP))
+	g.Expect(expressions[5].Action).To(gomega.Equal(sacloudtypes.Actions.Allow))
+
+	// too many rules
+	var rules []infrav1.PacketFilterRule
+	for i := 0; i < 24; i++ {
+		rules = append(rules, infrav1.PacketFilterRule{Protocol: "tcp", DestinationPort: "80"})
+	}
+	_, err = buildPacketFilterExpressions(&infrav1.PacketFilterSpec{Rules: rules}, nil)
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+func TestApplyPacketFilter(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// the fake doesn't reflect the interfaces in the servers, so the servers and the requests are stubbed
+	shared := sacloudtypes.Scopes.Shared
+	servers := []*sacloud.Server{
+		{Name: "caps-example-controlplane-0", Interfaces: []*sacloud.InterfaceView{
+			{ID: 101, IPAddress: "203.0.113.11", SwitchScope: shared},
+			{ID: 102, UserIPAddress: "192.168.0.11", SwitchScope: sacloudtypes.Scopes.User},
+		}},
+		// created while the packet filter was disabled
+		{Name: "caps-example-md-0-a", Interfaces: []*sacloud.InterfaceView{
+			{ID: 201, IPAddress: "203.0.113.12", SwitchScope: shared},
+		}},
+		// connected to the packet filter of the user
+		{Name: "caps-example-md-0-b", Interfaces: []*sacloud.InterfaceView{
+			{ID: 301, IPAddress: "203.0.113.13", SwitchScope: shared, PacketFilterID: 999},
+		}},
+	}
+	sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return &stubServerFindOp{ServerAPI: fake.NewServerOp(), servers: servers}
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return fake.NewServerOp()
+	})
+	interfaceOp := &recordingInterfaceOp{}
+	sacloud.SetClientFactoryFunc(fake.ResourceInterface, func(sacloud.APICaller) interface{} {
+		return interfaceOp
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceInterface, func(sacloud.APICaller) interface{} {
+		return fake.NewInterfaceOp()
+	})
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	c := &clusterClient{}
+
+	// the addresses of all NICs are allowed one by one
+	addresses, err := c.FindClusterAddresses(ctx, []string{zone}, "caps-example", "default")
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(addresses).To(gomega.Equal([]string{"192.168.0.11", "203.0.113.11", "203.0.113.12", "203.0.113.13"}))
+
+	// the NICs in the shared segment are connected to the packet filter
+	servers[0].Interfaces[0].PacketFilterID = 100
+	g.Expect(c.ApplyPacketFilter(ctx, zone, "caps-example", "default", 100)).To(gomega.Succeed())
+	g.Expect(interfaceOp.takeRequests()).To(gomega.Equal([]string{"connect 201 100", "disconnect 301", "connect 301 100"}))
+
+	// the NICs are disconnected from the packet filter of the cluster only
+	pf, err := c.packetFilterOp().Create(ctx, zone, &sacloud.PacketFilterCreateRequest{Name: clusterResourceName("caps-example", "default")})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	servers[0].Interfaces[0].PacketFilterID = pf.ID
+	servers[1].Interfaces[0].PacketFilterID = pf.ID
+	g.Expect(c.DetachPacketFilter(ctx, zone, "caps-example", "default")).To(gomega.Succeed())
+	g.Expect(interfaceOp.takeRequests()).To(gomega.Equal([]string{"disconnect 101", "disconnect 201"}))
+}
+
+type stubServerFindOp struct {
+	sacloud.ServerAPI
+	servers []*sacloud.Server
+}
+
+func (o *stubServerFindOp) Find(ctx context.Context, zone string, conditions *sacloud.FindCondition) (*sacloud.ServerFindResult, error) {
+	return &sacloud.ServerFindResult{Total: len(o.servers), Count: len(o.servers), Servers: o.servers}, nil
+}
+
+type recordingInterfaceOp struct {
+	sacloud.InterfaceAPI
+	requests []string
+}
+
+func (o *recordingInterfaceOp) ConnectToPacketFilter(ctx context.Context, zone string, id sacloudtypes.ID, packetFilterID sacloudtypes.ID) error {
+	o.requests = append(o.requests, fmt.Sprintf("connect %s %s", id, packetFilterID))
+	return nil
+}
+
+func (o *recordingInterfaceOp) DisconnectFromPacketFilter(ctx context.Context, zone string, id sacloudtypes.ID) error {
+	o.requests = append(o.requests, fmt.Sprintf("disconnect %s", id))
+	return nil
+}
+
+// takeRequests returns the requests and clears them
+func (o *recordingInterfaceOp) takeRequests() []string {
+	requests := o.requests
+	o.requests = nil
+	return requests
+}
+
+func TestReconcilePacketFilter(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// count the updates
+	updates := 0
+	sacloud.SetClientFactoryFunc(fake.ResourcePacketFilter, func(sacloud.APICaller) interface{} {
+		return &countingPacketFilterOp{PacketFilterAPI: fake.NewPacketFilterOp(), updates: &updates}
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourcePacketFilter, func(sacloud.APICaller) interface{} {
+		return fake.NewPacketFilterOp()
+	})
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	c := &clusterClient{}
+	param := &PacketFilterParameter{
+		ClusterName:   "caps-example",
+		NameSpace:     "default",
+		NodeAddresses: []string{"203.0.113.11", "203.0.113.12"},
+	}
+
+	created, err := c.ReconcilePacketFilter(ctx, zone, param)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(created.Name).To(gomega.Equal("caps-default-caps-example"))
+
+	// the rules read from the API are compared with the desired ones, so unchanged rules aren't updated
+	unchanged, err := c.ReconcilePacketFilter(ctx, zone, param)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(unchanged.ID).To(gomega.Equal(created.ID))
+	g.Expect(updates).To(gomega.BeZero())
+
+	// the networks in the spec take precedence over the addresses of the servers
+	param.Spec.ClusterCIDRs = []string{"192.168.0.0/24"}
+	updated, err := c.ReconcilePacketFilter(ctx, zone, param)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(updated.ID).To(gomega.Equal(created.ID))
+	g.Expect(updates).To(gomega.Equal(1))
+	g.Expect(updated.Expression[0].SourceNetwork).To(gomega.Equal(sacloudtypes.PacketFilterNetwork("192.168.0.0/24")))
+	g.Expect(updated.Expression[1].DestinationPort).To(gomega.Equal(sacloudtypes.PacketFilterPort("6443")))
+}
+
+type countingPacketFilterOp struct {
+	sacloud.PacketFilterAPI
+	updates *int
+}
+
+func (o *countingPacketFilterOp) Update(ctx context.Context, zone string, id sacloudtypes.ID, param *sacloud.PacketFilterUpdateRequest) (*sacloud.PacketFilter, error) {
+	*o.updates++
+	return o.PacketFilterAPI.Update(ctx, zone, id, param)
+}
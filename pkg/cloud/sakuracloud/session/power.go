@@ -0,0 +1,146 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+// Boot powers on the server and waits for it to be up
+func (s *serverClient) Boot(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID {
+	return s.runPowerOperation(ctx, zone, serverID, JobTypeBooting, func(sv *sacloud.Server) error {
+		if sv.InstanceStatus.IsUp() {
+			return nil
+		}
+		if err := s.serverOp().Boot(ctx, zone, serverID); err != nil {
+			return err
+		}
+		return s.waitForUp(ctx, zone, serverID)
+	})
+}
+
+// Shutdown shuts down the server via ACPI and waits for it to be down
+func (s *serverClient) Shutdown(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID {
+	return s.runPowerOperation(ctx, zone, serverID, JobTypeShuttingDown, func(sv *sacloud.Server) error {
+		if sv.InstanceStatus.IsDown() {
+			return nil
+		}
+		if err := s.serverOp().Shutdown(ctx, zone, serverID, &sacloud.ShutdownOption{Force: false}); err != nil {
+			return err
+		}
+		return s.waitForDown(ctx, zone, serverID)
+	})
+}
+
+// Reboot resets the server, which works even if the OS doesn't respond, and waits for it to be up
+func (s *serverClient) Reboot(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID {
+	return s.runPowerOperation(ctx, zone, serverID, JobTypeRebooting, func(sv *sacloud.Server) error {
+		if sv.InstanceStatus.IsDown() {
+			if err := s.serverOp().Boot(ctx, zone, serverID); err != nil {
+				return err
+			}
+		} else if err := s.serverOp().Reset(ctx, zone, serverID); err != nil {
+			return err
+		}
+		return s.waitForUp(ctx, zone, serverID)
+	})
+}
+
+func (s *serverClient) runPowerOperation(ctx context.Context, zone string, serverID sacloudtypes.ID, jobType JobType, operation func(sv *sacloud.Server) error) JobID {
+	jobID := JobID(fmt.Sprintf("%s/%s/%s", jobType, zone, serverID))
+	status := &JobStatus{
+		ID:    jobID,
+		Type:  jobType,
+		State: JobStatePending,
+		Reference: &CloudObjectRef{
+			ServerID: serverID,
+		},
+	}
+	s.jobs.set(jobID, status)
+
+	s.jobs.run(status, func() {
+		status.setState(JobStateInFlight)
+
+		sv, err := s.serverOp().Read(ctx, zone, serverID)
+		if err != nil {
+			status.fail(err)
+			return
+		}
+		if err := operation(sv); err != nil {
+			status.fail(err)
+			return
+		}
+		status.setState(JobStateDone)
+	})
+
+	return jobID
+}
+
+func (s *serverClient) waitForUp(ctx context.Context, zone string, serverID sacloudtypes.ID) error {
+	_, err := sacloud.WaiterForUp(func() (interface{}, error) {
+		return s.serverOp().Read(ctx, zone, serverID)
+	}).WaitForState(ctx)
+	return err
+}
+
+func (s *serverClient) waitForDown(ctx context.Context, zone string, serverID sacloudtypes.ID) error {
+	_, err := sacloud.WaiterForDown(func() (interface{}, error) {
+		return s.serverOp().Read(ctx, zone, serverID)
+	}).WaitForState(ctx)
+	return err
+}
+
+// shutdownWithTimeout shuts down the server via ACPI, and powers it off forcibly if it isn't down within the timeout.
+// It returns how the server was shut down.
+func (s *serverClient) shutdownWithTimeout(ctx context.Context, zone string, serverID sacloudtypes.ID, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		if err := s.serverOp().Shutdown(ctx, zone, serverID, &sacloud.ShutdownOption{Force: false}); err != nil {
+			return "", err
+		}
+		waiter := sacloud.WaiterForDown(func() (interface{}, error) {
+			return s.serverOp().Read(ctx, zone, serverID)
+		}).(*sacloud.StatePollWaiter)
+		waiter.Timeout = timeout
+		if _, err := waiter.WaitForState(ctx); err == nil {
+			return "shut down gracefully", nil
+		}
+
+		// the server may have gone down after the timeout
+		sv, err := s.serverOp().Read(ctx, zone, serverID)
+		if err != nil {
+			return "", err
+		}
+		if sv.InstanceStatus.IsDown() {
+			return "shut down gracefully", nil
+		}
+	}
+
+	if err := s.serverOp().Shutdown(ctx, zone, serverID, &sacloud.ShutdownOption{Force: true}); err != nil {
+		return "", err
+	}
+	if err := s.waitForDown(ctx, zone, serverID); err != nil {
+		return "", err
+	}
+	if timeout > 0 {
+		return fmt.Sprintf("powered off forcibly after the shutdown timeout of %s", timeout), nil
+	}
+	return "powered off forcibly", nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+)
+
+func TestShutdownWithTimeout(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// record the shutdown requests, and ignore the graceful ones if the OS doesn't respond
+	op := &shutdownRecordingServerOp{ServerAPI: fake.NewServerOp()}
+	sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return op
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return fake.NewServerOp()
+	})
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	s := &serverClient{}
+	newServer := func() sacloudtypes.ID {
+		sv, err := s.serverOp().Create(ctx, zone, &sacloud.ServerCreateRequest{Name: "caps-example-md-0-a", CPU: 2, MemoryMB: 4096})
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(s.serverOp().Boot(ctx, zone, sv.ID)).To(gomega.Succeed())
+		g.Expect(s.waitForUp(ctx, zone, sv.ID)).To(gomega.Succeed())
+		return sv.ID
+	}
+	expectDown := func(id sacloudtypes.ID) {
+		sv, err := s.serverOp().Read(ctx, zone, id)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		g.Expect(sv.InstanceStatus.IsDown()).To(gomega.BeTrue())
+	}
+
+	// shut down gracefully within the timeout
+	id := newServer()
+	result, err := s.shutdownWithTimeout(ctx, zone, id, time.Second)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(result).To(gomega.Equal("shut down gracefully"))
+	g.Expect(op.takeRequests()).To(gomega.Equal([]bool{false}))
+	expectDown(id)
+
+	// powered off forcibly after the timeout
+	id = newServer()
+	op.setUnresponsive(true)
+	result, err = s.shutdownWithTimeout(ctx, zone, id, 100*time.Millisecond)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(result).To(gomega.Equal("powered off forcibly after the shutdown timeout of 100ms"))
+	g.Expect(op.takeRequests()).To(gomega.Equal([]bool{false, true}))
+	expectDown(id)
+
+	// powered off forcibly without the timeout
+	id = newServer()
+	result, err = s.shutdownWithTimeout(ctx, zone, id, 0)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(result).To(gomega.Equal("powered off forcibly"))
+	g.Expect(op.takeRequests()).To(gomega.Equal([]bool{true}))
+	expectDown(id)
+}
+
+type shutdownRecordingServerOp struct {
+	sacloud.ServerAPI
+
+	mu           sync.Mutex
+	requests     []bool
+	unresponsive bool
+}
+
+func (o *shutdownRecordingServerOp) Shutdown(ctx context.Context, zone string, id sacloudtypes.ID, option *sacloud.ShutdownOption) error {
+	o.mu.Lock()
+	o.requests = append(o.requests, option.Force)
+	ignored := o.unresponsive && !option.Force
+	o.mu.Unlock()
+
+	if ignored {
+		return nil
+	}
+	return o.ServerAPI.Shutdown(ctx, zone, id, option)
+}
+
+func (o *shutdownRecordingServerOp) setUnresponsive(unresponsive bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.unresponsive = unresponsive
+}
+
+// takeRequests returns the Force options of the shutdown requests and clears them
+func (o *shutdownRecordingServerOp) takeRequests() []bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	requests := o.requests
+	o.requests = nil
+	return requests
+}
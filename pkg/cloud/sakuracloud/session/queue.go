@@ -0,0 +1,189 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/metrics"
+)
+
+// provisionQueue bounds the number of servers provisioned at once in each zone.
+// Waiting jobs are started control-plane machines first, taking turns between the clusters
+// so that a large cluster doesn't starve the others, and in order of arrival within each cluster.
+type provisionQueue struct {
+	mu    sync.Mutex
+	limit int
+	zones map[string]*zoneQueue
+}
+
+type zoneQueue struct {
+	running int
+	// waiting is the jobs in order of arrival
+	waiting []*queueEntry
+	// lastCluster is the cluster of the job started last, the next job is taken from the clusters after it
+	lastCluster string
+}
+
+type queueEntry struct {
+	jobID    JobID
+	cluster  string
+	priority bool
+	ready    chan struct{}
+}
+
+func newProvisionQueue(limit int) *provisionQueue {
+	return &provisionQueue{
+		limit: limit,
+		zones: make(map[string]*zoneQueue),
+	}
+}
+
+func (q *provisionQueue) zone(zone string) *zoneQueue {
+	zq, ok := q.zones[zone]
+	if !ok {
+		zq = &zoneQueue{}
+		q.zones[zone] = zq
+	}
+	return zq
+}
+
+// acquire blocks until the job of the cluster can be started in the zone
+func (q *provisionQueue) acquire(ctx context.Context, zone string, jobID JobID, cluster string, priority bool) error {
+	q.mu.Lock()
+	zq := q.zone(zone)
+	if q.limit <= 0 || (zq.running < q.limit && len(zq.waiting) == 0) {
+		zq.running++
+		zq.lastCluster = cluster
+		q.report(zone)
+		q.mu.Unlock()
+		return nil
+	}
+
+	entry := &queueEntry{jobID: jobID, cluster: cluster, priority: priority, ready: make(chan struct{})}
+	zq.waiting = append(zq.waiting, entry)
+	q.report(zone)
+	q.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, e := range zq.waiting {
+			if e == entry {
+				zq.waiting = append(zq.waiting[:i], zq.waiting[i+1:]...)
+				q.report(zone)
+				return ctx.Err()
+			}
+		}
+		// started while being canceled
+		zq.running--
+		q.dispatch(zone)
+		return ctx.Err()
+	}
+}
+
+// release starts the next waiting job in the zone
+func (q *provisionQueue) release(zone string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.zone(zone).running--
+	q.dispatch(zone)
+}
+
+func (q *provisionQueue) dispatch(zone string) {
+	zq := q.zone(zone)
+	for len(zq.waiting) > 0 && (q.limit <= 0 || zq.running < q.limit) {
+		i := nextEntry(zq.waiting, zq.lastCluster)
+		entry := zq.waiting[i]
+		zq.waiting = append(zq.waiting[:i], zq.waiting[i+1:]...)
+		zq.running++
+		zq.lastCluster = entry.cluster
+		close(entry.ready)
+	}
+	q.report(zone)
+}
+
+// order returns the waiting jobs in the order they are started
+func (zq *zoneQueue) order() []*queueEntry {
+	waiting := append([]*queueEntry{}, zq.waiting...)
+	last := zq.lastCluster
+	var ordered []*queueEntry
+	for len(waiting) > 0 {
+		i := nextEntry(waiting, last)
+		ordered = append(ordered, waiting[i])
+		last = waiting[i].cluster
+		waiting = append(waiting[:i], waiting[i+1:]...)
+	}
+	return ordered
+}
+
+// nextEntry returns the index of the job started next: the control-plane machines go first,
+// and the oldest job of the cluster after the last started one in order of the names is taken.
+func nextEntry(waiting []*queueEntry, last string) int {
+	priority := false
+	for _, e := range waiting {
+		if e.priority {
+			priority = true
+			break
+		}
+	}
+	// the clusters after the last one, then the ones wrapped around
+	before := func(a, b string) bool {
+		if (a > last) != (b > last) {
+			return a > last
+		}
+		return a < b
+	}
+	next := -1
+	for i, e := range waiting {
+		if e.priority != priority {
+			continue
+		}
+		if next < 0 || before(e.cluster, waiting[next].cluster) {
+			next = i
+		}
+	}
+	return next
+}
+
+func (q *provisionQueue) report(zone string) {
+	zq := q.zone(zone)
+	metrics.SetProvisioningQueueDepth(zone, len(zq.waiting), zq.running)
+}
+
+// position returns the 1-based position of the job in the queue of the zone, or 0 if it isn't waiting
+func (q *provisionQueue) position(zone string, jobID JobID) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, e := range q.zone(zone).order() {
+		if e.jobID == jobID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// depth returns the number of the jobs waiting and running in the zone
+func (q *provisionQueue) depth(zone string) (waiting, running int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	zq := q.zone(zone)
+	return len(zq.waiting), zq.running
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+)
+
+func TestProvisionQueue(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	q := newProvisionQueue(1)
+
+	g.Expect(q.acquire(ctx, "is1a", "worker-0", "default/example", false)).To(gomega.Succeed())
+	// zones are independent
+	g.Expect(q.acquire(ctx, "tk1a", "worker-1", "default/example", false)).To(gomega.Succeed())
+
+	started := make(chan JobID, 2)
+	wait := func(jobID JobID, priority bool) {
+		go func() {
+			if err := q.acquire(ctx, "is1a", jobID, "default/example", priority); err == nil {
+				started <- jobID
+			}
+		}()
+		g.Eventually(func() int { return q.position("is1a", jobID) }).ShouldNot(gomega.BeZero())
+	}
+	wait("worker-2", false)
+	wait("controlplane-0", true)
+
+	g.Expect(q.position("is1a", "controlplane-0")).To(gomega.Equal(1))
+	g.Expect(q.position("is1a", "worker-2")).To(gomega.Equal(2))
+	waiting, running := q.depth("is1a")
+	g.Expect(waiting).To(gomega.Equal(2))
+	g.Expect(running).To(gomega.Equal(1))
+
+	q.release("is1a")
+	g.Eventually(started).Should(gomega.Receive(gomega.Equal(JobID("controlplane-0"))))
+	q.release("is1a")
+	g.Eventually(started).Should(gomega.Receive(gomega.Equal(JobID("worker-2"))))
+}
+
+func TestProvisionQueueTakesTurnsBetweenClusters(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ctx := context.Background()
+	q := newProvisionQueue(1)
+
+	g.Expect(q.acquire(ctx, "is1a", "large-worker-0", "default/large", false)).To(gomega.Succeed())
+
+	started := make(chan JobID, 5)
+	wait := func(jobID JobID, cluster string, priority bool) {
+		go func() {
+			if err := q.acquire(ctx, "is1a", jobID, cluster, priority); err == nil {
+				started <- jobID
+			}
+		}()
+		g.Eventually(func() int { return q.position("is1a", jobID) }).ShouldNot(gomega.BeZero())
+	}
+	wait("large-worker-1", "default/large", false)
+	wait("large-worker-2", "default/large", false)
+	wait("large-worker-3", "default/large", false)
+	wait("small-worker-0", "default/small", false)
+	wait("small-controlplane-0", "default/small", true)
+
+	// the control-plane machine goes first, and the small cluster doesn't wait for all workers of the large one
+	expected := []JobID{"small-controlplane-0", "large-worker-1", "small-worker-0", "large-worker-2", "large-worker-3"}
+	for i, jobID := range expected {
+		g.Expect(q.position("is1a", jobID)).To(gomega.Equal(i + 1))
+	}
+	for _, jobID := range expected {
+		q.release("is1a")
+		g.Eventually(started).Should(gomega.Receive(gomega.Equal(jobID)))
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package session
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sacloud/libsacloud/v2/sacloud"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+// quotaFindCount is the page size of the lookups of the resources counted against the quota
+const quotaFindCount = 1000
+
+// ResourceQuota is the limits of the resources of the account in each zone.
+// 0 means no limit.
+type ResourceQuota struct {
+	Servers  int
+	CPUs     int
+	MemoryGB int
+	DiskGB   int
+}
+
+// ResourceUsage is the amount of resources used by servers
+type ResourceUsage struct {
+	Servers  int
+	CPUs     int
+	MemoryGB int
+	DiskGB   int
+}
+
+func (u *ResourceUsage) add(other *ResourceUsage) {
+	u.Servers += other.Servers
+	u.CPUs += other.CPUs
+	u.MemoryGB += other.MemoryGB
+	u.DiskGB += other.DiskGB
+}
+
+// quotaReservations is the resources reserved by the builds whose servers aren't built yet,
+// so that the servers waiting in the provisioning queue are counted against the quota.
+// The servers and disks of the builds are counted by the reservations until the builds finish,
+// not by the usage read from the API, so that they aren't counted twice while being built.
+type quotaReservations struct {
+	mu    sync.Mutex
+	zones map[string]map[string]*quotaReservation
+
+	// checking serializes the checks of the quota, so that the resources are reserved
+	// before other servers are checked
+	checking sync.Mutex
+}
+
+// quotaReservation is the resources reserved for a server
+type quotaReservation struct {
+	usage      *ResourceUsage
+	serverName string
+	// diskNames is the names of the disks created for the server
+	diskNames []string
+}
+
+func newQuotaReservations() *quotaReservations {
+	return &quotaReservations{zones: make(map[string]map[string]*quotaReservation)}
+}
+
+// quotaReservationKey returns the key of the reservation of the server, which is unique across the clusters
+func quotaReservationKey(clusterName, nameSpace, serverName string) string {
+	return fmt.Sprintf("%s/%s/%s", nameSpace, clusterName, serverName)
+}
+
+// newQuotaReservation returns the reservation of the server built from the spec
+func newQuotaReservation(serverName string, spec *infrav1.SakuraCloudMachineSpec) *quotaReservation {
+	diskNames := []string{serverName}
+	for _, disk := range spec.AdditionalDisks {
+		diskNames = append(diskNames, fmt.Sprintf("%s-%s", serverName, disk.Name))
+	}
+	return &quotaReservation{usage: machineUsage(spec), serverName: serverName, diskNames: diskNames}
+}
+
+// reserve reserves the resources, replacing the previous reservation with the key
+func (r *quotaReservations) reserve(zone string, key string, reservation *quotaReservation) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.zones[zone] == nil {
+		r.zones[zone] = make(map[string]*quotaReservation)
+	}
+	r.zones[zone][key] = reservation
+}
+
+// release removes the reservation unless it has been replaced, e.g. by another run of the build
+func (r *quotaReservations) release(zone string, key string, reservation *quotaReservation) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.zones[zone][key] == reservation {
+		delete(r.zones[zone], key)
+	}
+}
+
+// total returns the resources reserved in the zone, and the names of the servers and disks reserved
+func (r *quotaReservations) total(zone string) (*ResourceUsage, map[string]bool, map[string]bool) {
+	total := &ResourceUsage{}
+	servers := make(map[string]bool)
+	disks := make(map[string]bool)
+	if r == nil {
+		return total, servers, disks
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reservation := range r.zones[zone] {
+		total.add(reservation.usage)
+		servers[reservation.serverName] = true
+		for _, name := range reservation.diskNames {
+			disks[name] = true
+		}
+	}
+	return total, servers, disks
+}
+
+// QuotaExceededError is returned when a server doesn't fit in the remaining quota
+type QuotaExceededError struct {
+	Zone     string
+	Exceeded []string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded in zone %q: %s", e.Zone, strings.Join(e.Exceeded, ", "))
+}
+
+// IsQuotaExceededError returns true if the error is a QuotaExceededError
+func IsQuotaExceededError(err error) bool {
+	_, ok := err.(*QuotaExceededError)
+	return ok
+}
+
+// machineUsage returns the resources used by the server built from the spec
+func machineUsage(spec *infrav1.SakuraCloudMachineSpec) *ResourceUsage {
+	usage := &ResourceUsage{
+		Servers:  1,
+		CPUs:     spec.CPUs,
+		MemoryGB: spec.MemoryGB,
+		DiskGB:   spec.DiskGB,
+	}
+	for _, disk := range spec.AdditionalDisks {
+		usage.DiskGB += disk.SizeGB
+	}
+	return usage
+}
+
+// check returns a QuotaExceededError if the requested resources don't fit in the quota
+func (q *ResourceQuota) check(zone string, used, requested *ResourceUsage) error {
+	var exceeded []string
+	limits := []struct {
+		name       string
+		limit      int
+		used, more int
+	}{
+		{name: "servers", limit: q.Servers, used: used.Servers, more: requested.Servers},
+		{name: "cpus", limit: q.CPUs, used: used.CPUs, more: requested.CPUs},
+		{name: "memoryGB", limit: q.MemoryGB, used: used.MemoryGB, more: requested.MemoryGB},
+		{name: "diskGB", limit: q.DiskGB, used: used.DiskGB, more: requested.DiskGB},
+	}
+	for _, l := range limits {
+		if l.limit > 0 && l.used+l.more > l.limit {
+			exceeded = append(exceeded, fmt.Sprintf("%s(used: %d, requested: %d, limit: %d)", l.name, l.used, l.more, l.limit))
+		}
+	}
+	if len(exceeded) > 0 {
+		return &QuotaExceededError{Zone: zone, Exceeded: exceeded}
+	}
+	return nil
+}
+
+func (q *ResourceQuota) isUnlimited() bool {
+	return q.Servers == 0 && q.CPUs == 0 && q.MemoryGB == 0 && q.DiskGB == 0
+}
+
+// ReserveQuota returns a QuotaExceededError if the server built from the spec doesn't fit in the remaining quota
+// of the account, otherwise reserves the resources for the server until it's built by Provision.
+// The usage includes the resources not owned by the clusters, and the ones reserved by the builds
+// waiting in the provisioning queue or in progress.
+func (s *serverClient) ReserveQuota(ctx context.Context, zone, clusterName, nameSpace, serverName string, spec *infrav1.SakuraCloudMachineSpec) error {
+	if s.quota.isUnlimited() {
+		return nil
+	}
+	if s.reservations != nil {
+		s.reservations.checking.Lock()
+		defer s.reservations.checking.Unlock()
+	}
+
+	used, reservedServers, reservedDisks := s.reservations.total(zone)
+	for from := 0; ; {
+		servers, err := s.serverOp().Find(ctx, zone, &sacloud.FindCondition{From: from, Count: quotaFindCount})
+		if err != nil {
+			return err
+		}
+		for _, sv := range servers.Servers {
+			if reservedServers[sv.Name] {
+				continue
+			}
+			used.Servers++
+			used.CPUs += sv.CPU
+			used.MemoryGB += sv.MemoryMB / 1024
+		}
+		from += len(servers.Servers)
+		if len(servers.Servers) == 0 || from >= servers.Total {
+			break
+		}
+	}
+	for from := 0; ; {
+		disks, err := s.diskOp().Find(ctx, zone, &sacloud.FindCondition{From: from, Count: quotaFindCount})
+		if err != nil {
+			return err
+		}
+		for _, disk := range disks.Disks {
+			if reservedDisks[disk.Name] {
+				continue
+			}
+			used.DiskGB += disk.SizeMB / 1024
+		}
+		from += len(disks.Disks)
+		if len(disks.Disks) == 0 || from >= disks.Total {
+			break
+		}
+	}
+
+	reservation := newQuotaReservation(serverName, spec)
+	if err := s.quota.check(zone, used, reservation.usage); err != nil {
+		return err
+	}
+	s.reservations.reserve(zone, quotaReservationKey(clusterName, nameSpace, serverName), reservation)
+	return nil
+}
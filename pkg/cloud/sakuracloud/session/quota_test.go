@@ -0,0 +1,154 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestQuotaCheck(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	requested := machineUsage(&infrav1.SakuraCloudMachineSpec{
+		CPUs:     2,
+		MemoryGB: 4,
+		DiskGB:   20,
+		AdditionalDisks: []infrav1.AdditionalDisk{
+			{Name: "etcd", SizeGB: 40},
+		},
+	})
+	g.Expect(requested).To(gomega.Equal(&ResourceUsage{Servers: 1, CPUs: 2, MemoryGB: 4, DiskGB: 60}))
+
+	used := &ResourceUsage{Servers: 9, CPUs: 18, MemoryGB: 36, DiskGB: 500}
+
+	unlimited := &ResourceQuota{}
+	g.Expect(unlimited.check("is1a", used, requested)).To(gomega.Succeed())
+
+	quota := &ResourceQuota{Servers: 10, CPUs: 20, DiskGB: 560}
+	g.Expect(quota.check("is1a", used, requested)).To(gomega.Succeed())
+
+	quota = &ResourceQuota{Servers: 9, CPUs: 20, DiskGB: 500}
+	err := quota.check("is1a", used, requested)
+	g.Expect(IsQuotaExceededError(err)).To(gomega.BeTrue())
+	g.Expect(err.(*QuotaExceededError).Exceeded).To(gomega.HaveLen(2))
+	g.Expect(err.Error()).To(gomega.ContainSubstring("servers(used: 9, requested: 1, limit: 9)"))
+}
+
+func TestReserveQuotaCountsQueuedBuilds(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	jobs := &jobRegistry{}
+	events := jobs.subscribe()
+	s := &serverClient{
+		jobs:         jobs,
+		queue:        newProvisionQueue(1),
+		quota:        &ResourceQuota{Servers: 2, CPUs: 8},
+		reservations: newQuotaReservations(),
+	}
+	spec := &infrav1.SakuraCloudMachineSpec{CPUs: 2, MemoryGB: 4}
+	reserve := func(serverName string) error {
+		return s.ReserveQuota(ctx, zone, "caps-example", "default", serverName, spec)
+	}
+
+	// a server exists and the queue is full
+	_, err := s.serverOp().Create(ctx, zone, &sacloud.ServerCreateRequest{Name: "caps-example-controlplane-0", CPU: 2, MemoryMB: 4096})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(s.queue.acquire(ctx, zone, "build/running", "default/caps-example", false)).To(gomega.Succeed())
+	defer s.queue.release(zone)
+
+	// the check reserves the resources, so that the next check counts them before the build starts
+	g.Expect(reserve("caps-example-md-0-a")).To(gomega.Succeed())
+	err = reserve("caps-example-md-0-b")
+	g.Expect(IsQuotaExceededError(err)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("servers(used: 2, requested: 1, limit: 2)"))
+
+	// the build waiting in the queue takes over the reservation
+	jobID := s.Provision(ctx, zone, &ServerBuildParameter{ServerName: "caps-example-md-0-a", ClusterName: "caps-example", NameSpace: "default", Spec: *spec})
+	g.Expect(IsQuotaExceededError(reserve("caps-example-md-0-b"))).To(gomega.BeTrue())
+
+	// the reservation is released when the build is canceled
+	g.Expect(jobs.cancel(jobID)).To(gomega.BeTrue())
+	g.Eventually(events).Should(gomega.Receive(gomega.Equal(JobEvent{ID: jobID, State: JobStateFailed})))
+	g.Expect(reserve("caps-example-md-0-b")).To(gomega.Succeed())
+}
+
+func TestReserveQuotaExcludesServersBeingBuilt(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	s := &serverClient{
+		quota:        &ResourceQuota{Servers: 2, DiskGB: 100},
+		reservations: newQuotaReservations(),
+	}
+	spec := &infrav1.SakuraCloudMachineSpec{CPUs: 2, MemoryGB: 4, DiskGB: 20, AdditionalDisks: []infrav1.AdditionalDisk{{Name: "etcd", SizeGB: 20}}}
+	g.Expect(s.ReserveQuota(ctx, zone, "caps-example", "default", "caps-example-md-0-a", spec)).To(gomega.Succeed())
+
+	// the server and the disks created by the build in progress are counted once by the reservation
+	_, err := s.serverOp().Create(ctx, zone, &sacloud.ServerCreateRequest{Name: "caps-example-md-0-a", CPU: 2, MemoryMB: 4096})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	for _, name := range []string{"caps-example-md-0-a", "caps-example-md-0-a-etcd"} {
+		_, err := s.diskOp().Create(ctx, zone, &sacloud.DiskCreateRequest{Name: name, SizeMB: 20 * 1024}, nil)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+	}
+	g.Expect(s.ReserveQuota(ctx, zone, "caps-example", "default", "caps-example-md-0-b", spec)).To(gomega.Succeed())
+
+	err = s.ReserveQuota(ctx, zone, "caps-example", "default", "caps-example-md-0-c", spec)
+	g.Expect(IsQuotaExceededError(err)).To(gomega.BeTrue())
+	g.Expect(err.Error()).To(gomega.ContainSubstring("servers(used: 2, requested: 1, limit: 2)"))
+}
+
+func TestQuotaReservations(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	spec := func(cpus int) *infrav1.SakuraCloudMachineSpec {
+		return &infrav1.SakuraCloudMachineSpec{CPUs: cpus}
+	}
+	reservations := newQuotaReservations()
+	first := newQuotaReservation("a", spec(2))
+	reservations.reserve("is1a", "default/example/a", first)
+	reservations.reserve("is1a", "default/example/b", newQuotaReservation("b", spec(4)))
+	reservations.reserve("tk1a", "default/example/c", newQuotaReservation("c", spec(8)))
+	total, servers, disks := reservations.total("is1a")
+	g.Expect(total).To(gomega.Equal(&ResourceUsage{Servers: 2, CPUs: 6}))
+	g.Expect(servers).To(gomega.Equal(map[string]bool{"a": true, "b": true}))
+	g.Expect(disks).To(gomega.Equal(map[string]bool{"a": true, "b": true}))
+
+	// the reservation of the retried build isn't released by the previous run
+	retried := newQuotaReservation("a", spec(2))
+	reservations.reserve("is1a", "default/example/a", retried)
+	reservations.release("is1a", "default/example/a", first)
+	total, _, _ = reservations.total("is1a")
+	g.Expect(total).To(gomega.Equal(&ResourceUsage{Servers: 2, CPUs: 6}))
+	reservations.release("is1a", "default/example/a", retried)
+	total, _, _ = reservations.total("is1a")
+	g.Expect(total).To(gomega.Equal(&ResourceUsage{Servers: 1, CPUs: 4}))
+
+	// nil reservations, e.g. of the clients in the tests, count nothing
+	var none *quotaReservations
+	none.reserve("is1a", "default/example/a", first)
+	total, _, _ = none.total("is1a")
+	g.Expect(total).To(gomega.Equal(&ResourceUsage{}))
+}
@@ -26,6 +26,7 @@ import (
 	"text/template"
 
 	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	"github.com/sacloud/libsacloud/v2/sacloud/search/keys"
 
 	"github.com/sacloud/ftps"
 	"github.com/sacloud/libsacloud/v2/sacloud"
@@ -36,8 +37,11 @@ import (
 )
 
 type serverClient struct {
-	caller sacloud.APICaller
-	jobs   *jobRegistry
+	caller       sacloud.APICaller
+	jobs         *jobRegistry
+	queue        *provisionQueue
+	quota        *ResourceQuota
+	reservations *quotaReservations
 }
 
 func (s *serverClient) serverOp() sacloud.ServerAPI {
@@ -52,33 +56,58 @@ func (s *serverClient) archiveOp() sacloud.ArchiveAPI {
 	return sacloud.NewArchiveOp(s.caller)
 }
 
-func (s *serverClient) ReadArchive(ctx context.Context, zone string, archiveID sacloudtypes.ID) (*sacloud.Archive, error) {
-	return s.archiveOp().Read(ctx, zone, archiveID)
+func (s *serverClient) diskOp() sacloud.DiskAPI {
+	return sacloud.NewDiskOp(s.caller)
 }
 
-func (s *serverClient) FindArchive(ctx context.Context, zone string, filters []infrav1.Filter) (*sacloud.Archive, error) {
-	condition := &sacloud.FindCondition{
-		Filter: search.Filter{},
-	}
-	for _, filter := range filters {
-		condition.Filter[search.Key(filter.Name)] = search.ExactMatch(filter.Values...)
-	}
+func (s *serverClient) serverPlanOp() sacloud.ServerPlanAPI {
+	return sacloud.NewServerPlanOp(s.caller)
+}
 
-	searched, err := s.archiveOp().Find(ctx, zone, condition)
+// FindServerPlan returns the server plan used for the spec, or nil if no plan is available in the zone
+func (s *serverClient) FindServerPlan(ctx context.Context, zone string, spec *infrav1.SakuraCloudMachineSpec) (*sacloud.ServerPlan, error) {
+	searched, err := s.serverPlanOp().Find(ctx, zone, serverPlanFindCondition(spec))
 	if err != nil {
 		return nil, err
 	}
-	if searched.Count == 0 {
-		return nil, nil
+	for _, plan := range searched.ServerPlans {
+		if plan.Availability.IsAvailable() {
+			return plan, nil
+		}
 	}
-	return searched.Archives[0], nil
+	return nil, nil
+}
+
+// serverPlanFindCondition returns the condition to find the plans for the spec, the newest generation first
+func serverPlanFindCondition(spec *infrav1.SakuraCloudMachineSpec) *sacloud.FindCondition {
+	condition := &sacloud.FindCondition{
+		Sort: search.SortKeys{
+			{Key: "Generation", Order: search.SortDesc},
+		},
+		Filter: search.Filter{
+			search.Key("CPU"):        spec.CPUs,
+			search.Key("MemoryMB"):   spec.MemoryGB * 1024,
+			search.Key("Commitment"): commitment(spec.Commitment),
+		},
+		Count: 1000,
+	}
+	if spec.Generation != 0 {
+		condition.Filter[search.Key("Generation")] = spec.Generation
+	}
+	return condition
 }
 
 func (s *serverClient) Read(ctx context.Context, zone string, id sacloudtypes.ID) (*sacloud.Server, error) {
 	return s.serverOp().Read(ctx, zone, id)
 }
 
-func (s *serverClient) Cleanup(ctx context.Context, zone string, serverID sacloudtypes.ID) JobID {
+func (s *serverClient) ReadISOImage(ctx context.Context, zone string, id sacloudtypes.ID) (*sacloud.CDROM, error) {
+	return s.isoImageOp().Read(ctx, zone, id)
+}
+
+// Cleanup shuts down the server and deletes it with its disks, ISO image and backups.
+// The disks selected by the deletion policy are retained or archived before the deletion.
+func (s *serverClient) Cleanup(ctx context.Context, zone string, serverID sacloudtypes.ID, param *ServerCleanupParameter) JobID {
 	jobID := JobID(fmt.Sprintf("cleanup/%s/%s", zone, serverID))
 	status := &JobStatus{
 		ID:    jobID,
@@ -90,113 +119,224 @@ func (s *serverClient) Cleanup(ctx context.Context, zone string, serverID saclou
 	}
 	s.jobs.set(jobID, status)
 
-	go func() {
-		status.State = JobStateInFlight
+	s.jobs.run(status, func() {
+		status.setState(JobStateInFlight)
 
 		sv, err := s.serverOp().Read(ctx, zone, serverID)
 		if err != nil {
 			if sacloud.IsNotFoundError(err) {
-				status.State = JobStateDone
+				// backups may be left by the previous attempt
+				if err := s.DeleteBackups(ctx, zone, param.ClusterName, param.NameSpace, param.ServerName); err != nil {
+					status.fail(err)
+					return
+				}
+				status.setResult("server was already deleted")
+				status.setState(JobStateDone)
 				return
 			}
-			status.Error = err
-			status.State = JobStateFailed
+			status.fail(err)
 			return
 		}
 
 		// shutdown
+		status.setResult("server was already powered off")
 		if sv.InstanceStatus.IsUp() {
-			if err := s.serverOp().Shutdown(ctx, zone, serverID, &sacloud.ShutdownOption{Force: true}); err != nil {
-				status.Error = err
-				status.State = JobStateFailed
-				return
-			}
-
-			if _, err := sacloud.WaiterForDown(func() (interface{}, error) {
-				return s.serverOp().Read(ctx, zone, serverID)
-			}).WaitForState(ctx); err != nil {
-				status.Error = err
-				status.State = JobStateFailed
+			status.setProgress("shutting down server")
+			result, err := s.shutdownWithTimeout(ctx, zone, serverID, param.ShutdownTimeout)
+			if err != nil {
+				status.fail(err)
 				return
 			}
+			status.setResult(result)
 		}
 
-		// delete server+disks
-		var diskIDs []sacloudtypes.ID
-		for _, disk := range sv.Disks {
-			diskIDs = append(diskIDs, disk.ID)
+		// retain or archive disks, and delete server+other disks
+		diskIDs, err := s.applyDeletionPolicy(ctx, zone, sv, param, status)
+		if err != nil {
+			status.fail(err)
+			return
 		}
-		if err := s.serverOp().DeleteWithDisks(ctx, zone, serverID, &sacloud.ServerDeleteWithDisksRequest{IDs: diskIDs}); err != nil {
-			status.Error = err
-			status.State = JobStateFailed
+		status.setProgress("deleting server")
+		if err := s.deleteWithDisks(ctx, zone, serverID, diskIDs); err != nil {
+			status.fail(err)
 			return
 		}
 
 		// delete iso-image
 		if !sv.CDROMID.IsEmpty() {
-			if err := s.isoImageOp().Delete(ctx, zone, sv.CDROMID); err != nil {
-				status.Error = err
-				status.State = JobStateFailed
+			if err := s.isoImageOp().Delete(ctx, zone, sv.CDROMID); err != nil && !sacloud.IsNotFoundError(err) {
+				status.fail(err)
 				return
 			}
 		}
 
-		status.State = JobStateDone
-	}()
+		// delete backups
+		status.setProgress("deleting backups")
+		if err := s.DeleteBackups(ctx, zone, param.ClusterName, param.NameSpace, param.ServerName); err != nil {
+			status.fail(err)
+			return
+		}
+
+		status.setState(JobStateDone)
+	})
 
 	return jobID
 }
 
+// deleteWithDisks deletes the server with the disks.
+// The server or some of the disks may be already deleted, e.g. by hand, so they are deleted one by one on NotFound.
+func (s *serverClient) deleteWithDisks(ctx context.Context, zone string, serverID sacloudtypes.ID, diskIDs []sacloudtypes.ID) error {
+	err := s.serverOp().DeleteWithDisks(ctx, zone, serverID, &sacloud.ServerDeleteWithDisksRequest{IDs: diskIDs})
+	if err == nil || !sacloud.IsNotFoundError(err) {
+		return err
+	}
+
+	if err := s.serverOp().Delete(ctx, zone, serverID); err != nil && !sacloud.IsNotFoundError(err) {
+		return err
+	}
+	for _, diskID := range diskIDs {
+		if err := s.diskOp().Delete(ctx, zone, diskID); err != nil && !sacloud.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteBuildLeftovers deletes the server and the disks created by the failed build.
+// It returns the ID of the server if it couldn't be deleted.
+func (s *serverClient) deleteBuildLeftovers(ctx context.Context, zone string, param *ServerBuildParameter, diskNames []string) (sacloudtypes.ID, error) {
+	condition := &sacloud.FindCondition{
+		Filter: search.Filter{
+			search.Key(keys.Tags): search.TagsAndEqual(clusterTags(param.ClusterName, param.NameSpace)...),
+		},
+	}
+
+	servers, err := s.serverOp().Find(ctx, zone, condition)
+	if err != nil {
+		return sacloudtypes.ID(0), err
+	}
+	for _, sv := range servers.Servers {
+		if sv.Name != param.ServerName {
+			continue
+		}
+		var diskIDs []sacloudtypes.ID
+		for _, disk := range sv.Disks {
+			diskIDs = append(diskIDs, disk.ID)
+		}
+		if err := s.deleteWithDisks(ctx, zone, sv.ID, diskIDs); err != nil {
+			return sv.ID, err
+		}
+	}
+
+	// the disks which weren't connected to the server yet
+	names := make(map[string]bool)
+	for _, name := range diskNames {
+		names[name] = true
+	}
+	disks, err := s.diskOp().Find(ctx, zone, condition)
+	if err != nil {
+		return sacloudtypes.ID(0), err
+	}
+	for _, disk := range disks.Disks {
+		if !names[disk.Name] {
+			continue
+		}
+		if err := s.diskOp().Delete(ctx, zone, disk.ID); err != nil && !sacloud.IsNotFoundError(err) {
+			return sacloudtypes.ID(0), err
+		}
+	}
+	return sacloudtypes.ID(0), nil
+}
+
 func (s *serverClient) Provision(ctx context.Context, zone string, param *ServerBuildParameter) JobID {
-	jobID := JobID(fmt.Sprintf("build/%s/%s/%s", param.NameSpace, param.ClusterName, param.ServerName))
+	jobID := JobID(fmt.Sprintf("build/%s/%s/%s/%s", zone, param.NameSpace, param.ClusterName, param.ServerName))
+	// the job is canceled while waiting in the queue if it's deleted, e.g. because the machine is deleted
+	waitCtx, cancel := context.WithCancel(ctx)
 	status := &JobStatus{
-		ID:    jobID,
-		Type:  JobTypeProvisioning,
-		State: JobStatePending,
+		ID:         jobID,
+		Type:       JobTypeProvisioning,
+		State:      JobStatePending,
+		cancelWait: cancel,
 	}
 	s.jobs.set(jobID, status)
 
-	go func() {
-		status.State = JobStateInFlight
+	// the resources are counted against the quota by the reservation until the server is built,
+	// replacing the one made by ReserveQuota
+	reservationKey := quotaReservationKey(param.ClusterName, param.NameSpace, param.ServerName)
+	reservation := newQuotaReservation(param.ServerName, &param.Spec)
+	s.reservations.reserve(zone, reservationKey, reservation)
+
+	s.jobs.run(status, func() {
+		defer cancel()
+		defer s.reservations.release(zone, reservationKey, reservation)
+
+		builder, err := s.createBuilder(zone, param)
+		if err != nil {
+			status.fail(err)
+			return
+		}
+
+		status.setProgress("waiting in the provisioning queue")
+		cluster := fmt.Sprintf("%s/%s", param.NameSpace, param.ClusterName)
+		if err := s.queue.acquire(waitCtx, zone, jobID, cluster, param.IsControlPlane); err != nil {
+			status.fail(err)
+			return
+		}
+		defer s.queue.release(zone)
+
+		status.setProgress("")
+		if !status.start() {
+			status.fail(context.Canceled)
+			return
+		}
+		s.jobs.notify(status) // the position in the queue is changed
 
 		// build server
 		builderClient := server.NewBuildersAPIClient(s.caller)
-		builder := s.createBuilder(param)
 		result, err := builder.Build(ctx, builderClient, zone)
 		if err != nil {
-			status.Error = err
-			status.State = JobStateFailed
+			// the build doesn't return the server created before the failure,
+			// which is deleted so that the retry doesn't create another one
+			leftID, cleanupErr := s.deleteBuildLeftovers(ctx, zone, param, reservation.diskNames)
+			s.reservations.release(zone, reservationKey, reservation)
+			if cleanupErr != nil {
+				// the server left is adopted, and deleted with the machine instead of retrying
+				if !leftID.IsEmpty() {
+					status.setReference(&CloudObjectRef{ServerID: leftID})
+				}
+				err = fmt.Errorf("%v, and the resources created by the build couldn't be deleted: %v", err, cleanupErr)
+			}
+			status.fail(err)
 			return
 		}
+		s.reservations.release(zone, reservationKey, reservation)
 		if result != nil {
-			status.Reference = &CloudObjectRef{ServerID: result.ServerID}
+			status.setReference(&CloudObjectRef{ServerID: result.ServerID})
 		}
 
 		// build iso-image
 		sv, err := s.serverOp().Read(ctx, zone, result.ServerID)
 		if err != nil {
-			status.Error = err
-			status.State = JobStateFailed
+			status.fail(err)
 			return
 		}
 		isoImage, err := s.buildISOImage(ctx, zone, sv, param)
 		if err != nil {
-			status.Error = err
-			status.State = JobStateFailed
+			status.fail(err)
 			return
 		}
-		status.Reference.ISOImageID = isoImage.ID
+		status.update(func(job *JobStatus) {
+			job.Reference.ISOImageID = isoImage.ID
+		})
 
 		// insert
 		if err := s.serverOp().InsertCDROM(ctx, zone, sv.ID, &sacloud.InsertCDROMRequest{ID: isoImage.ID}); err != nil {
-			status.Error = err
-			status.State = JobStateFailed
+			status.fail(err)
 			return
 		}
 
 		if err := s.serverOp().Boot(ctx, zone, sv.ID); err != nil {
-			status.Error = err
-			status.State = JobStateFailed
+			status.fail(err)
 			return
 		}
 
@@ -204,49 +344,122 @@ func (s *serverClient) Provision(ctx context.Context, zone string, param *Server
 			return s.serverOp().Read(ctx, zone, sv.ID)
 		}).WaitForState(ctx)
 		if err != nil {
-			status.Error = err
-			status.State = JobStateFailed
+			status.fail(err)
 			return
 		}
 
-		status.State = JobStateDone
-	}()
+		status.setState(JobStateDone)
+	})
 
 	return jobID
 }
 
-func (s *serverClient) buildTagsFromContext(clusterName, nameSpace string, isControlPlane bool) sacloudtypes.Tags {
-	return sacloudtypes.Tags{
-		fmt.Sprintf("cluster=%s", clusterName),
-		fmt.Sprintf("ns=%s", nameSpace),
+func (s *serverClient) buildTagsFromContext(zone, clusterName, nameSpace string, isControlPlane bool) sacloudtypes.Tags {
+	return append(clusterTags(clusterName, nameSpace),
 		fmt.Sprintf("control-plane=%t", isControlPlane), // util.IsControlPlaneMachine(ctx.Machine)
-	}
+		fmt.Sprintf("zone=%s", zone),
+	)
 }
 
-func (s *serverClient) createBuilder(param *ServerBuildParameter) *server.Builder {
+func (s *serverClient) createBuilder(zone string, param *ServerBuildParameter) (*server.Builder, error) {
+	tags := s.buildTagsFromContext(zone, param.ClusterName, param.NameSpace, param.IsControlPlane)
+	diskBuilders := []server.DiskBuilder{
+		&server.FromDiskOrArchiveDiskBuilder{
+			SourceArchiveID: sacloudtypes.StringID(param.SourceArchiveID),
+			Name:            param.ServerName,
+			SizeGB:          param.Spec.DiskGB,
+			PlanID:          diskPlanID(param.Spec.DiskPlan),
+			Connection:      diskConnection(param.Spec.DiskConnection),
+			Description:     "",
+			Tags:            tags,
+		},
+	}
+	for _, disk := range param.Spec.AdditionalDisks {
+		diskBuilder, err := s.createAdditionalDiskBuilder(param.ServerName, tags, &disk)
+		if err != nil {
+			return nil, err
+		}
+		diskBuilders = append(diskBuilders, diskBuilder)
+	}
+
 	return &server.Builder{
 		Name:            param.ServerName,
 		CPU:             param.Spec.CPUs,
 		MemoryGB:        param.Spec.MemoryGB,
-		Commitment:      sacloudtypes.Commitments.Standard,
-		Generation:      sacloudtypes.PlanGenerations.Default,
-		InterfaceDriver: sacloudtypes.InterfaceDrivers.VirtIO,
+		Commitment:      commitment(param.Spec.Commitment),
+		Generation:      planGeneration(param),
+		InterfaceDriver: interfaceDriver(param.Spec.InterfaceDriver),
 		Description:     "", // TODO 何か入れる?
-		Tags:            s.buildTagsFromContext(param.ClusterName, param.NameSpace, param.IsControlPlane),
-		BootAfterCreate: false,                      // for insert ISO-Image with metadata
-		NIC:             &server.SharedNICSetting{}, // TODO あとで直す
-		DiskBuilders: []server.DiskBuilder{
-			&server.FromDiskOrArchiveDiskBuilder{
-				SourceArchiveID: sacloudtypes.StringID(param.SourceArchiveID),
-				Name:            param.ServerName,
-				SizeGB:          param.Spec.DiskGB,
-				PlanID:          sacloudtypes.DiskPlans.SSD,
-				Connection:      sacloudtypes.DiskConnections.VirtIO,
-				Description:     "",
-				Tags:            s.buildTagsFromContext(param.ClusterName, param.NameSpace, param.IsControlPlane),
-			},
-		},
+		Tags:            tags,
+		BootAfterCreate: false, // for insert ISO-Image with metadata
+		NIC:             &server.SharedNICSetting{PacketFilterID: sacloudtypes.StringID(param.PacketFilterID)},
+		DiskBuilders:    diskBuilders,
+	}, nil
+}
+
+// createAdditionalDiskBuilder returns the builder of the disk.
+// The source archive must be resolved by the controller, otherwise the disk would be created blank.
+func (s *serverClient) createAdditionalDiskBuilder(serverName string, serverTags sacloudtypes.Tags, disk *infrav1.AdditionalDisk) (server.DiskBuilder, error) {
+	name := fmt.Sprintf("%s-%s", serverName, disk.Name)
+	tags := append(append(sacloudtypes.Tags{}, serverTags...), disk.Tags...)
+
+	if disk.SourceArchive != nil {
+		if disk.SourceArchive.ID == nil {
+			return nil, &invalidConfigurationError{message: fmt.Sprintf("the source archive of the additional disk %q is not resolved", disk.Name)}
+		}
+		return &server.FromDiskOrArchiveDiskBuilder{
+			SourceArchiveID: sacloudtypes.StringID(*disk.SourceArchive.ID),
+			Name:            name,
+			SizeGB:          disk.SizeGB,
+			PlanID:          diskPlanID(disk.Plan),
+			Connection:      diskConnection(disk.Connection),
+			Tags:            tags,
+		}, nil
+	}
+	return &server.BlankDiskBuilder{
+		Name:       name,
+		SizeGB:     disk.SizeGB,
+		PlanID:     diskPlanID(disk.Plan),
+		Connection: diskConnection(disk.Connection),
+		Tags:       tags,
+	}, nil
+}
+
+// planGeneration returns the generation of the plan resolved by FindServerPlan,
+// so that the server is created with the plan recorded in the status
+func planGeneration(param *ServerBuildParameter) sacloudtypes.EPlanGeneration {
+	if param.PlanGeneration != 0 {
+		return sacloudtypes.EPlanGeneration(param.PlanGeneration)
+	}
+	return sacloudtypes.EPlanGeneration(param.Spec.Generation)
+}
+
+func commitment(commitment infrav1.Commitment) sacloudtypes.ECommitment {
+	if commitment == infrav1.CommitmentDedicatedCPU {
+		return sacloudtypes.Commitments.DedicatedCPU
+	}
+	return sacloudtypes.Commitments.Standard
+}
+
+func interfaceDriver(driver infrav1.InterfaceDriver) sacloudtypes.EInterfaceDriver {
+	if driver == infrav1.InterfaceDriverE1000 {
+		return sacloudtypes.InterfaceDrivers.E1000
+	}
+	return sacloudtypes.InterfaceDrivers.VirtIO
+}
+
+func diskPlanID(plan infrav1.DiskPlan) sacloudtypes.ID {
+	if plan == infrav1.DiskPlanHDD {
+		return sacloudtypes.DiskPlans.HDD
+	}
+	return sacloudtypes.DiskPlans.SSD
+}
+
+func diskConnection(connection infrav1.DiskConnection) sacloudtypes.EDiskConnection {
+	if connection == infrav1.DiskConnectionIDE {
+		return sacloudtypes.DiskConnections.IDE
 	}
+	return sacloudtypes.DiskConnections.VirtIO
 }
 
 func (s *serverClient) buildISOImage(ctx context.Context, zone string, sv *sacloud.Server, param *ServerBuildParameter) (*sacloud.CDROM, error) {
@@ -261,7 +474,7 @@ func (s *serverClient) buildISOImage(ctx context.Context, zone string, sv *saclo
 
 	// create ISO image on SakuraCloud
 	isoImage, ftpInfo, err := s.isoImageOp().Create(ctx, zone, &sacloud.CDROMCreateRequest{
-		SizeMB:      5 * 1024,
+		SizeMB:      isoImageSizeGB * 1024,
 		Name:        param.ServerName,
 		Description: "",
 		Tags:        sv.Tags,
@@ -297,7 +510,7 @@ func (s *serverClient) buildISOImage(ctx context.Context, zone string, sv *saclo
 
 	ftpsClient := ftps.NewClient(ftpInfo.User, ftpInfo.Password, ftpInfo.HostName)
 	if err := ftpsClient.UploadFile("cloud-init.iso", isoFile); err != nil {
-		return nil, err
+		return nil, &uploadError{err: err}
 	}
 
 	// close FTP
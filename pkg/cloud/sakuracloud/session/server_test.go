@@ -0,0 +1,325 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package session
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/onsi/gomega"
+	"github.com/sacloud/libsacloud/v2/sacloud"
+	"github.com/sacloud/libsacloud/v2/sacloud/fake"
+	"github.com/sacloud/libsacloud/v2/sacloud/search"
+	sacloudtypes "github.com/sacloud/libsacloud/v2/sacloud/types"
+	"github.com/sacloud/libsacloud/v2/utils/server"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestCreateAdditionalDiskBuilder(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	s := &serverClient{}
+	serverTags := sacloudtypes.Tags{"cluster=caps-example", "ns=default"}
+
+	// a disk without the source archive is a blank disk with the default plan and connection
+	builder, err := s.createAdditionalDiskBuilder("caps-example-controlplane-0", serverTags, &infrav1.AdditionalDisk{
+		Name:   "etcd",
+		SizeGB: 40,
+		Tags:   []string{"etcd"},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(builder).To(gomega.Equal(&server.BlankDiskBuilder{
+		Name:       "caps-example-controlplane-0-etcd",
+		SizeGB:     40,
+		PlanID:     sacloudtypes.DiskPlans.SSD,
+		Connection: sacloudtypes.DiskConnections.VirtIO,
+		Tags:       sacloudtypes.Tags{"cluster=caps-example", "ns=default", "etcd"},
+	}))
+	// the tags of the server aren't modified
+	g.Expect(serverTags).To(gomega.HaveLen(2))
+
+	// a disk with the resolved source archive is copied from it
+	id := "123456789012"
+	builder, err = s.createAdditionalDiskBuilder("caps-example-controlplane-0", serverTags, &infrav1.AdditionalDisk{
+		Name:          "data",
+		SizeGB:        100,
+		Plan:          infrav1.DiskPlanHDD,
+		Connection:    infrav1.DiskConnectionIDE,
+		SourceArchive: &infrav1.SourceArchiveReference{SakuraCloudResourceReference: infrav1.SakuraCloudResourceReference{ID: &id}},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(builder).To(gomega.Equal(&server.FromDiskOrArchiveDiskBuilder{
+		SourceArchiveID: sacloudtypes.StringID(id),
+		Name:            "caps-example-controlplane-0-data",
+		SizeGB:          100,
+		PlanID:          sacloudtypes.DiskPlans.HDD,
+		Connection:      sacloudtypes.DiskConnections.IDE,
+		Tags:            serverTags,
+	}))
+
+	// a source archive not resolved is an invalid configuration instead of a blank disk
+	_, err = s.createAdditionalDiskBuilder("caps-example-controlplane-0", serverTags, &infrav1.AdditionalDisk{
+		Name:          "data",
+		SizeGB:        100,
+		SourceArchive: &infrav1.SourceArchiveReference{},
+	})
+	g.Expect(err).To(gomega.HaveOccurred())
+	g.Expect(ClassifyError(err)).To(gomega.Equal(ErrorKindInvalidConfiguration))
+}
+
+func TestCreateBuilderDisks(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	s := &serverClient{}
+	builder, err := s.createBuilder("is1a", &ServerBuildParameter{
+		ServerName:      "caps-example-md-0-xxxxx",
+		ClusterName:     "caps-example",
+		NameSpace:       "default",
+		SourceArchiveID: "123456789012",
+		Spec: infrav1.SakuraCloudMachineSpec{
+			DiskGB:         20,
+			DiskPlan:       infrav1.DiskPlanHDD,
+			DiskConnection: infrav1.DiskConnectionIDE,
+			AdditionalDisks: []infrav1.AdditionalDisk{
+				{Name: "etcd", SizeGB: 40},
+				{Name: "data", SizeGB: 100, Plan: infrav1.DiskPlanHDD},
+			},
+		},
+	})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(builder.DiskBuilders).To(gomega.HaveLen(3))
+
+	boot := builder.DiskBuilders[0].(*server.FromDiskOrArchiveDiskBuilder)
+	g.Expect(boot.Name).To(gomega.Equal("caps-example-md-0-xxxxx"))
+	g.Expect(boot.SourceArchiveID).To(gomega.Equal(sacloudtypes.StringID("123456789012")))
+	g.Expect(boot.PlanID).To(gomega.Equal(sacloudtypes.DiskPlans.HDD))
+	g.Expect(boot.Connection).To(gomega.Equal(sacloudtypes.DiskConnections.IDE))
+
+	// each additional disk has its own name, plan and connection
+	etcd := builder.DiskBuilders[1].(*server.BlankDiskBuilder)
+	g.Expect(etcd.Name).To(gomega.Equal("caps-example-md-0-xxxxx-etcd"))
+	g.Expect(etcd.PlanID).To(gomega.Equal(sacloudtypes.DiskPlans.SSD))
+	g.Expect(etcd.Connection).To(gomega.Equal(sacloudtypes.DiskConnections.VirtIO))
+	data := builder.DiskBuilders[2].(*server.BlankDiskBuilder)
+	g.Expect(data.Name).To(gomega.Equal("caps-example-md-0-xxxxx-data"))
+	g.Expect(data.PlanID).To(gomega.Equal(sacloudtypes.DiskPlans.HDD))
+}
+
+func TestFindServerPlan(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// the API returns the plans sorted by the condition
+	plans := &stubServerPlanOp{plans: []*sacloud.ServerPlan{
+		{ID: 200002004, CPU: 2, MemoryMB: 4096, Generation: 200, Availability: sacloudtypes.Availabilities.Discontinued},
+		{ID: 100002004, CPU: 2, MemoryMB: 4096, Generation: 100, Availability: sacloudtypes.Availabilities.Available},
+	}}
+	sacloud.SetClientFactoryFunc(fake.ResourceServerPlan, func(sacloud.APICaller) interface{} {
+		return plans
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceServerPlan, func(sacloud.APICaller) interface{} {
+		return fake.NewServerPlanOp()
+	})
+
+	s := &serverClient{}
+	spec := &infrav1.SakuraCloudMachineSpec{CPUs: 2, MemoryGB: 4}
+
+	// the newest available plan is used
+	plan, err := s.FindServerPlan(context.Background(), "is1a", spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(plan.ID).To(gomega.Equal(sacloudtypes.ID(100002004)))
+	g.Expect(plans.condition.Filter).To(gomega.Equal(search.Filter{
+		search.Key("CPU"):        2,
+		search.Key("MemoryMB"):   4096,
+		search.Key("Commitment"): sacloudtypes.Commitments.Standard,
+	}))
+	g.Expect(plans.condition.Sort).To(gomega.Equal(search.SortKeys{{Key: "Generation", Order: search.SortDesc}}))
+
+	// the generation and the commitment are filtered if specified
+	spec.Generation = 200
+	spec.Commitment = infrav1.CommitmentDedicatedCPU
+	plans.plans = plans.plans[:1]
+	plan, err = s.FindServerPlan(context.Background(), "is1a", spec)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(plan).To(gomega.BeNil())
+	g.Expect(plans.condition.Filter).To(gomega.HaveKeyWithValue(search.Key("Generation"), 200))
+	g.Expect(plans.condition.Filter).To(gomega.HaveKeyWithValue(search.Key("Commitment"), sacloudtypes.Commitments.DedicatedCPU))
+}
+
+func TestCreateBuilderPlan(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	s := &serverClient{}
+	param := &ServerBuildParameter{
+		ServerName: "caps-example-md-0-xxxxx",
+		Spec: infrav1.SakuraCloudMachineSpec{
+			CPUs:            2,
+			MemoryGB:        4,
+			Commitment:      infrav1.CommitmentDedicatedCPU,
+			InterfaceDriver: infrav1.InterfaceDriverE1000,
+		},
+	}
+
+	// the default generation of the zone
+	builder, _ := s.createBuilder("is1a", param)
+	g.Expect(builder.Generation).To(gomega.Equal(sacloudtypes.PlanGenerations.Default))
+	g.Expect(builder.Commitment).To(gomega.Equal(sacloudtypes.Commitments.DedicatedCPU))
+	g.Expect(builder.InterfaceDriver).To(gomega.Equal(sacloudtypes.InterfaceDrivers.E1000))
+
+	// the generation of the plan found by FindServerPlan takes precedence
+	param.PlanGeneration = 200
+	builder, _ = s.createBuilder("is1a", param)
+	g.Expect(builder.Generation).To(gomega.Equal(sacloudtypes.PlanGenerations.G200))
+
+	param.PlanGeneration = 0
+	param.Spec.Generation = 100
+	builder, _ = s.createBuilder("is1a", param)
+	g.Expect(builder.Generation).To(gomega.Equal(sacloudtypes.PlanGenerations.G100))
+}
+
+func TestDeleteWithDisks(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	s := &serverClient{}
+	sv, err := s.serverOp().Create(ctx, zone, &sacloud.ServerCreateRequest{Name: "caps-example-md-0-a", CPU: 2, MemoryMB: 4096})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	var diskIDs []sacloudtypes.ID
+	for _, name := range []string{"caps-example-md-0-a-0", "caps-example-md-0-a-1"} {
+		disk, err := s.diskOp().Create(ctx, zone, &sacloud.DiskCreateRequest{Name: name, SizeMB: 20 * 1024}, nil)
+		g.Expect(err).NotTo(gomega.HaveOccurred())
+		diskIDs = append(diskIDs, disk.ID)
+	}
+
+	// the disk already deleted by hand is skipped
+	g.Expect(s.diskOp().Delete(ctx, zone, diskIDs[0])).To(gomega.Succeed())
+	g.Expect(s.deleteWithDisks(ctx, zone, sv.ID, diskIDs)).To(gomega.Succeed())
+	_, err = s.serverOp().Read(ctx, zone, sv.ID)
+	g.Expect(sacloud.IsNotFoundError(err)).To(gomega.BeTrue())
+	_, err = s.diskOp().Read(ctx, zone, diskIDs[1])
+	g.Expect(sacloud.IsNotFoundError(err)).To(gomega.BeTrue())
+
+	// the server already deleted
+	g.Expect(s.deleteWithDisks(ctx, zone, sv.ID, diskIDs)).To(gomega.Succeed())
+}
+
+func TestProvisionDeletesServerLeftByFailedBuild(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	// the fake has the plans only in the real zones
+	sacloud.SetClientFactoryFunc(fake.ResourceDiskPlan, func(sacloud.APICaller) interface{} {
+		return &realZoneDiskPlanOp{DiskPlanAPI: fake.NewDiskPlanOp()}
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceDiskPlan, func(sacloud.APICaller) interface{} {
+		return fake.NewDiskPlanOp()
+	})
+	// the disk can't be created after the server is created
+	sacloud.SetClientFactoryFunc(fake.ResourceDisk, func(sacloud.APICaller) interface{} {
+		return &failingDiskCreateOp{DiskAPI: fake.NewDiskOp()}
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceDisk, func(sacloud.APICaller) interface{} {
+		return fake.NewDiskOp()
+	})
+
+	ctx := context.Background()
+	zone := newFakeZone()
+	jobs := &jobRegistry{}
+	s := &serverClient{
+		jobs:         jobs,
+		queue:        newProvisionQueue(1),
+		reservations: newQuotaReservations(),
+	}
+	archive, err := s.archiveOp().Create(ctx, zone, &sacloud.ArchiveCreateRequest{Name: "ubuntu"})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	param := &ServerBuildParameter{
+		ServerName:      "caps-example-md-0-a",
+		ClusterName:     "caps-example",
+		NameSpace:       "default",
+		SourceArchiveID: archive.ID.String(),
+		Spec:            infrav1.SakuraCloudMachineSpec{CPUs: 2, MemoryGB: 4, DiskGB: 20},
+	}
+	build := func() *JobStatus {
+		jobID := s.Provision(ctx, zone, param)
+		g.Eventually(func() JobState { return jobs.get(jobID).snapshot().State }).Should(gomega.BeEquivalentTo(JobStateFailed))
+		return jobs.get(jobID).snapshot()
+	}
+
+	// the server is deleted, and the build is retried
+	job := build()
+	g.Expect(IsRetryableError(job.Error)).To(gomega.BeTrue())
+	g.Expect(job.Reference).To(gomega.BeNil())
+	servers, err := s.serverOp().Find(ctx, zone, &sacloud.FindCondition{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(servers.Servers).To(gomega.BeEmpty())
+
+	// the server which can't be deleted is adopted, and the failure isn't retried
+	sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return &failingServerDeleteOp{ServerAPI: fake.NewServerOp()}
+	})
+	defer sacloud.SetClientFactoryFunc(fake.ResourceServer, func(sacloud.APICaller) interface{} {
+		return fake.NewServerOp()
+	})
+	jobs.delete(job.ID)
+	job = build()
+	g.Expect(IsRetryableError(job.Error)).To(gomega.BeFalse())
+	servers, err = s.serverOp().Find(ctx, zone, &sacloud.FindCondition{})
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(servers.Servers).To(gomega.HaveLen(1))
+	g.Expect(job.Reference).To(gomega.Equal(&CloudObjectRef{ServerID: servers.Servers[0].ID}))
+}
+
+type realZoneDiskPlanOp struct {
+	sacloud.DiskPlanAPI
+}
+
+func (o *realZoneDiskPlanOp) Read(ctx context.Context, zone string, id sacloudtypes.ID) (*sacloud.DiskPlan, error) {
+	return o.DiskPlanAPI.Read(ctx, "is1a", id)
+}
+
+type failingDiskCreateOp struct {
+	sacloud.DiskAPI
+}
+
+func (o *failingDiskCreateOp) Create(ctx context.Context, zone string, param *sacloud.DiskCreateRequest, distantFrom []sacloudtypes.ID) (*sacloud.Disk, error) {
+	return nil, sacloud.NewAPIError(http.MethodPost, nil, "", http.StatusServiceUnavailable, nil)
+}
+
+type failingServerDeleteOp struct {
+	sacloud.ServerAPI
+}
+
+func (o *failingServerDeleteOp) Delete(ctx context.Context, zone string, id sacloudtypes.ID) error {
+	return errors.New("server is locked")
+}
+
+func (o *failingServerDeleteOp) DeleteWithDisks(ctx context.Context, zone string, id sacloudtypes.ID, disks *sacloud.ServerDeleteWithDisksRequest) error {
+	return errors.New("server is locked")
+}
+
+type stubServerPlanOp struct {
+	sacloud.ServerPlanAPI
+	plans     []*sacloud.ServerPlan
+	condition *sacloud.FindCondition
+}
+
+func (o *stubServerPlanOp) Find(ctx context.Context, zone string, conditions *sacloud.FindCondition) (*sacloud.ServerPlanFindResult, error) {
+	o.condition = conditions
+	return &sacloud.ServerPlanFindResult{Total: len(o.plans), Count: len(o.plans), ServerPlans: o.plans}, nil
+}
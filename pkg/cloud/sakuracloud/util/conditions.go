@@ -0,0 +1,61 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+// GetCondition returns the condition of the type, or nil if it isn't set.
+func GetCondition(conditions []infrav1.Condition, conditionType infrav1.ConditionType) *infrav1.Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds or updates the condition of the type.
+// LastTransitionTime is only updated when the status changes.
+func SetCondition(conditions []infrav1.Condition, conditionType infrav1.ConditionType, status corev1.ConditionStatus, reason, message string) []infrav1.Condition {
+	if current := GetCondition(conditions, conditionType); current != nil {
+		if current.Status != status {
+			current.Status = status
+			current.LastTransitionTime = metav1.Now()
+		}
+		current.Reason = reason
+		current.Message = message
+		return conditions
+	}
+	return append(conditions, infrav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// IsConditionTrue returns true if the condition of the type is set to True.
+func IsConditionTrue(conditions []infrav1.Condition, conditionType infrav1.ConditionType) bool {
+	condition := GetCondition(conditions, conditionType)
+	return condition != nil && condition.Status == corev1.ConditionTrue
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestSetCondition(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	var conditions []infrav1.Condition
+	conditions = SetCondition(conditions, infrav1.ConditionTypePoweredOn, corev1.ConditionTrue, "PoweredOn", "")
+	g.Expect(conditions).To(gomega.HaveLen(1))
+	g.Expect(IsConditionTrue(conditions, infrav1.ConditionTypePoweredOn)).To(gomega.BeTrue())
+	transitioned := conditions[0].LastTransitionTime
+
+	// the transition time is kept while the status is unchanged
+	conditions = SetCondition(conditions, infrav1.ConditionTypePoweredOn, corev1.ConditionTrue, "PoweredOn", "still up")
+	g.Expect(conditions).To(gomega.HaveLen(1))
+	g.Expect(conditions[0].LastTransitionTime).To(gomega.Equal(transitioned))
+	g.Expect(conditions[0].Message).To(gomega.Equal("still up"))
+
+	conditions = SetCondition(conditions, infrav1.ConditionTypePoweredOn, corev1.ConditionFalse, "PoweredOff", "")
+	g.Expect(conditions).To(gomega.HaveLen(1))
+	g.Expect(IsConditionTrue(conditions, infrav1.ConditionTypePoweredOn)).To(gomega.BeFalse())
+	g.Expect(GetCondition(conditions, infrav1.ConditionType("Unknown"))).To(gomega.BeNil())
+}
@@ -40,11 +40,19 @@ func NewKubeClient(
 			cluster.Name, cluster.Namespace)
 	}
 
-	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	kubeClient, err := newKubeClientFromKubeConfig(kubeconfig)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create client configuration for Cluster %q in namespace %q",
 			cluster.Name, cluster.Namespace)
 	}
 
+	return kubeClient, nil
+}
+
+func newKubeClientFromKubeConfig(kubeconfig []byte) (kubernetes.Interface, error) {
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
 	return kubernetes.NewForConfig(restConfig)
 }
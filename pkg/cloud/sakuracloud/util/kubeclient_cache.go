@@ -0,0 +1,225 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// kubeClientHealthCheckInterval is the interval at which a cached client
+	// for a healthy workload cluster is probed again.
+	kubeClientHealthCheckInterval = time.Minute
+
+	// kubeClientHealthCheckTimeout is the timeout of a single health probe.
+	kubeClientHealthCheckTimeout = 10 * time.Second
+
+	// kubeClientMinBackoff and kubeClientMaxBackoff bound the wait before an
+	// unreachable workload cluster is probed again.
+	kubeClientMinBackoff = 10 * time.Second
+	kubeClientMaxBackoff = 5 * time.Minute
+)
+
+// ClusterUnreachableError is returned by KubeClientCache when the workload
+// cluster failed its last health check and is still backing off.
+type ClusterUnreachableError struct {
+	// Cluster is the namespace/name of the unreachable cluster.
+	Cluster string
+	// RetryAfter is the remaining time until the cluster is probed again.
+	RetryAfter time.Duration
+	// Err is the error returned by the last health check.
+	Err error
+}
+
+func (e *ClusterUnreachableError) Error() string {
+	return fmt.Sprintf("cluster %s is unreachable, retry after %s: %v", e.Cluster, e.RetryAfter, e.Err)
+}
+
+// IsClusterUnreachable returns the ClusterUnreachableError wrapped in err, if any.
+func IsClusterUnreachable(err error) (*ClusterUnreachableError, bool) {
+	e, ok := errors.Cause(err).(*ClusterUnreachableError)
+	return e, ok
+}
+
+type kubeClientCacheEntry struct {
+	// lock serializes the health checks of the cluster
+	lock sync.Mutex
+
+	client          kubernetes.Interface
+	secretVersion   string
+	lastCheck       time.Time
+	lastCheckFailed error
+	backoff         time.Duration
+}
+
+// KubeClientCache caches clients for workload clusters keyed by the cluster's UID.
+//
+// A cached client is dropped when the kubeconfig Secret of the cluster changes
+// or when the cluster is removed from the cache with Delete.
+type KubeClientCache struct {
+	// lock guards entries only, so that an unreachable cluster doesn't block the others
+	lock    sync.Mutex
+	entries map[apitypes.UID]*kubeClientCacheEntry
+
+	// these are replaced in tests
+	now       func() time.Time
+	newClient func(kubeconfig []byte) (kubernetes.Interface, error)
+	probe     func(client kubernetes.Interface) error
+}
+
+// NewKubeClientCache returns a new, empty KubeClientCache.
+func NewKubeClientCache() *KubeClientCache {
+	return &KubeClientCache{
+		entries:   map[apitypes.UID]*kubeClientCacheEntry{},
+		now:       time.Now,
+		newClient: newKubeClientFromKubeConfig,
+		probe:     probeKubeClient,
+	}
+}
+
+var defaultKubeClientCache = NewKubeClientCache()
+
+// GetOrCreateKubeClient returns a client for the target cluster from the
+// default cache, creating one from the KubeConfig secret stored in the
+// management cluster when needed.
+func GetOrCreateKubeClient(
+	ctx context.Context,
+	controllerClient client.Client,
+	cluster *clusterv1.Cluster) (kubernetes.Interface, error) {
+
+	return defaultKubeClientCache.Get(ctx, controllerClient, cluster)
+}
+
+// DeleteKubeClient removes the client of the target cluster from the default cache.
+func DeleteKubeClient(cluster *clusterv1.Cluster) {
+	defaultKubeClientCache.Delete(cluster)
+}
+
+// Get returns a healthy client for the target cluster.
+func (c *KubeClientCache) Get(
+	ctx context.Context,
+	controllerClient client.Client,
+	cluster *clusterv1.Cluster) (kubernetes.Interface, error) {
+
+	kubeconfigSecret, err := secret.Get(controllerClient, cluster, secret.Kubeconfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to retrieve kubeconfig secret for Cluster %q in namespace %q",
+			cluster.Name, cluster.Namespace)
+	}
+
+	entry, err := c.getOrCreateEntry(cluster, kubeconfigSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	now := c.now()
+	if !entry.lastCheck.IsZero() {
+		next := entry.lastCheck.Add(kubeClientHealthCheckInterval)
+		if entry.lastCheckFailed != nil {
+			next = entry.lastCheck.Add(entry.backoff)
+		}
+		if now.Before(next) {
+			if entry.lastCheckFailed != nil {
+				return nil, &ClusterUnreachableError{
+					Cluster:    fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name),
+					RetryAfter: next.Sub(now),
+					Err:        entry.lastCheckFailed,
+				}
+			}
+			return entry.client, nil
+		}
+	}
+
+	entry.lastCheck = now
+	if err := c.probe(entry.client); err != nil {
+		entry.lastCheckFailed = err
+		switch {
+		case entry.backoff == 0:
+			entry.backoff = kubeClientMinBackoff
+		case entry.backoff*2 > kubeClientMaxBackoff:
+			entry.backoff = kubeClientMaxBackoff
+		default:
+			entry.backoff *= 2
+		}
+		return nil, &ClusterUnreachableError{
+			Cluster:    fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name),
+			RetryAfter: entry.backoff,
+			Err:        err,
+		}
+	}
+	entry.lastCheckFailed = nil
+	entry.backoff = 0
+	return entry.client, nil
+}
+
+// getOrCreateEntry returns the entry of the target cluster, replacing it if the kubeconfig Secret has changed.
+func (c *KubeClientCache) getOrCreateEntry(cluster *clusterv1.Cluster, kubeconfigSecret *corev1.Secret) (*kubeClientCacheEntry, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[cluster.UID]
+	if ok && entry.secretVersion == kubeconfigSecret.ResourceVersion {
+		return entry, nil
+	}
+
+	kubeconfig, ok := kubeconfigSecret.Data[secret.KubeconfigDataName]
+	if !ok {
+		return nil, errors.Errorf("missing key %q in kubeconfig secret for Cluster %q in namespace %q",
+			secret.KubeconfigDataName, cluster.Name, cluster.Namespace)
+	}
+	kubeClient, err := c.newClient(kubeconfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create client for Cluster %q in namespace %q",
+			cluster.Name, cluster.Namespace)
+	}
+	entry = &kubeClientCacheEntry{
+		client:        kubeClient,
+		secretVersion: kubeconfigSecret.ResourceVersion,
+	}
+	c.entries[cluster.UID] = entry
+	return entry, nil
+}
+
+// Delete removes the client of the target cluster from the cache.
+func (c *KubeClientCache) Delete(cluster *clusterv1.Cluster) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, cluster.UID)
+}
+
+func probeKubeClient(kubeClient kubernetes.Interface) error {
+	return kubeClient.Discovery().RESTClient().
+		Get().
+		AbsPath("/healthz").
+		Timeout(kubeClientHealthCheckTimeout).
+		Do().
+		Error()
+}
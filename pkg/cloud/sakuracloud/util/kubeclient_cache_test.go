@@ -0,0 +1,160 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/onsi/gomega"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKubeClientCache(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cluster := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "foo-uid"},
+	}
+	kubeconfigSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-kubeconfig", Namespace: "default"},
+		Data:       map[string][]byte{"value": []byte("kubeconfig")},
+	}
+	controllerClient := fake.NewFakeClientWithScheme(clientgoscheme.Scheme, kubeconfigSecret)
+
+	now := time.Now()
+	created := 0
+	var probeErr error
+
+	cache := NewKubeClientCache()
+	cache.now = func() time.Time { return now }
+	cache.newClient = func([]byte) (kubernetes.Interface, error) {
+		created++
+		return fakekube.NewSimpleClientset(), nil
+	}
+	cache.probe = func(kubernetes.Interface) error { return probeErr }
+
+	// the client is created once and then reused
+	first, err := cache.Get(context.Background(), controllerClient, cluster)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	second, err := cache.Get(context.Background(), controllerClient, cluster)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(second).To(gomega.BeIdenticalTo(first))
+	g.Expect(created).To(gomega.Equal(1))
+
+	// a changed kubeconfig secret invalidates the cached client
+	kubeconfigSecret.Data["value"] = []byte("rotated")
+	kubeconfigSecret.ResourceVersion = "2"
+	g.Expect(controllerClient.Update(context.Background(), kubeconfigSecret)).To(gomega.Succeed())
+	third, err := cache.Get(context.Background(), controllerClient, cluster)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(third).NotTo(gomega.BeIdenticalTo(first))
+	g.Expect(created).To(gomega.Equal(2))
+
+	// an unreachable cluster backs off until the next probe
+	probeErr = errors.New("connection refused")
+	now = now.Add(kubeClientHealthCheckInterval)
+	_, err = cache.Get(context.Background(), controllerClient, cluster)
+	unreachable, ok := IsClusterUnreachable(err)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(unreachable.RetryAfter).To(gomega.Equal(kubeClientMinBackoff))
+
+	now = now.Add(kubeClientMinBackoff / 2)
+	_, err = cache.Get(context.Background(), controllerClient, cluster)
+	unreachable, ok = IsClusterUnreachable(err)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(unreachable.RetryAfter).To(gomega.Equal(kubeClientMinBackoff / 2))
+
+	now = now.Add(kubeClientMinBackoff / 2)
+	_, err = cache.Get(context.Background(), controllerClient, cluster)
+	unreachable, ok = IsClusterUnreachable(err)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(unreachable.RetryAfter).To(gomega.Equal(2 * kubeClientMinBackoff))
+
+	// the cluster recovers
+	probeErr = nil
+	now = now.Add(2 * kubeClientMinBackoff)
+	_, err = cache.Get(context.Background(), controllerClient, cluster)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	// deleting the cluster drops the client
+	cache.Delete(cluster)
+	_, err = cache.Get(context.Background(), controllerClient, cluster)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(created).To(gomega.Equal(3))
+}
+
+func TestKubeClientCacheProbesClustersIndependently(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	slow := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "slow", Namespace: "default", UID: "slow-uid"},
+	}
+	fast := &clusterv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "fast", Namespace: "default", UID: "fast-uid"},
+	}
+	controllerClient := fake.NewFakeClientWithScheme(clientgoscheme.Scheme,
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "slow-kubeconfig", Namespace: "default"},
+			Data:       map[string][]byte{"value": []byte("slow")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "fast-kubeconfig", Namespace: "default"},
+			Data:       map[string][]byte{"value": []byte("fast")},
+		},
+	)
+
+	clients := map[string]kubernetes.Interface{}
+	release := make(chan struct{})
+	probing := make(chan struct{})
+
+	cache := NewKubeClientCache()
+	cache.newClient = func(kubeconfig []byte) (kubernetes.Interface, error) {
+		client := fakekube.NewSimpleClientset()
+		clients[string(kubeconfig)] = client
+		return client, nil
+	}
+	cache.probe = func(client kubernetes.Interface) error {
+		if client == clients["slow"] {
+			close(probing)
+			<-release
+		}
+		return nil
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := cache.Get(context.Background(), controllerClient, slow)
+		done <- err
+	}()
+	<-probing
+
+	// the probe of the slow cluster doesn't block the other clusters
+	_, err := cache.Get(context.Background(), controllerClient, fast)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+
+	close(release)
+	g.Expect(<-done).NotTo(gomega.HaveOccurred())
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	apitypes "k8s.io/apimachinery/pkg/types"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
 	clusterutilv1 "sigs.k8s.io/cluster-api/util"
@@ -79,6 +80,32 @@ func GetSakuraCloudMachinesInCluster(
 	return machines, nil
 }
 
+// GetSakuraCloudMachinesForMachines gets the SakuraCloudMachine resources referred by the infrastructure
+// references of the CAPI Machines, keyed by the Machine names.
+// Machines whose SakuraCloudMachine doesn't exist are skipped.
+func GetSakuraCloudMachinesForMachines(
+	ctx context.Context,
+	controllerClient client.Client,
+	machines []*clusterv1.Machine) (map[string]*infrav1.SakuraCloudMachine, error) {
+
+	sakuracloudMachines := map[string]*infrav1.SakuraCloudMachine{}
+	for _, machine := range machines {
+		ref := machine.Spec.InfrastructureRef
+		if ref.Kind != "SakuraCloudMachine" || ref.Name == "" {
+			continue
+		}
+		sakuracloudMachine, err := GetSakuraCloudMachine(ctx, controllerClient, machine.Namespace, ref.Name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		sakuracloudMachines[machine.Name] = sakuracloudMachine
+	}
+	return sakuracloudMachines, nil
+}
+
 // GetSakuraCloudMachine gets a SakuraCloudMachine resource for the given CAPI Machine.
 func GetSakuraCloudMachine(
 	ctx context.Context,
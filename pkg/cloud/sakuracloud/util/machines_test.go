@@ -0,0 +1,61 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestGetSakuraCloudMachinesForMachines(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	scheme := runtime.NewScheme()
+	g.Expect(infrav1.AddToScheme(scheme)).To(gomega.Succeed())
+
+	// the SakuraCloudMachine cloned from the template has a generated name
+	cloned := &infrav1.SakuraCloudMachine{ObjectMeta: metav1.ObjectMeta{Name: "caps-example-md-0-xxxxx", Namespace: "default"}}
+	controllerClient := fake.NewFakeClientWithScheme(scheme, cloned)
+
+	machine := func(name, infraName string) *clusterv1.Machine {
+		return &clusterv1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: clusterv1.MachineSpec{
+				InfrastructureRef: corev1.ObjectReference{Kind: "SakuraCloudMachine", Name: infraName},
+			},
+		}
+	}
+	machines := []*clusterv1.Machine{
+		machine("caps-example-md-0-abcde-fghij", "caps-example-md-0-xxxxx"),
+		machine("caps-example-md-0-abcde-klmno", "deleted"),
+	}
+
+	sakuracloudMachines, err := GetSakuraCloudMachinesForMachines(context.Background(), controllerClient, machines)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	g.Expect(sakuracloudMachines).To(gomega.HaveLen(1))
+	g.Expect(sakuracloudMachines).To(gomega.HaveKey("caps-example-md-0-abcde-fghij"))
+	g.Expect(sakuracloudMachines["caps-example-md-0-abcde-fghij"].Name).To(gomega.Equal("caps-example-md-0-xxxxx"))
+}
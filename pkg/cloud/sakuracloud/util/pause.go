@@ -0,0 +1,45 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/constants"
+)
+
+// PauseReason returns why the reconciliation of the objects must not change
+// anything on SakuraCloud, or an empty string if it is not paused.
+// The cluster is paused by the paused annotation, and the objects are in
+// maintenance by the maintenance annotation.
+func PauseReason(cluster *clusterv1.Cluster, objects ...metav1.Object) string {
+	if cluster != nil {
+		if _, ok := cluster.Annotations[constants.PausedAnnotation]; ok {
+			return "ClusterPaused"
+		}
+	}
+	for _, obj := range objects {
+		if obj == nil {
+			continue
+		}
+		if _, ok := obj.GetAnnotations()[constants.MaintenanceAnnotationLabel]; ok {
+			return "Maintenance"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+	"github.com/sacloud/cluster-api-provider-sakuracloud/pkg/cloud/sakuracloud/constants"
+)
+
+func TestPauseReason(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	cluster := &clusterv1.Cluster{}
+	machine := &infrav1.SakuraCloudMachine{}
+	g.Expect(PauseReason(cluster, machine)).To(gomega.BeEmpty())
+
+	machine.Annotations = map[string]string{constants.MaintenanceAnnotationLabel: ""}
+	g.Expect(PauseReason(cluster, machine)).To(gomega.Equal("Maintenance"))
+
+	cluster.ObjectMeta = metav1.ObjectMeta{Annotations: map[string]string{constants.PausedAnnotation: "true"}}
+	g.Expect(PauseReason(cluster, machine)).To(gomega.Equal("ClusterPaused"))
+	g.Expect(PauseReason(cluster)).To(gomega.Equal("ClusterPaused"))
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+// SelectZone returns the zone with the fewest machines which have the same
+// role(control plane or not) as the machine to be created.
+// The roles are read from the CAPI Machines because SakuraCloudMachines cloned from templates don't have the labels,
+// and sakuracloudMachines is the SakuraCloudMachines of the Machines keyed by the Machine names.
+// Ties are broken by the order of zones.
+func SelectZone(zones []string, machines []*clusterv1.Machine, sakuracloudMachines map[string]*infrav1.SakuraCloudMachine, isControlPlane bool) string {
+	if len(zones) == 0 {
+		return ""
+	}
+
+	counts := map[string]int{}
+	for _, machine := range machines {
+		if !machine.DeletionTimestamp.IsZero() || IsControlPlaneMachine(machine) != isControlPlane {
+			continue
+		}
+		sakuracloudMachine, ok := sakuracloudMachines[machine.Name]
+		if !ok || sakuracloudMachine.Spec.Zone == nil {
+			continue
+		}
+		counts[*sakuracloudMachine.Spec.Zone]++
+	}
+
+	selected := zones[0]
+	for _, zone := range zones[1:] {
+		if counts[zone] < counts[selected] {
+			selected = zone
+		}
+	}
+	return selected
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha2"
+
+	infrav1 "github.com/sacloud/cluster-api-provider-sakuracloud/api/v1alpha2"
+)
+
+func TestSelectZone(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+
+	var machines []*clusterv1.Machine
+	sakuracloudMachines := map[string]*infrav1.SakuraCloudMachine{}
+	machine := func(name, zone string, isControlPlane bool) *clusterv1.Machine {
+		m := &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if isControlPlane {
+			m.Labels = map[string]string{clusterv1.MachineControlPlaneLabelName: "true"}
+		}
+		// SakuraCloudMachines cloned from templates don't have the labels
+		sakuracloudMachine := &infrav1.SakuraCloudMachine{}
+		if zone != "" {
+			sakuracloudMachine.Spec.Zone = &zone
+		}
+		machines = append(machines, m)
+		sakuracloudMachines[name] = sakuracloudMachine
+		return m
+	}
+	zones := []string{"is1a", "is1b", "tk1a"}
+
+	g.Expect(SelectZone(nil, nil, nil, false)).To(gomega.BeEmpty())
+	g.Expect(SelectZone(zones, nil, nil, false)).To(gomega.Equal("is1a"))
+
+	machine("controlplane-0", "is1a", true)
+	machine("controlplane-1", "is1b", true)
+	machine("md-0-aaaaa", "is1a", false)
+	machine("md-0-bbbbb", "", false)
+	g.Expect(SelectZone(zones, machines, sakuracloudMachines, true)).To(gomega.Equal("tk1a"))
+	g.Expect(SelectZone(zones, machines, sakuracloudMachines, false)).To(gomega.Equal("is1b"))
+
+	// machines being deleted and machines without SakuraCloudMachine are not counted
+	machine("md-0-ccccc", "is1b", false)
+	deleting := machine("md-0-ddddd", "tk1a", false)
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	machines = append(machines, &clusterv1.Machine{ObjectMeta: metav1.ObjectMeta{Name: "md-0-eeeee"}})
+	g.Expect(SelectZone(zones, machines, sakuracloudMachines, false)).To(gomega.Equal("tk1a"))
+}
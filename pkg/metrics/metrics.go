@@ -0,0 +1,61 @@
+/*
+Copyright 2019 Kazumichi Yamamoto.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	provisioningQueueWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "caps_provisioning_queue_waiting",
+		Help: "Number of servers waiting in the provisioning queue",
+	}, []string{"zone"})
+
+	provisioningQueueRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "caps_provisioning_queue_running",
+		Help: "Number of servers being provisioned",
+	}, []string{"zone"})
+
+	estimatedCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "caps_estimated_cost_jpy",
+		Help: "Estimated cost of the SakuraCloud resources of clusters and machines in JPY",
+	}, []string{"kind", "namespace", "name", "period"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(provisioningQueueWaiting, provisioningQueueRunning, estimatedCost)
+}
+
+// SetProvisioningQueueDepth records the number of the servers waiting and being provisioned in the zone.
+func SetProvisioningQueueDepth(zone string, waiting, running int) {
+	provisioningQueueWaiting.WithLabelValues(zone).Set(float64(waiting))
+	provisioningQueueRunning.WithLabelValues(zone).Set(float64(running))
+}
+
+// SetEstimatedCost records the estimated hourly and monthly cost of the resources of a cluster or a machine.
+func SetEstimatedCost(kind, namespace, name string, hourly, monthly int) {
+	estimatedCost.WithLabelValues(kind, namespace, name, "hourly").Set(float64(hourly))
+	estimatedCost.WithLabelValues(kind, namespace, name, "monthly").Set(float64(monthly))
+}
+
+// DeleteEstimatedCost removes the estimated cost of a deleted cluster or machine.
+func DeleteEstimatedCost(kind, namespace, name string) {
+	estimatedCost.DeleteLabelValues(kind, namespace, name, "hourly")
+	estimatedCost.DeleteLabelValues(kind, namespace, name, "monthly")
+}